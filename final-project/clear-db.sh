@@ -1,4 +1,5 @@
-curl -X DELETE http://localhost:8000/billings/removeAllBillings
-curl -X DELETE http://localhost:8000/tasks/removeAllTasks
-curl -X DELETE http://localhost:8000/users/delete-all
+# The API has no bulk delete routes; drop the service databases directly
+docker exec user-mongodb mongosh --quiet user --eval 'db.dropDatabase()'
+docker exec task-mongodb mongosh --quiet taskmanagement --eval 'db.dropDatabase()'
+docker exec billing-mongodb mongosh --quiet billing --eval 'db.dropDatabase()'
 echo "clearing db done"
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/auth"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+)
+
+// UpstreamStatus is an upstream's balancing and failure state.
+type UpstreamStatus struct {
+	Name           string           `json:"name"`
+	Balancer       string           `json:"balancer"`
+	CircuitBreaker BreakerStatus    `json:"circuit_breaker"`
+	Instances      []InstanceStatus `json:"instances"`
+}
+
+type InstanceStatus struct {
+	URL                 string     `json:"url"`
+	Healthy             bool       `json:"healthy"`
+	EjectedUntil        *time.Time `json:"ejected_until,omitempty"`
+	InFlight            int64      `json:"in_flight"`
+	ConsecutiveFailures int64      `json:"consecutive_failures"`
+}
+
+// listUpstreams shows admins the state of every upstream.
+func listUpstreams(w http.ResponseWriter, r *http.Request) {
+	table := routes.Load()
+	now := time.Now()
+
+	statuses := []UpstreamStatus{}
+	for _, up := range table.upstreams {
+		status := UpstreamStatus{
+			Name:           up.name,
+			Balancer:       up.config.Balancer,
+			CircuitBreaker: up.breaker.status(),
+			Instances:      []InstanceStatus{},
+		}
+		for _, t := range up.targets {
+			instance := InstanceStatus{
+				URL:                 t.url.String(),
+				Healthy:             !t.unhealthy.Load(),
+				InFlight:            t.inFlight.Load(),
+				ConsecutiveFailures: t.failures.Load(),
+			}
+			if until := time.Unix(0, t.ejectedUntil.Load()); until.After(now) {
+				instance.EjectedUntil = &until
+			}
+			status.Instances = append(status.Instances, instance)
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// adminMiddleware only lets requests with an admin's token through. The
+// services check tokens themselves; this is for the gateway's own routes.
+func adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := auth.Claims(r)
+		if claims == nil {
+			problem.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		if role, _ := claims["role"].(string); role != "admin" {
+			problem.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
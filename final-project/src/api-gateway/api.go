@@ -2,38 +2,40 @@ package main
 
 import (
     "bytes"
+    "context"
     "encoding/json"
     "io"
     "log"
+    "log/slog"
     "net/http"
-    "net/http/httputil"
-    "net/url"
+
+    "github.com/DavidN0809/Cloud-Computing/final-project/shared/logging"
+    "github.com/DavidN0809/Cloud-Computing/final-project/shared/metrics"
+    "github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+    "github.com/DavidN0809/Cloud-Computing/final-project/shared/server"
+    "github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
 )
 
 func main() {
-    mux := http.NewServeMux()
-
-    // Wrap handlers with CORS middleware using mux.Handle
-    mux.Handle("/users/", corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        userServiceURL, _ := url.Parse("http://user-service:8001")
-        userServiceProxy := httputil.NewSingleHostReverseProxy(userServiceURL)
-        userServiceProxy.ServeHTTP(w, r)
-    })))
-
-    mux.Handle("/tasks/", corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        forwardRequest(w, r, "http://task-service:8002")
-    })))
+    logging.Setup("api-gateway")
+    shutdownTracing := tracing.Setup("api-gateway")
+    defer shutdownTracing(context.Background())
 
-    mux.Handle("/billings/", corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        forwardRequest(w, r, "http://billing-service:8003")
-    })))
+    if err := loadOpenAPI(); err != nil {
+        log.Fatal("Invalid OpenAPI document: ", err)
+    }
 
-    // Note the change to mux.Handle here as well
-    mux.Handle("/auth/login", corsMiddleware(http.HandlerFunc(handleLogin)))
-    mux.Handle("/auth/register", corsMiddleware(http.HandlerFunc(handleRegister)))
+    // Routes and upstreams come from the gateway configuration file
+    path := configPath()
+    loaded, err := loadConfig(path)
+    if err != nil {
+        log.Fatal("Invalid gateway configuration: ", err)
+    }
+    go watchConfig(path, loaded)
+    go serveInternal()
 
-    log.Println("API Gateway listening on port 8000...")
-    log.Fatal(http.ListenAndServe(":8000", mux))
+    slog.Info("API Gateway listening on port 8000")
+    server.Run(":8000", tracing.Middleware(logging.Middleware(metrics.Middleware(apiKeyMiddleware(openapiMiddleware(http.HandlerFunc(serveRoute))), openapiRoute)), openapiRoute))
 }
 
 func corsMiddleware(next http.Handler) http.Handler {
@@ -45,8 +47,9 @@ func corsMiddleware(next http.Handler) http.Handler {
         if w.Header().Get("Access-Control-Allow-Origin") == "" {
             w.Header().Set("Access-Control-Allow-Origin", origin)
         }
-        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-        w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+        w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-API-Key, If-Match")
+        w.Header().Set("Access-Control-Expose-Headers", "ETag, X-Request-ID, Deprecation, Link, Retry-After, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset")
         w.Header().Set("Access-Control-Allow-Credentials", "true")
 
         // Handle preflight requests
@@ -60,73 +63,41 @@ func corsMiddleware(next http.Handler) http.Handler {
 }
 
 
-func handleRegister(w http.ResponseWriter, r *http.Request) {
-    var user struct {
-        Username string `json:"username"`
-        Email    string `json:"email"`
-        Password string `json:"password"`
-        Role     string `json:"role"`
-    }
-
-    // Log the raw request body
-    body, err := io.ReadAll(r.Body)
-
-    if err != nil {
-        log.Println("Failed to read request body:", err)
-        http.Error(w, "Failed to read request body", http.StatusInternalServerError)
-        return
-    }
-    log.Printf("Request body: %s", string(body))
-
-
-    log.Printf("Before parsing JSON, body is: %s", string(body))
-    err = json.Unmarshal(body, &user)
-    log.Printf("Parsed user: %+v", user)
-    err = json.Unmarshal(body, &user)
-    if err != nil {
-        log.Println("Failed to parse request body:", err)
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
-        return
-    }
-
-    // Validate user role
-    if user.Role != "admin" && user.Role != "regular" {
-        log.Println("Invalid user role")
-        http.Error(w, "Invalid user role", http.StatusBadRequest)
-        return
-    }
-
-    // Forward the request to the user service
-    userServiceURL, _ := url.Parse("http://user-service:8001")
-    userServiceProxy := httputil.NewSingleHostReverseProxy(userServiceURL)
-    r.URL.Path = "/users/create"
-
-    // Forward the request body
-    r.Body = io.NopCloser(bytes.NewBuffer(body))
-
-    userServiceProxy.ServeHTTP(w, r)
-}
-
-
-func handleLogin(w http.ResponseWriter, r *http.Request) {
-    log.Println("Received request to login user")
+// registerMiddleware only lets self-registration through with a valid role.
+func registerMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var user struct {
+            Username string `json:"username"`
+            Email    string `json:"email"`
+            Password string `json:"password"`
+            Role     string `json:"role"`
+        }
 
-    // Forward the request to the user service
-    userServiceURL, _ := url.Parse("http://user-service:8001")
-    userServiceProxy := httputil.NewSingleHostReverseProxy(userServiceURL)
-    r.URL.Path = "/users/login"
-    userServiceProxy.ServeHTTP(w, r)
-}
+        body, err := io.ReadAll(r.Body)
+        if err != nil {
+            slog.WarnContext(r.Context(), "Failed to read request body", "error", err)
+            problem.Error(w, "Failed to read request body", http.StatusInternalServerError)
+            return
+        }
 
+        err = json.Unmarshal(body, &user)
+        if err != nil {
+            slog.InfoContext(r.Context(), "Invalid registration body", "error", err)
+            problem.Error(w, "Invalid request body", http.StatusBadRequest)
+            return
+        }
 
-func forwardRequest(w http.ResponseWriter, r *http.Request, serviceURL string) {
-    // Forward the JWT token to the downstream service
-    token := r.Header.Get("Authorization")
-    if token != "" {
-        r.Header.Set("Authorization", token)
-    }
+        // Validate user role
+        if user.Role != "admin" && user.Role != "regular" {
+            slog.InfoContext(r.Context(), "Invalid registration role", "role", user.Role)
+            problem.Validation(w, http.StatusUnprocessableEntity, []problem.FieldError{
+                {Field: "role", Message: "must be one of: admin, regular"},
+            })
+            return
+        }
 
-    url, _ := url.Parse(serviceURL)
-    proxy := httputil.NewSingleHostReverseProxy(url)
-    proxy.ServeHTTP(w, r)
+        // Forward the request body
+        r.Body = io.NopCloser(bytes.NewBuffer(body))
+        next.ServeHTTP(w, r)
+    })
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/auth"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+)
+
+// Personal access tokens and service API keys are accepted in place of a
+// JWT, as a bearer token or in X-API-Key. The gateway exchanges a key with
+// the user service for a short-lived JWT carrying the key's scopes and
+// forwards that instead, so the services only ever see JWTs. Exchanged
+// JWTs are cached for a while, which is how long a revoked key can keep
+// working and how precise its last-used time is.
+//
+// Keys without the write scope are read-only: the gateway only lets their
+// safe requests through, and the services refuse the others too. The
+// services check the rest, as for any JWT.
+
+const (
+	// apiKeyPrefix starts every key; JWTs never start with it
+	apiKeyPrefix       = "tm_"
+	apiKeyExchangePath = "/internal/apikeys/exchange"
+	// maxCachedKeys bounds the cache; expired entries are dropped past it
+	maxCachedKeys = 10000
+)
+
+// keyExchanger trades keys for JWTs at an upstream running the user
+// service.
+type keyExchanger struct {
+	upstream *upstream
+	cacheFor time.Duration
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache map[[32]byte]exchangedKey
+}
+
+type exchangedKey struct {
+	Token     string   `json:"token"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int      `json:"expires_in"`
+	until     time.Time
+}
+
+func newKeyExchanger(up *upstream, cacheFor time.Duration) *keyExchanger {
+	return &keyExchanger{
+		upstream: up,
+		cacheFor: cacheFor,
+		client:   &http.Client{Timeout: 10 * time.Second, Transport: upstreamTransport(up.name)},
+		cache:    map[[32]byte]exchangedKey{},
+	}
+}
+
+// keyError is a key the user service did not accept, or could not check.
+type keyError struct {
+	status  int
+	message string
+}
+
+func (e *keyError) Error() string { return e.message }
+
+// exchange returns the JWT for a key, from the cache if it has one.
+func (x *keyExchanger) exchange(r *http.Request, key string) (exchangedKey, error) {
+	hash := sha256.Sum256([]byte(key))
+	now := time.Now()
+	x.mu.Lock()
+	cached, ok := x.cache[hash]
+	x.mu.Unlock()
+	if ok && now.Before(cached.until) {
+		return cached, nil
+	}
+
+	target := x.upstream.pick(r)
+	if target == nil {
+		return exchangedKey{}, &keyError{http.StatusServiceUnavailable, "No healthy instances of " + x.upstream.name + " to check the API key"}
+	}
+	body, _ := json.Marshal(map[string]string{"token": key})
+	ctx, cancel := context.WithTimeout(r.Context(), x.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.url.String()+apiKeyExchangePath, bytes.NewReader(body))
+	if err != nil {
+		return exchangedKey{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", r.Header.Get("X-Request-ID"))
+	resp, err := x.client.Do(req)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "API key exchange failed", "upstream", x.upstream.name, "error", err)
+		return exchangedKey{}, &keyError{http.StatusBadGateway, "Failed to check the API key"}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		var problem struct {
+			Detail string `json:"detail"`
+		}
+		json.NewDecoder(resp.Body).Decode(&problem)
+		if problem.Detail == "" {
+			problem.Detail = "Invalid API key"
+		}
+		return exchangedKey{}, &keyError{http.StatusUnauthorized, problem.Detail}
+	}
+	if resp.StatusCode != http.StatusOK {
+		slog.ErrorContext(r.Context(), "API key exchange failed", "upstream", x.upstream.name, "status", resp.StatusCode)
+		return exchangedKey{}, &keyError{http.StatusBadGateway, "Failed to check the API key"}
+	}
+	var exchanged exchangedKey
+	if err := json.NewDecoder(resp.Body).Decode(&exchanged); err != nil {
+		return exchangedKey{}, fmt.Errorf("decoding exchanged key: %w", err)
+	}
+
+	// Stop using the JWT well before it expires
+	exchanged.until = now.Add(x.cacheFor)
+	if expires := now.Add(time.Duration(exchanged.ExpiresIn) * time.Second / 2); expires.Before(exchanged.until) {
+		exchanged.until = expires
+	}
+	x.mu.Lock()
+	if len(x.cache) >= maxCachedKeys {
+		for cachedHash, entry := range x.cache {
+			if !now.Before(entry.until) {
+				delete(x.cache, cachedHash)
+			}
+		}
+	}
+	x.cache[hash] = exchanged
+	x.mu.Unlock()
+	return exchanged, nil
+}
+
+// requestKey returns the API key a request authenticates with, if any.
+func requestKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); strings.HasPrefix(bearer, apiKeyPrefix) {
+		return bearer
+	}
+	return ""
+}
+
+// safeMethod reports whether a request only reads (RFC 9110, section
+// 9.2.1).
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// apiKeyMiddleware replaces an API key with the JWT it is exchanged for.
+func apiKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := requestKey(r)
+		if key == "" {
+			// The JWTs keys are exchanged for never leave the gateway, so
+			// one sent by a client was taken from somewhere it should not be
+			if claims := auth.Claims(r); claims != nil && claims["key_id"] != nil {
+				problem.Error(w, "Send the API key, not a token made for it", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		exchanger := routes.Load().apiKeys
+		if exchanger == nil {
+			problem.Error(w, "API keys are not accepted", http.StatusUnauthorized)
+			return
+		}
+		exchanged, err := exchanger.exchange(r, key)
+		if err != nil {
+			if keyErr, ok := err.(*keyError); ok {
+				problem.Error(w, keyErr.message, keyErr.status)
+				return
+			}
+			slog.ErrorContext(r.Context(), "API key exchange failed", "error", err)
+			problem.Error(w, "Failed to check the API key", http.StatusBadGateway)
+			return
+		}
+		if !safeMethod(r.Method) && !contains(exchanged.Scopes, "write") {
+			problem.Error(w, "The API key is read-only", http.StatusForbidden)
+			return
+		}
+
+		r.Header.Del("X-API-Key")
+		r.Header.Set("Authorization", "Bearer "+exchanged.Token)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+)
+
+// Each upstream spreads requests over its instances with one of the
+// balancers below. Instances are taken out of rotation in two ways: an
+// active health check polls each one, and an instance whose requests keep
+// failing is ejected for a while. Both end on their own, so instances come
+// back without intervention.
+
+const (
+	roundRobin     = "round-robin"
+	leastConn      = "least-conn"
+	consistentHash = "consistent-hash"
+
+	// ringReplicas is how many points each instance has on the hash ring
+	ringReplicas = 100
+)
+
+// balancers pick an available instance of an upstream, or nil if there is
+// none.
+var balancers = map[string]func(u *upstream, r *http.Request) *target{
+	roundRobin:     pickRoundRobin,
+	leastConn:      pickLeastConn,
+	consistentHash: pickConsistentHash,
+}
+
+// upstream is one backend service. Its proxies are built once per
+// configuration and shared by every request.
+type upstream struct {
+	name    string
+	config  UpstreamConfig
+	targets []*target
+	next    atomic.Uint64
+	ring    []ringPoint
+	breaker *circuitBreaker
+}
+
+type target struct {
+	url   *url.URL
+	proxy *httputil.ReverseProxy
+
+	inFlight atomic.Int64
+	// unhealthy is set while the instance fails its health checks
+	unhealthy atomic.Bool
+	// failures counts consecutive failed requests
+	failures     atomic.Int64
+	ejected      atomic.Bool
+	ejectedUntil atomic.Int64
+}
+
+type ringPoint struct {
+	hash   uint32
+	target *target
+}
+
+func newUpstream(name string, config UpstreamConfig) (*upstream, error) {
+	up := &upstream{name: name, config: config, breaker: newCircuitBreaker(name, config.CircuitBreaker)}
+	for _, rawURL := range config.Targets {
+		targetURL, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		t := &target{url: targetURL, proxy: httputil.NewSingleHostReverseProxy(targetURL)}
+		t.proxy.Transport = upstreamTransport(name)
+		t.proxy.ModifyResponse = func(resp *http.Response) error {
+			up.record(t, resp.StatusCode == http.StatusBadGateway ||
+				resp.StatusCode == http.StatusServiceUnavailable ||
+				resp.StatusCode == http.StatusGatewayTimeout)
+			return nil
+		}
+		t.proxy.ErrorHandler = up.proxyError(t)
+		up.targets = append(up.targets, t)
+	}
+
+	if config.Balancer == consistentHash {
+		for _, t := range up.targets {
+			for i := 0; i < ringReplicas; i++ {
+				hash := crc32.ChecksumIEEE([]byte(t.url.String() + "#" + strconv.Itoa(i)))
+				up.ring = append(up.ring, ringPoint{hash: hash, target: t})
+			}
+		}
+		sort.Slice(up.ring, func(i, j int) bool { return up.ring[i].hash < up.ring[j].hash })
+	}
+	return up, nil
+}
+
+func (u *upstream) pick(r *http.Request) *target {
+	return balancers[u.config.Balancer](u, r)
+}
+
+func (t *target) available(now time.Time) bool {
+	return !t.unhealthy.Load() && now.UnixNano() >= t.ejectedUntil.Load()
+}
+
+// pickRoundRobin takes the instances in turn, skipping unavailable ones.
+func pickRoundRobin(u *upstream, r *http.Request) *target {
+	now := time.Now()
+	start := u.next.Add(1) - 1
+	for i := range u.targets {
+		t := u.targets[(start+uint64(i))%uint64(len(u.targets))]
+		if t.available(now) {
+			return t
+		}
+	}
+	return nil
+}
+
+// pickLeastConn takes the instance with the fewest requests in flight.
+// Ties go to instances in turn.
+func pickLeastConn(u *upstream, r *http.Request) *target {
+	now := time.Now()
+	start := u.next.Add(1) - 1
+	var best *target
+	for i := range u.targets {
+		t := u.targets[(start+uint64(i))%uint64(len(u.targets))]
+		if t.available(now) && (best == nil || t.inFlight.Load() < best.inFlight.Load()) {
+			best = t
+		}
+	}
+	return best
+}
+
+// pickConsistentHash sends requests with the same key to the same instance
+// while it is available. The key is the configured header, or the client's
+// IP. When an instance leaves, only its keys move.
+func pickConsistentHash(u *upstream, r *http.Request) *target {
+	key := clientIP(r)
+	if u.config.HashHeader != "" && r.Header.Get(u.config.HashHeader) != "" {
+		key = r.Header.Get(u.config.HashHeader)
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+
+	now := time.Now()
+	start := sort.Search(len(u.ring), func(i int) bool { return u.ring[i].hash >= hash })
+	for i := range u.ring {
+		point := u.ring[(start+i)%len(u.ring)]
+		if point.target.available(now) {
+			return point.target
+		}
+	}
+	return nil
+}
+
+// clientIP returns the address the request came from.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// record notes the outcome of a request, ejecting the instance after too
+// many consecutive failures.
+func (u *upstream) record(t *target, failed bool) {
+	u.breaker.record(failed)
+	if !failed {
+		t.failures.Store(0)
+		return
+	}
+	if t.failures.Add(1) == int64(u.config.Ejection.Failures) {
+		t.failures.Store(0)
+		t.ejectedUntil.Store(time.Now().Add(u.config.Ejection.Duration).UnixNano())
+		t.ejected.Store(true)
+		slog.Warn("Ejected instance", "upstream", u.name, "target", t.url.String(), "for", u.config.Ejection.Duration, "failures", u.config.Ejection.Failures)
+	}
+}
+
+// proxyError reports a failed upstream request as a problem response.
+func (u *upstream) proxyError(t *target) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		slog.ErrorContext(r.Context(), "Upstream request failed", "upstream", u.name, "target", t.url.String(), "error", err)
+		// A client that went away says nothing about the instance
+		if !errors.Is(err, context.Canceled) {
+			u.record(t, true)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			upstreamErrors.WithLabelValues(u.name, reasonTimeout).Inc()
+			problem.Error(w, "Upstream "+u.name+" timed out", http.StatusGatewayTimeout)
+			return
+		}
+		if !errors.Is(err, context.Canceled) {
+			upstreamErrors.WithLabelValues(u.name, reasonUnreachable).Inc()
+		}
+		problem.Error(w, "Upstream "+u.name+" is unavailable", http.StatusBadGateway)
+	}
+}
+
+// startHealthChecks polls every upstream's instances until the table is
+// replaced.
+func (table *routeTable) startHealthChecks() {
+	for _, up := range table.upstreams {
+		go up.checkHealth(table.stop)
+	}
+}
+
+func (u *upstream) checkHealth(stop <-chan struct{}) {
+	check := u.config.HealthCheck
+	client := &http.Client{Timeout: check.Timeout}
+	ticker := time.NewTicker(check.Interval)
+	defer ticker.Stop()
+
+	for {
+		for _, t := range u.targets {
+			if t.ejected.Load() && time.Now().UnixNano() >= t.ejectedUntil.Load() {
+				t.ejected.Store(false)
+				slog.Info("Reinstated instance", "upstream", u.name, "target", t.url.String())
+			}
+			if !check.Disabled {
+				u.checkTarget(client, t, check.Path)
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (u *upstream) checkTarget(client *http.Client, t *target, path string) {
+	healthy := false
+	resp, err := client.Get(t.url.JoinPath(path).String())
+	if err == nil {
+		resp.Body.Close()
+		healthy = resp.StatusCode >= 200 && resp.StatusCode < 300
+	}
+
+	if wasUnhealthy := t.unhealthy.Swap(!healthy); wasUnhealthy == healthy {
+		if healthy {
+			slog.Info("Instance passed its health check", "upstream", u.name, "target", t.url.String())
+		} else {
+			slog.Warn("Instance failed its health check", "upstream", u.name, "target", t.url.String())
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testUpstream(t *testing.T, balancer string, targets ...string) *upstream {
+	t.Helper()
+	up, err := newUpstream("test", UpstreamConfig{
+		Targets:        targets,
+		Balancer:       balancer,
+		HashHeader:     "X-Tenant",
+		Ejection:       EjectionConfig{Failures: 3, Duration: time.Minute},
+		CircuitBreaker: CircuitBreakerConfig{Failures: 100, OpenFor: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return up
+}
+
+// picks returns the hosts of the next n instances the upstream picks.
+func picks(up *upstream, r *http.Request, n int) []string {
+	var hosts []string
+	for i := 0; i < n; i++ {
+		if t := up.pick(r); t != nil {
+			hosts = append(hosts, t.url.Host)
+		} else {
+			hosts = append(hosts, "-")
+		}
+	}
+	return hosts
+}
+
+func TestRoundRobin(t *testing.T) {
+	tests := []struct {
+		name      string
+		unhealthy []int
+		ejected   []int
+		want      string
+	}{
+		{"in turn", nil, nil, "a b c a b c"},
+		{"skips unhealthy", []int{1}, nil, "a c c a c c"},
+		{"skips ejected", nil, []int{0}, "b b c b b c"},
+		{"none available", []int{0, 1}, []int{2}, "- - - - - -"},
+	}
+	for _, tt := range tests {
+		up := testUpstream(t, roundRobin, "http://a", "http://b", "http://c")
+		for _, i := range tt.unhealthy {
+			up.targets[i].unhealthy.Store(true)
+		}
+		for _, i := range tt.ejected {
+			up.targets[i].ejectedUntil.Store(time.Now().Add(time.Minute).UnixNano())
+		}
+		got := fmt.Sprint(picks(up, httptest.NewRequest("GET", "/", nil), 6))
+		if got != "["+tt.want+"]" {
+			t.Errorf("%s: picked %s, want [%s]", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	tests := []struct {
+		name      string
+		inFlight  []int64
+		unhealthy []int
+		want      string
+	}{
+		{"fewest in flight", []int64{3, 1, 2}, nil, "b b b"},
+		{"ties in turn", []int64{1, 1, 5}, nil, "a b a"},
+		{"skips unhealthy", []int64{3, 1, 2}, []int{1}, "c c c"},
+		{"none available", []int64{0, 0, 0}, []int{0, 1, 2}, "- - -"},
+	}
+	for _, tt := range tests {
+		up := testUpstream(t, leastConn, "http://a", "http://b", "http://c")
+		for i, n := range tt.inFlight {
+			up.targets[i].inFlight.Store(n)
+		}
+		for _, i := range tt.unhealthy {
+			up.targets[i].unhealthy.Store(true)
+		}
+		got := fmt.Sprint(picks(up, httptest.NewRequest("GET", "/", nil), 3))
+		if got != "["+tt.want+"]" {
+			t.Errorf("%s: picked %s, want [%s]", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	up := testUpstream(t, consistentHash, "http://a", "http://b", "http://c")
+	request := func(tenant, addr string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		if tenant != "" {
+			r.Header.Set("X-Tenant", tenant)
+		}
+		return r
+	}
+
+	// The same key goes to the same instance, by header or else by IP
+	before := map[string]string{}
+	used := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("tenant-%d", i)
+		host := up.pick(request(key, "10.0.0.1:1000")).url.Host
+		if again := up.pick(request(key, fmt.Sprintf("10.0.0.%d:2000", i))).url.Host; again != host {
+			t.Errorf("%s went to %s, then %s", key, host, again)
+		}
+		before[key] = host
+		used[host] = true
+	}
+	if len(used) != 3 {
+		t.Errorf("keys spread over %d instances, want 3", len(used))
+	}
+	ip := up.pick(request("", "192.0.2.1:1000")).url.Host
+	if again := up.pick(request("", "192.0.2.1:2000")).url.Host; again != ip {
+		t.Errorf("client IP went to %s, then %s", ip, again)
+	}
+
+	// Only the keys of an instance that leaves move
+	up.targets[1].unhealthy.Store(true)
+	for key, host := range before {
+		got := up.pick(request(key, "10.0.0.1:1000")).url.Host
+		if host != "b" && got != host {
+			t.Errorf("%s moved from %s to %s", key, host, got)
+		}
+		if got == "b" {
+			t.Errorf("%s still goes to the unhealthy instance", key)
+		}
+	}
+}
+
+func TestEjection(t *testing.T) {
+	up := testUpstream(t, roundRobin, "http://a")
+	target := up.targets[0]
+	steps := []struct {
+		failed    bool
+		available bool
+	}{
+		{true, true},
+		{true, true},
+		// A success resets the count
+		{false, true},
+		{true, true},
+		{true, true},
+		{true, false},
+	}
+	for i, step := range steps {
+		up.record(target, step.failed)
+		if got := target.available(time.Now()); got != step.available {
+			t.Errorf("step %d: available = %v, want %v", i, got, step.available)
+		}
+	}
+	if !target.ejected.Load() {
+		t.Error("instance not marked ejected")
+	}
+	// The ejection ends on its own
+	if !target.available(time.Now().Add(time.Minute + time.Second)) {
+		t.Error("instance still unavailable after the ejection")
+	}
+}
+
+func TestCheckTarget(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	up := testUpstream(t, roundRobin, server.URL)
+	target := up.targets[0]
+	client := &http.Client{Timeout: time.Second}
+	tests := []struct {
+		status  int
+		healthy bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusServiceUnavailable, false},
+		{http.StatusNoContent, true},
+		{http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		status = tt.status
+		up.checkTarget(client, target, "/healthz")
+		if got := !target.unhealthy.Load(); got != tt.healthy {
+			t.Errorf("status %d: healthy = %v, want %v", tt.status, got, tt.healthy)
+		}
+	}
+
+	server.Close()
+	up.checkTarget(client, target, "/healthz")
+	if !target.unhealthy.Load() {
+		t.Error("unreachable instance still healthy")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// A circuit breaker guards each upstream. After enough consecutive failed
+// requests it opens and the gateway answers 503 straight away, with a
+// Retry-After header, instead of waiting on an upstream that is down. Once
+// the open period is over one request is let through to probe the upstream:
+// if it succeeds the breaker closes, otherwise it opens again.
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+type circuitBreaker struct {
+	name   string
+	config CircuitBreakerConfig
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	// probeAt is when the half-open probe was let through, zero if none is
+	// in flight
+	probeAt time.Time
+}
+
+// BreakerStatus is a circuit breaker's state as shown to admins.
+type BreakerStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	RetryAfterSeconds   int        `json:"retry_after_seconds,omitempty"`
+}
+
+func newCircuitBreaker(name string, config CircuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{name: name, config: config, state: breakerClosed}
+}
+
+// allow reports whether a request may go to the upstream, and if not, how
+// long the client should wait before trying again.
+func (b *circuitBreaker) allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.state == breakerOpen {
+		if wait := b.openedAt.Add(b.config.OpenFor).Sub(now); wait > 0 {
+			return wait, false
+		}
+		b.state = breakerHalfOpen
+		b.probeAt = time.Time{}
+	}
+	if b.state == breakerHalfOpen {
+		// A probe that never reported back does not hold the breaker forever
+		if !b.probeAt.IsZero() && now.Sub(b.probeAt) < b.config.OpenFor {
+			return time.Second, false
+		}
+		b.probeAt = now
+	}
+	return 0, true
+}
+
+// record notes the outcome of a request to the upstream.
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.failures = 0
+		if b.state == breakerHalfOpen {
+			b.state = breakerClosed
+			slog.Info("Circuit breaker closed", "upstream", b.name)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.config.Failures) {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		slog.Warn("Circuit breaker opened", "upstream", b.name, "for", b.config.OpenFor, "failures", b.failures)
+	}
+}
+
+func (b *circuitBreaker) status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BreakerStatus{State: b.state, ConsecutiveFailures: b.failures}
+	if b.state != breakerClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	if b.state == breakerOpen {
+		if wait := time.Until(b.openedAt.Add(b.config.OpenFor)); wait > 0 {
+			status.RetryAfterSeconds = retryAfterSeconds(wait)
+		}
+	}
+	return status
+}
+
+// retryAfterSeconds rounds a wait up to whole seconds for Retry-After.
+func retryAfterSeconds(wait time.Duration) int {
+	return int((wait + time.Second - 1) / time.Second)
+}
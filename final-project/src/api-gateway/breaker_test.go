@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const openFor = 30 * time.Second
+	breaker := newCircuitBreaker("test", CircuitBreakerConfig{Failures: 3, OpenFor: openFor})
+
+	// Each step lets elapsed pass, then either asks allow or records an
+	// outcome, and checks the breaker's state afterwards
+	steps := []struct {
+		name    string
+		elapsed time.Duration
+		action  string // "allow", "fail" or "succeed"
+		allowed bool
+		state   string
+	}{
+		{"closed breaker allows", 0, "allow", true, breakerClosed},
+		{"first failure", 0, "fail", false, breakerClosed},
+		{"second failure", 0, "fail", false, breakerClosed},
+		{"success resets the count", 0, "succeed", false, breakerClosed},
+		{"failure after the reset", 0, "fail", false, breakerClosed},
+		{"second failure again", 0, "fail", false, breakerClosed},
+		{"threshold opens", 0, "fail", false, breakerOpen},
+		{"open breaker refuses", 0, "allow", false, breakerOpen},
+		{"still open before the period ends", openFor / 2, "allow", false, breakerOpen},
+		{"lets a probe through after the period", openFor, "allow", true, breakerHalfOpen},
+		{"refuses while the probe is in flight", 0, "allow", false, breakerHalfOpen},
+		{"failed probe reopens", 0, "fail", false, breakerOpen},
+		{"reopened breaker refuses", 0, "allow", false, breakerOpen},
+		{"probes again after the period", openFor, "allow", true, breakerHalfOpen},
+		{"lost probe stops holding the breaker", openFor, "allow", true, breakerHalfOpen},
+		{"successful probe closes", 0, "succeed", false, breakerClosed},
+		{"closed again allows", 0, "allow", true, breakerClosed},
+	}
+	for _, step := range steps {
+		breaker.openedAt = breaker.openedAt.Add(-step.elapsed)
+		if !breaker.probeAt.IsZero() {
+			breaker.probeAt = breaker.probeAt.Add(-step.elapsed)
+		}
+		switch step.action {
+		case "allow":
+			wait, allowed := breaker.allow()
+			if allowed != step.allowed {
+				t.Errorf("%s: allow = %v, want %v", step.name, allowed, step.allowed)
+			}
+			if !allowed && wait <= 0 {
+				t.Errorf("%s: refused without a wait", step.name)
+			}
+		case "fail":
+			breaker.record(true)
+		case "succeed":
+			breaker.record(false)
+		}
+		if breaker.state != step.state {
+			t.Errorf("%s: state %s, want %s", step.name, breaker.state, step.state)
+		}
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want int
+	}{
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+		{30 * time.Second, 30},
+	}
+	for _, tt := range tests {
+		if got := retryAfterSeconds(tt.wait); got != tt.want {
+			t.Errorf("retryAfterSeconds(%v) = %d, want %d", tt.wait, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The gateway's routes and upstreams come from a YAML (or JSON) file, by
+// default config/gateway.yaml, or the file named by GATEWAY_CONFIG. The
+// file is checked for changes every few seconds; a changed file that fails
+// to load is logged and the running configuration is kept.
+
+const (
+	defaultConfigPath   = "config/gateway.yaml"
+	defaultRouteTimeout = 30 * time.Second
+	// maxRouteTimeout stays below the server's write timeout
+	maxRouteTimeout     = time.Minute
+	defaultHealthPath   = "/healthz"
+	defaultHealthEvery  = 10 * time.Second
+	defaultHealthWait   = 2 * time.Second
+	defaultEjectAfter   = 5
+	defaultEjectFor     = 30 * time.Second
+	defaultBackoff      = 100 * time.Millisecond
+	defaultMaxBackoff   = time.Second
+	defaultBreakAfter   = 5
+	defaultBreakFor     = 30 * time.Second
+	defaultKeyCache     = time.Minute
+	configCheckInterval = 2 * time.Second
+)
+
+type Config struct {
+	Defaults  RouteDefaults             `yaml:"defaults" json:"defaults"`
+	Upstreams map[string]UpstreamConfig `yaml:"upstreams" json:"upstreams"`
+	Routes    []RouteConfig             `yaml:"routes" json:"routes"`
+	RateLimit RateLimitConfig           `yaml:"rate_limit" json:"rate_limit"`
+	OIDC      OIDCConfig                `yaml:"oidc" json:"oidc"`
+	APIKeys   APIKeysConfig             `yaml:"api_keys" json:"api_keys"`
+}
+
+type RouteDefaults struct {
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+	Retry   RetryConfig   `yaml:"retry" json:"retry"`
+	// RateLimit names the policy of routes using the ratelimit middleware
+	RateLimit string `yaml:"rate_limit" json:"rate_limit"`
+}
+
+// RetryConfig retries idempotent requests that get no response, or a 502,
+// 503 or 504, waiting a random time up to Backoff doubled per attempt.
+type RetryConfig struct {
+	// Attempts includes the first one; 1 turns retries off
+	Attempts   int           `yaml:"attempts" json:"attempts"`
+	Backoff    time.Duration `yaml:"backoff" json:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff" json:"max_backoff"`
+}
+
+// UpstreamConfig lists the instances of one backend service and how
+// requests are spread across them.
+type UpstreamConfig struct {
+	Targets []string `yaml:"targets" json:"targets"`
+	// Balancer is round-robin (the default), least-conn or consistent-hash
+	Balancer string `yaml:"balancer" json:"balancer"`
+	// HashHeader keys consistent-hash; the client's IP is used without it
+	HashHeader     string               `yaml:"hash_header" json:"hash_header"`
+	HealthCheck    HealthCheckConfig    `yaml:"health_check" json:"health_check"`
+	Ejection       EjectionConfig       `yaml:"ejection" json:"ejection"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker" json:"circuit_breaker"`
+}
+
+// HealthCheckConfig polls every instance; one that fails a check gets no
+// requests until it passes again.
+type HealthCheckConfig struct {
+	Disabled bool          `yaml:"disabled" json:"disabled"`
+	Path     string        `yaml:"path" json:"path"`
+	Interval time.Duration `yaml:"interval" json:"interval"`
+	Timeout  time.Duration `yaml:"timeout" json:"timeout"`
+}
+
+// EjectionConfig takes an instance out of rotation for Duration after
+// Failures consecutive failed requests.
+type EjectionConfig struct {
+	Failures int           `yaml:"failures" json:"failures"`
+	Duration time.Duration `yaml:"duration" json:"duration"`
+}
+
+// RateLimitConfig defines named policies of token buckets. Store is memory
+// (the default), which limits each gateway replica on its own, or mongo,
+// which shares the buckets between replicas.
+type RateLimitConfig struct {
+	Store    string                   `yaml:"store" json:"store"`
+	MongoURI string                   `yaml:"mongo_uri" json:"mongo_uri"`
+	Policies map[string][]LimitConfig `yaml:"policies" json:"policies"`
+}
+
+// LimitConfig is one token bucket per key: ip (the client's address), user
+// (the token's user; anonymous requests are not counted) or route (every
+// request to the route). It holds up to Burst tokens, default Limit, and
+// refills at Limit per Per.
+type LimitConfig struct {
+	Key   string        `yaml:"key" json:"key"`
+	Limit int           `yaml:"limit" json:"limit"`
+	Per   time.Duration `yaml:"per" json:"per"`
+	Burst int           `yaml:"burst" json:"burst"`
+}
+
+// CircuitBreakerConfig stops sending requests to the whole upstream for
+// OpenFor after Failures consecutive failed requests.
+type CircuitBreakerConfig struct {
+	Failures int           `yaml:"failures" json:"failures"`
+	OpenFor  time.Duration `yaml:"open_for" json:"open_for"`
+}
+
+// OIDCConfig lets users log in with an OpenID Connect provider. It is off
+// without an issuer.
+type OIDCConfig struct {
+	Issuer string `yaml:"issuer" json:"issuer"`
+	// BackchannelURL replaces the issuer in the URLs the gateway calls
+	// itself, for a provider it reaches at another address than browsers do
+	BackchannelURL string `yaml:"backchannel_url" json:"backchannel_url"`
+	ClientID       string `yaml:"client_id" json:"client_id"`
+	ClientSecret   string `yaml:"client_secret" json:"client_secret"`
+	// RedirectURL is the callback registered with the provider
+	RedirectURL string   `yaml:"redirect_url" json:"redirect_url"`
+	Scopes      []string `yaml:"scopes" json:"scopes"`
+	// GroupsClaim is the ID token claim listing the user's groups
+	GroupsClaim string `yaml:"groups_claim" json:"groups_claim"`
+	// Roles maps groups to roles; the first one the user is in wins
+	Roles []RoleMapping `yaml:"roles" json:"roles"`
+	// DefaultRole is for users in none of the groups; without it they
+	// cannot log in
+	DefaultRole string `yaml:"default_role" json:"default_role"`
+}
+
+// APIKeysConfig accepts personal access tokens and service API keys,
+// exchanging them for JWTs at Upstream, which runs the user service. Keys
+// are refused without an upstream.
+type APIKeysConfig struct {
+	Upstream string `yaml:"upstream" json:"upstream"`
+	// Cache is how long an exchanged key is reused, and so how long a
+	// revoked key keeps working
+	Cache time.Duration `yaml:"cache" json:"cache"`
+}
+
+type RoleMapping struct {
+	Group string `yaml:"group" json:"group"`
+	Role  string `yaml:"role" json:"role"`
+}
+
+// RouteConfig forwards requests matching Path to an upstream. Paths follow
+// http.ServeMux rules: a trailing slash matches the whole subtree.
+type RouteConfig struct {
+	Path     string `yaml:"path" json:"path"`
+	Upstream string `yaml:"upstream" json:"upstream"`
+	// Rewrite replaces the request path before it is forwarded
+	Rewrite string `yaml:"rewrite" json:"rewrite"`
+	// Middleware wraps the route, outermost first
+	Middleware []string `yaml:"middleware" json:"middleware"`
+	Successor  string   `yaml:"successor" json:"successor"`
+	// Timeout covers every attempt at the request
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+	Retry   RetryConfig   `yaml:"retry" json:"retry"`
+	// RateLimit names the route's rate limit policy
+	RateLimit string `yaml:"rate_limit" json:"rate_limit"`
+}
+
+func configPath() string {
+	if path := os.Getenv("GATEWAY_CONFIG"); path != "" {
+		return path
+	}
+	return defaultConfigPath
+}
+
+// parseConfig decodes and checks a configuration file's contents.
+func parseConfig(data []byte) (*Config, error) {
+	var config Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+
+	if config.Defaults.Timeout <= 0 {
+		config.Defaults.Timeout = defaultRouteTimeout
+	}
+	if config.Defaults.Retry.Attempts <= 0 {
+		config.Defaults.Retry.Attempts = 1
+	}
+	if config.Defaults.Retry.Backoff <= 0 {
+		config.Defaults.Retry.Backoff = defaultBackoff
+	}
+	if config.Defaults.Retry.MaxBackoff <= 0 {
+		config.Defaults.Retry.MaxBackoff = defaultMaxBackoff
+	}
+	for name, upstream := range config.Upstreams {
+		if len(upstream.Targets) == 0 {
+			return nil, fmt.Errorf("upstream %q has no targets", name)
+		}
+		if upstream.Balancer == "" {
+			upstream.Balancer = roundRobin
+		}
+		if _, ok := balancers[upstream.Balancer]; !ok {
+			return nil, fmt.Errorf("upstream %q has unknown balancer %q", name, upstream.Balancer)
+		}
+		if upstream.HealthCheck.Path == "" {
+			upstream.HealthCheck.Path = defaultHealthPath
+		}
+		if upstream.HealthCheck.Interval <= 0 {
+			upstream.HealthCheck.Interval = defaultHealthEvery
+		}
+		if upstream.HealthCheck.Timeout <= 0 {
+			upstream.HealthCheck.Timeout = defaultHealthWait
+		}
+		if upstream.Ejection.Failures <= 0 {
+			upstream.Ejection.Failures = defaultEjectAfter
+		}
+		if upstream.Ejection.Duration <= 0 {
+			upstream.Ejection.Duration = defaultEjectFor
+		}
+		if upstream.CircuitBreaker.Failures <= 0 {
+			upstream.CircuitBreaker.Failures = defaultBreakAfter
+		}
+		if upstream.CircuitBreaker.OpenFor <= 0 {
+			upstream.CircuitBreaker.OpenFor = defaultBreakFor
+		}
+		config.Upstreams[name] = upstream
+		for _, target := range upstream.Targets {
+			parsed, err := url.Parse(target)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return nil, fmt.Errorf("upstream %q has invalid target %q", name, target)
+			}
+		}
+	}
+
+	switch config.RateLimit.Store {
+	case "", storeMemory:
+		config.RateLimit.Store = storeMemory
+	case storeMongo:
+		if config.RateLimit.MongoURI == "" {
+			return nil, fmt.Errorf("rate limit store mongo needs mongo_uri")
+		}
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", config.RateLimit.Store)
+	}
+	for name, limits := range config.RateLimit.Policies {
+		for i, limit := range limits {
+			if limit.Key != limitByIP && limit.Key != limitByUser && limit.Key != limitByRoute {
+				return nil, fmt.Errorf("rate limit policy %s: unknown key %q", name, limit.Key)
+			}
+			if limit.Limit <= 0 || limit.Per <= 0 {
+				return nil, fmt.Errorf("rate limit policy %s: limit and per must be positive", name)
+			}
+			if limit.Burst <= 0 {
+				limits[i].Burst = limit.Limit
+			}
+		}
+	}
+
+	if config.OIDC.Issuer != "" {
+		if config.OIDC.ClientID == "" || config.OIDC.RedirectURL == "" {
+			return nil, fmt.Errorf("oidc needs client_id and redirect_url")
+		}
+		if len(config.OIDC.Scopes) == 0 {
+			config.OIDC.Scopes = []string{"openid", "email", "profile"}
+		}
+		if config.OIDC.GroupsClaim == "" {
+			config.OIDC.GroupsClaim = "groups"
+		}
+		for _, mapping := range config.OIDC.Roles {
+			if mapping.Role != "admin" && mapping.Role != "regular" {
+				return nil, fmt.Errorf("oidc: group %q has unknown role %q", mapping.Group, mapping.Role)
+			}
+		}
+		if config.OIDC.DefaultRole != "" && config.OIDC.DefaultRole != "admin" && config.OIDC.DefaultRole != "regular" {
+			return nil, fmt.Errorf("oidc: unknown default_role %q", config.OIDC.DefaultRole)
+		}
+	}
+
+	if config.APIKeys.Upstream != "" {
+		if _, ok := config.Upstreams[config.APIKeys.Upstream]; !ok {
+			return nil, fmt.Errorf("api_keys: unknown upstream %q", config.APIKeys.Upstream)
+		}
+		if config.APIKeys.Cache < 0 {
+			return nil, fmt.Errorf("api_keys: cache must not be negative")
+		}
+		if config.APIKeys.Cache == 0 {
+			config.APIKeys.Cache = defaultKeyCache
+		}
+	}
+
+	paths := map[string]bool{}
+	for i, route := range config.Routes {
+		if !strings.HasPrefix(route.Path, "/") {
+			return nil, fmt.Errorf("route %d: path must start with /", i)
+		}
+		if paths[route.Path] || route.Path == "/openapi.json" || strings.HasPrefix(route.Path, "/v1/") || strings.HasPrefix(route.Path, "/admin/") || route.Path == oidcLoginPath {
+			return nil, fmt.Errorf("route %s: path is already served", route.Path)
+		}
+		paths[route.Path] = true
+		if _, ok := config.Upstreams[route.Upstream]; !ok {
+			return nil, fmt.Errorf("route %s: unknown upstream %q", route.Path, route.Upstream)
+		}
+		if route.Rewrite != "" && !strings.HasPrefix(route.Rewrite, "/") {
+			return nil, fmt.Errorf("route %s: rewrite must start with /", route.Path)
+		}
+		for _, name := range route.Middleware {
+			if _, ok := middlewares[name]; !ok {
+				return nil, fmt.Errorf("route %s: unknown middleware %q", route.Path, name)
+			}
+		}
+		if route.Timeout <= 0 {
+			config.Routes[i].Timeout = config.Defaults.Timeout
+		}
+		if config.Routes[i].Timeout > maxRouteTimeout {
+			return nil, fmt.Errorf("route %s: timeout must be at most %s", route.Path, maxRouteTimeout)
+		}
+		if route.RateLimit == "" {
+			config.Routes[i].RateLimit = config.Defaults.RateLimit
+		}
+		if policy := config.Routes[i].RateLimit; policy != "" {
+			if _, ok := config.RateLimit.Policies[policy]; !ok {
+				return nil, fmt.Errorf("route %s: unknown rate limit policy %q", route.Path, policy)
+			}
+		}
+		if route.Retry.Attempts <= 0 {
+			config.Routes[i].Retry.Attempts = config.Defaults.Retry.Attempts
+		}
+		if route.Retry.Backoff <= 0 {
+			config.Routes[i].Retry.Backoff = config.Defaults.Retry.Backoff
+		}
+		if route.Retry.MaxBackoff <= 0 {
+			config.Routes[i].Retry.MaxBackoff = config.Defaults.Retry.MaxBackoff
+		}
+	}
+	return &config, nil
+}
+
+// loadConfig reads the configuration file and installs its routes.
+func loadConfig(path string) ([32]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	config, err := parseConfig(data)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	table, err := buildRoutes(config)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	if old := routes.Swap(table); old != nil {
+		close(old.stop)
+		if old.limiter.store != table.limiter.store {
+			old.limiter.store.close()
+		}
+	}
+	table.startHealthChecks()
+	return sha256.Sum256(data), nil
+}
+
+// watchConfig reloads the configuration file whenever its contents change.
+func watchConfig(path string, loaded [32]byte) {
+	ticker := time.NewTicker(configCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		data, err := os.ReadFile(path)
+		if err != nil || sha256.Sum256(data) == loaded {
+			continue
+		}
+		sum, err := loadConfig(path)
+		if err != nil {
+			slog.Error("Keeping the current gateway configuration", "path", path, "error", err)
+			// Do not retry the same broken contents every tick
+			loaded = sha256.Sum256(data)
+			continue
+		}
+		loaded = sum
+		slog.Info("Reloaded gateway configuration", "path", path)
+	}
+}
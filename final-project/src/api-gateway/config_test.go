@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfigDefaults(t *testing.T) {
+	config, err := parseConfig([]byte(`
+upstreams:
+  users:
+    targets: [http://users:8001]
+routes:
+  - path: /users/
+    upstream: users
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantDefaults := RouteDefaults{
+		Timeout: defaultRouteTimeout,
+		Retry:   RetryConfig{Attempts: 1, Backoff: defaultBackoff, MaxBackoff: defaultMaxBackoff},
+	}
+	if !reflect.DeepEqual(config.Defaults, wantDefaults) {
+		t.Errorf("defaults = %+v, want %+v", config.Defaults, wantDefaults)
+	}
+	wantUpstream := UpstreamConfig{
+		Targets:        []string{"http://users:8001"},
+		Balancer:       roundRobin,
+		HealthCheck:    HealthCheckConfig{Path: defaultHealthPath, Interval: defaultHealthEvery, Timeout: defaultHealthWait},
+		Ejection:       EjectionConfig{Failures: defaultEjectAfter, Duration: defaultEjectFor},
+		CircuitBreaker: CircuitBreakerConfig{Failures: defaultBreakAfter, OpenFor: defaultBreakFor},
+	}
+	if got := config.Upstreams["users"]; !reflect.DeepEqual(got, wantUpstream) {
+		t.Errorf("upstream = %+v, want %+v", got, wantUpstream)
+	}
+	wantRoute := RouteConfig{Path: "/users/", Upstream: "users", Timeout: defaultRouteTimeout, Retry: wantDefaults.Retry}
+	if got := config.Routes[0]; !reflect.DeepEqual(got, wantRoute) {
+		t.Errorf("route = %+v, want %+v", got, wantRoute)
+	}
+	if config.RateLimit.Store != storeMemory {
+		t.Errorf("rate limit store = %q, want %q", config.RateLimit.Store, storeMemory)
+	}
+}
+
+// Routes take what they leave out from the defaults, and keep what they set.
+func TestParseConfigRouteSettings(t *testing.T) {
+	config, err := parseConfig([]byte(`
+defaults:
+  timeout: 10s
+  retry: {attempts: 3, backoff: 50ms, max_backoff: 2s}
+  rate_limit: default
+rate_limit:
+  policies:
+    default: [{key: ip, limit: 10, per: 1s}]
+    strict: [{key: user, limit: 2, per: 1m, burst: 5}]
+upstreams:
+  users:
+    targets: [http://users:8001, http://users-2:8001]
+    balancer: least-conn
+    health_check: {path: /ready, interval: 1s}
+routes:
+  - path: /users/
+    upstream: users
+  - path: /auth/login
+    upstream: users
+    timeout: 5s
+    retry: {attempts: 1}
+    rate_limit: strict
+    middleware: [cors, ratelimit]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"inherited timeout", config.Routes[0].Timeout, 10 * time.Second},
+		{"inherited retry", config.Routes[0].Retry, RetryConfig{Attempts: 3, Backoff: 50 * time.Millisecond, MaxBackoff: 2 * time.Second}},
+		{"inherited rate limit", config.Routes[0].RateLimit, "default"},
+		{"own timeout", config.Routes[1].Timeout, 5 * time.Second},
+		{"own attempts, inherited backoff", config.Routes[1].Retry, RetryConfig{Attempts: 1, Backoff: 50 * time.Millisecond, MaxBackoff: 2 * time.Second}},
+		{"own rate limit", config.Routes[1].RateLimit, "strict"},
+		{"middleware", config.Routes[1].Middleware, []string{"cors", "ratelimit"}},
+		{"balancer", config.Upstreams["users"].Balancer, leastConn},
+		{"health check", config.Upstreams["users"].HealthCheck, HealthCheckConfig{Path: "/ready", Interval: time.Second, Timeout: defaultHealthWait}},
+		{"burst defaults to the limit", config.RateLimit.Policies["default"][0].Burst, 10},
+		{"own burst", config.RateLimit.Policies["strict"][0].Burst, 5},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	const upstream = "upstreams:\n  users:\n    targets: [http://users:8001]\n"
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"unknown field", "upstream: {}\n", "field upstream not found"},
+		{"no targets", "upstreams:\n  users: {}\n", `upstream "users" has no targets`},
+		{"invalid target", "upstreams:\n  users:\n    targets: [users:8001]\n", "invalid target"},
+		{"unknown balancer", "upstreams:\n  users:\n    targets: [http://users:8001]\n    balancer: random\n", "unknown balancer"},
+		{"relative path", upstream + "routes:\n  - {path: users, upstream: users}\n", "path must start with /"},
+		{"duplicate path", upstream + "routes:\n  - {path: /users/, upstream: users}\n  - {path: /users/, upstream: users}\n", "already served"},
+		{"v1 path", upstream + "routes:\n  - {path: /v1/users, upstream: users}\n", "already served"},
+		{"unknown upstream", "routes:\n  - {path: /users/, upstream: users}\n", `unknown upstream "users"`},
+		{"relative rewrite", upstream + "routes:\n  - {path: /users/, upstream: users, rewrite: users}\n", "rewrite must start with /"},
+		{"unknown middleware", upstream + "routes:\n  - {path: /users/, upstream: users, middleware: [gzip]}\n", `unknown middleware "gzip"`},
+		{"long timeout", upstream + "routes:\n  - {path: /users/, upstream: users, timeout: 2m}\n", "timeout must be at most"},
+		{"unknown rate limit policy", upstream + "routes:\n  - {path: /users/, upstream: users, rate_limit: strict}\n", "unknown rate limit policy"},
+		{"unknown limit key", "rate_limit:\n  policies:\n    p: [{key: host, limit: 1, per: 1s}]\n", `unknown key "host"`},
+		{"zero limit", "rate_limit:\n  policies:\n    p: [{key: ip, limit: 0, per: 1s}]\n", "must be positive"},
+		{"unknown store", "rate_limit:\n  store: redis\n", "unknown rate limit store"},
+		{"mongo store without uri", "rate_limit:\n  store: mongo\n", "needs mongo_uri"},
+		{"oidc without client", "oidc:\n  issuer: http://idp\n", "needs client_id"},
+		{"oidc unknown role", "oidc:\n  issuer: http://idp\n  client_id: gw\n  redirect_url: http://gw/cb\n  roles: [{group: staff, role: owner}]\n", `unknown role "owner"`},
+		{"api keys unknown upstream", "api_keys:\n  upstream: users\n", `unknown upstream "users"`},
+	}
+	for _, tt := range tests {
+		_, err := parseConfig([]byte(tt.config))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want one containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+// The configuration the gateway ships with must load.
+func TestShippedConfig(t *testing.T) {
+	data, err := os.ReadFile(defaultConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseConfig(data); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/health"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/server"
+)
+
+// The gateway's own probes and metrics are served on an internal port,
+// METRICS_ADDR, rather than next to the API on port 8000: they need no
+// token, are not rate limited and cannot be reached from outside.
+//
+// The gateway is ready while its rate limit store can be reached. Upstreams
+// without a healthy instance are reported but do not make it unready,
+// since it still serves the routes to the other upstreams.
+
+const defaultMetricsAddr = ":9100"
+
+// serveInternal serves /metrics, /healthz and /readyz on METRICS_ADDR.
+func serveInternal() {
+	health.AddCheck("rate_limit_store", func(ctx context.Context) error {
+		return routes.Load().limiter.store.ping(ctx)
+	})
+	health.AddOptionalCheck("upstreams", unavailableUpstreams)
+
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		addr = defaultMetricsAddr
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", health.Healthz)
+	mux.HandleFunc("/readyz", health.Readyz)
+	slog.Info("Internal endpoints listening", "addr", addr)
+	// It shuts down alongside the API, failing /readyz while it drains
+	server.Run(addr, mux)
+}
+
+// unavailableUpstreams reports the upstreams the gateway cannot send
+// requests to: those without a healthy instance or with an open circuit
+// breaker.
+func unavailableUpstreams(ctx context.Context) error {
+	var unavailable []string
+	for name, up := range routes.Load().upstreams {
+		if up.breaker.status().RetryAfterSeconds > 0 {
+			unavailable = append(unavailable, name)
+			continue
+		}
+		healthy := false
+		for _, t := range up.targets {
+			if !t.unhealthy.Load() && !t.ejected.Load() {
+				healthy = true
+				break
+			}
+		}
+		if !healthy {
+			unavailable = append(unavailable, name)
+		}
+	}
+	if len(unavailable) > 0 {
+		sort.Strings(unavailable)
+		return fmt.Errorf("no healthy instances of %s", strings.Join(unavailable, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The gateway serves Prometheus metrics at /metrics on its internal port
+// (see internal.go). Requests are labelled with the OpenAPI path they
+// matched rather than their path, so IDs in paths do not each start a new
+// series.
+
+var (
+	upstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_upstream_errors_total",
+		Help: "Requests the gateway could not get an answer to from an upstream, by upstream and reason.",
+	}, []string{"upstream", "reason"})
+
+	upstreamRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_upstream_retries_total",
+		Help: "Requests sent to an upstream again after a failed attempt, by upstream.",
+	}, []string{"upstream"})
+)
+
+// Reasons for gateway_upstream_errors_total
+const (
+	reasonNoInstance  = "no_healthy_instance"
+	reasonCircuitOpen = "circuit_open"
+	reasonTimeout     = "timeout"
+	reasonUnreachable = "unreachable"
+)
+
+// openapiRoute returns the OpenAPI path a request matches.
+func openapiRoute(r *http.Request) string {
+	if route, _, err := openapiRouter.FindRoute(r); err == nil {
+		return route.Path
+	}
+	return "unmatched"
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+)
+
+// Users can log in with the company's OpenID Connect provider using the
+// authorization code flow with PKCE. The login route sends the browser to
+// the provider, keeping the flow's state, nonce and PKCE verifier in a
+// signed cookie so any gateway replica can finish it. The callback route
+// exchanges the code for an ID token, checks it, maps the user's groups to
+// a role and forwards the result to the user service as a short-lived
+// assertion; the user service creates or updates the user and logs them in.
+//
+// The flow cookie and the assertion are signed with their own keys, so
+// neither is ever accepted in place of a JWT.
+
+const (
+	oidcLoginPath  = "/auth/oidc/login"
+	oidcFlowCookie = "oidc_flow"
+	oidcFlowTTL    = 10 * time.Minute
+	assertionTTL   = time.Minute
+	// jwksRefetchEvery limits refetching the provider's keys for an
+	// unknown key ID
+	jwksRefetchEvery = time.Minute
+)
+
+var (
+	oidcFlowKey      = []byte("your-oidc-flow-key")
+	oidcAssertionKey = []byte("your-oidc-assertion-key")
+)
+
+// oidcProvider talks to the provider of one configuration. Its discovery
+// document and keys are fetched when first needed, so the gateway starts
+// even while the provider is down.
+type oidcProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func newOIDCProvider(config OIDCConfig) *oidcProvider {
+	return &oidcProvider{config: config, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// backchannel returns the address the gateway reaches a provider URL at.
+func (p *oidcProvider) backchannel(rawURL string) string {
+	if p.config.BackchannelURL == "" || !strings.HasPrefix(rawURL, p.config.Issuer) {
+		return rawURL
+	}
+	return strings.TrimSuffix(p.config.BackchannelURL, "/") + strings.TrimPrefix(rawURL, strings.TrimSuffix(p.config.Issuer, "/"))
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, rawURL string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.backchannel(rawURL), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("provider says its issuer is %q, not %q", discovery.Issuer, p.config.Issuer)
+	}
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// key returns the provider's signing key with the given ID, refetching the
+// keys when it is unknown, as the provider may have rotated them.
+func (p *oidcProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < jwksRefetchEvery {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	p.keysFetched = time.Now()
+	p.keys = map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil {
+			slog.Warn("Skipping malformed key from the OIDC provider", "kid", jwk.Kid)
+			continue
+		}
+		p.keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// exchange trades an authorization code for an ID token.
+func (p *oidcProvider) exchange(ctx context.Context, code, verifier string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.config.ClientSecret == "" {
+		form.Set("client_id", p.config.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.backchannel(discovery.TokenEndpoint), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request refused: %s %s", result.Error, result.ErrorDescription)
+	}
+	if result.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return result.IDToken, nil
+}
+
+// verifyIDToken checks an ID token's signature, issuer, audience, expiry
+// and nonce, returning its claims.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, raw, nonce string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, kid)
+	})
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("invalid ID token: %v", err)
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+
+	if claims["iss"] != p.config.Issuer {
+		return nil, fmt.Errorf("ID token is from %v, not %s", claims["iss"], p.config.Issuer)
+	}
+	audiences := stringList(claims["aud"])
+	if !contains(audiences, p.config.ClientID) {
+		return nil, fmt.Errorf("ID token is not for client %s", p.config.ClientID)
+	}
+	if len(audiences) > 1 && claims["azp"] != p.config.ClientID {
+		return nil, fmt.Errorf("ID token was not issued to client %s", p.config.ClientID)
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("ID token has no expiry")
+	}
+	if got, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1 {
+		return nil, errors.New("ID token nonce does not match")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+// role maps the groups in the claims to a role, reporting false if the
+// user may not log in.
+func (p *oidcProvider) role(claims jwt.MapClaims) (string, bool) {
+	groups := stringList(claims[p.config.GroupsClaim])
+	for _, mapping := range p.config.Roles {
+		if contains(groups, mapping.Group) {
+			return mapping.Role, true
+		}
+	}
+	return p.config.DefaultRole, p.config.DefaultRole != ""
+}
+
+// stringList reads a claim that may be a string or a list of them.
+func stringList(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var list []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// pkceChallenge is the S256 code challenge of a PKCE verifier (RFC 7636).
+func pkceChallenge(verifier string) string {
+	challenge := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(challenge[:])
+}
+
+// oidcLogin sends the browser to the provider to log in.
+func (table *routeTable) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	if table.oidc == nil {
+		problem.Error(w, "OIDC login is not configured", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	discovery, err := table.oidc.discover(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "OIDC discovery failed", "error", err)
+		problem.Error(w, "The identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state, nonce, verifier := randomString(), randomString(), randomString()
+	flow, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+		"exp":      time.Now().Add(oidcFlowTTL).Unix(),
+	}).SignedString(oidcFlowKey)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to sign the OIDC flow", "error", err)
+		problem.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcFlowCookie,
+		Value:    flow,
+		Path:     "/",
+		MaxAge:   int(oidcFlowTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		// The provider sends the browser back with a top-level GET
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {table.oidc.config.ClientID},
+		"redirect_uri":          {table.oidc.config.RedirectURL},
+		"scope":                 {strings.Join(table.oidc.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, discovery.AuthorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// oidcCallback finishes a login when the provider sends the browser back,
+// replacing the request with a POST of the assertion for the user service.
+func (table *routeTable) oidcCallback(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provider := table.oidc
+		if provider == nil {
+			problem.Error(w, "OIDC login is not configured", http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodGet {
+			problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		if providerError := query.Get("error"); providerError != "" {
+			problem.Error(w, "Login failed at the identity provider: "+providerError+" "+query.Get("error_description"), http.StatusUnauthorized)
+			return
+		}
+
+		cookie, err := r.Cookie(oidcFlowCookie)
+		if err != nil {
+			problem.Error(w, "Login expired, start again", http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: oidcFlowCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+		flow, err := jwt.Parse(cookie.Value, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return oidcFlowKey, nil
+		})
+		if err != nil || !flow.Valid {
+			problem.Error(w, "Login expired, start again", http.StatusBadRequest)
+			return
+		}
+		flowClaims, _ := flow.Claims.(jwt.MapClaims)
+		state, _ := flowClaims["state"].(string)
+		nonce, _ := flowClaims["nonce"].(string)
+		verifier, _ := flowClaims["verifier"].(string)
+		if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(query.Get("state"))) != 1 {
+			problem.Error(w, "Login state does not match, start again", http.StatusBadRequest)
+			return
+		}
+
+		idToken, err := provider.exchange(r.Context(), query.Get("code"), verifier)
+		if err != nil {
+			slog.WarnContext(r.Context(), "OIDC code exchange failed", "error", err)
+			problem.Error(w, "The identity provider did not accept the login", http.StatusBadGateway)
+			return
+		}
+		claims, err := provider.verifyIDToken(r.Context(), idToken, nonce)
+		if err != nil {
+			slog.WarnContext(r.Context(), "Rejected OIDC ID token", "error", err)
+			problem.Error(w, "The identity provider sent an invalid ID token", http.StatusBadGateway)
+			return
+		}
+		role, ok := provider.role(claims)
+		if !ok {
+			slog.InfoContext(r.Context(), "OIDC user is in no group with a role", "sub", claims["sub"])
+			problem.Error(w, "You are not in a group allowed to use this application", http.StatusForbidden)
+			return
+		}
+
+		assertion, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"purpose":            "oidc_login",
+			"iss":                provider.config.Issuer,
+			"sub":                claims["sub"],
+			"email":              claims["email"],
+			"email_verified":     claims["email_verified"] == true,
+			"preferred_username": claims["preferred_username"],
+			"name":               claims["name"],
+			"role":               role,
+			"amr":                claims["amr"],
+			"exp":                time.Now().Add(assertionTTL).Unix(),
+		}).SignedString(oidcAssertionKey)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to sign the OIDC assertion", "error", err)
+			problem.Error(w, "Failed to finish login", http.StatusInternalServerError)
+			return
+		}
+
+		body, _ := json.Marshal(map[string]string{"assertion": assertion})
+		r.Method = http.MethodPost
+		r.URL.RawQuery = ""
+		r.Header.Del("Cookie")
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		r.ContentLength = int64(len(body))
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
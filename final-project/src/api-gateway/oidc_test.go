@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestPKCEChallenge(t *testing.T) {
+	tests := []struct {
+		verifier string
+		want     string
+	}{
+		// RFC 7636, appendix B
+		{"dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk", "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"},
+		{"", "47DEQpj8HBSa-_TImW-5JCeuQeRkm5NMpJWZG3hSuFU"},
+	}
+	for _, tt := range tests {
+		if got := pkceChallenge(tt.verifier); got != tt.want {
+			t.Errorf("pkceChallenge(%q) = %q, want %q", tt.verifier, got, tt.want)
+		}
+	}
+}
+
+// The login redirect carries the S256 challenge of the verifier kept in
+// the flow cookie, and the state kept next to it.
+func TestOIDCLogin(t *testing.T) {
+	var provider *httptest.Server
+	provider = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                provider.URL,
+			AuthorizationEndpoint: provider.URL + "/authorize",
+		})
+	}))
+	defer provider.Close()
+
+	table := &routeTable{oidc: newOIDCProvider(OIDCConfig{
+		Issuer:      provider.URL,
+		ClientID:    "gateway",
+		RedirectURL: "http://localhost:8000/auth/oidc/callback",
+		Scopes:      []string{"openid", "email"},
+	})}
+	w := httptest.NewRecorder()
+	table.oidcLogin(w, httptest.NewRequest(http.MethodGet, oidcLoginPath, nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusFound)
+	}
+
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcFlowCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("no flow cookie")
+	}
+	flow, err := jwt.Parse(cookie.Value, func(token *jwt.Token) (interface{}, error) { return oidcFlowKey, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := flow.Claims.(jwt.MapClaims)
+	verifier, _ := claims["verifier"].(string)
+	// 43 to 128 unreserved characters
+	if !regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`).MatchString(verifier) {
+		t.Errorf("verifier %q is not a valid PKCE verifier", verifier)
+	}
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	tests := []struct {
+		param string
+		want  string
+	}{
+		{"response_type", "code"},
+		{"client_id", "gateway"},
+		{"redirect_uri", "http://localhost:8000/auth/oidc/callback"},
+		{"scope", "openid email"},
+		{"state", claims["state"].(string)},
+		{"nonce", claims["nonce"].(string)},
+		{"code_challenge", pkceChallenge(verifier)},
+		{"code_challenge_method", "S256"},
+	}
+	if location.Path != "/authorize" {
+		t.Errorf("redirected to %s, want the authorization endpoint", location.Path)
+	}
+	for _, tt := range tests {
+		if got := query.Get(tt.param); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.param, got, tt.want)
+		}
+	}
+}
+
+func TestOIDCRole(t *testing.T) {
+	provider := newOIDCProvider(OIDCConfig{
+		GroupsClaim: "groups",
+		Roles:       []RoleMapping{{Group: "admins", Role: "admin"}, {Group: "staff", Role: "regular"}},
+	})
+	tests := []struct {
+		name        string
+		groups      interface{}
+		defaultRole string
+		want        string
+		ok          bool
+	}{
+		{"mapped group", []interface{}{"staff"}, "", "regular", true},
+		{"first match wins", []interface{}{"staff", "admins"}, "", "admin", true},
+		{"single group as a string", "admins", "", "admin", true},
+		{"no mapped group", []interface{}{"guests"}, "", "", false},
+		{"no groups claim", nil, "", "", false},
+		{"default role", []interface{}{"guests"}, "regular", "regular", true},
+	}
+	for _, tt := range tests {
+		provider.config.DefaultRole = tt.defaultRole
+		claims := jwt.MapClaims{}
+		if tt.groups != nil {
+			claims["groups"] = tt.groups
+		}
+		role, ok := provider.role(claims)
+		if role != tt.want || ok != tt.ok {
+			t.Errorf("%s: role = %q, %v, want %q, %v", tt.name, role, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+)
+
+// openapi.json describes every route the gateway serves. Requests are
+// checked against it before they are forwarded, and responses on the way
+// back, so the document cannot silently drift from the services.
+
+//go:embed openapi.json
+var openapiJSON []byte
+
+var openapiRouter routers.Router
+
+func loadOpenAPI() error {
+	// Only date-time is checked unless other formats are defined
+	openapi3.DefineStringFormat("email", openapi3.FormatOfStringForEmail)
+
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(openapiJSON)
+	if err != nil {
+		return err
+	}
+	if err := doc.Validate(loader.Context); err != nil {
+		return err
+	}
+
+	// Route on the path alone: clients reach the gateway under several host
+	// names, not just the one in the document's servers list
+	routing := *doc
+	routing.Servers = nil
+	openapiRouter, err = gorillamux.NewRouter(&routing)
+	if err != nil {
+		return err
+	}
+
+	// Merge patches are JSON documents
+	openapi3filter.RegisterBodyDecoder("application/merge-patch+json", openapi3filter.RegisteredBodyDecoder("application/json"))
+	return nil
+}
+
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openapiJSON)
+}
+
+// openapiMiddleware rejects requests that do not match the document. The
+// services check authentication, so the gateway only validates the shape
+// of requests. Responses that do not match are logged, not rejected.
+func openapiMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// CORS preflight requests are answered by corsMiddleware
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		route, pathParams, err := openapiRouter.FindRoute(r)
+		if errors.Is(err, routers.ErrMethodNotAllowed) {
+			problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			problem.Error(w, "No route for "+r.URL.Path, http.StatusNotFound)
+			return
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			Options: &openapi3filter.Options{
+				MultiError:         true,
+				AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+			},
+		}
+		if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+			status, fieldErrors := requestErrors(err)
+			problem.Validation(w, status, fieldErrors)
+			return
+		}
+
+		recorder := &responseRecorder{header: http.Header{}, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		err = openapi3filter.ValidateResponse(r.Context(), (&openapi3filter.ResponseValidationInput{
+			RequestValidationInput: input,
+			Status:                 recorder.status,
+			Header:                 recorder.header,
+			Options:                &openapi3filter.Options{IncludeResponseStatus: true, MultiError: true},
+		}).SetBodyBytes(recorder.body.Bytes()))
+		if err != nil {
+			slog.WarnContext(r.Context(), "Response does not match the OpenAPI document", "method", r.Method, "path", r.URL.Path, "error", err)
+		}
+
+		recorder.writeTo(w)
+	})
+}
+
+// requestErrors converts a request validation error into field errors. The
+// status is 422 when only the body's content is invalid, otherwise 400.
+func requestErrors(err error) (int, []problem.FieldError) {
+	status := http.StatusUnprocessableEntity
+	var fieldErrors []problem.FieldError
+
+	var collect func(err error, field string)
+	collect = func(err error, field string) {
+		switch e := err.(type) {
+		case openapi3.MultiError:
+			for _, inner := range e {
+				collect(inner, field)
+			}
+		case *openapi3filter.RequestError:
+			if e.Parameter != nil {
+				status = http.StatusBadRequest
+				fieldErrors = append(fieldErrors, problem.FieldError{Field: e.Parameter.Name, Message: firstReason(e)})
+			} else if e.Err != nil {
+				collect(e.Err, field)
+			} else {
+				status = http.StatusBadRequest
+				fieldErrors = append(fieldErrors, problem.FieldError{Field: field, Message: e.Reason})
+			}
+		case *openapi3.SchemaError:
+			path := strings.Join(e.JSONPointer(), ".")
+			if path == "" {
+				path = field
+			}
+			fieldErrors = append(fieldErrors, problem.FieldError{Field: path, Message: e.Reason})
+		default:
+			status = http.StatusBadRequest
+			fieldErrors = append(fieldErrors, problem.FieldError{Field: field, Message: err.Error()})
+		}
+	}
+	collect(err, "body")
+	return status, fieldErrors
+}
+
+// firstReason returns the most specific reason a parameter is invalid.
+func firstReason(err *openapi3filter.RequestError) string {
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err.Err, &schemaErr) {
+		return schemaErr.Reason
+	}
+	if err.Err != nil {
+		return err.Err.Error()
+	}
+	return err.Reason
+}
+
+// responseRecorder holds a response back until it has been validated.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	return r.body.Write(data)
+}
+
+// writeTo sends the held response on to w.
+func (r *responseRecorder) writeTo(w http.ResponseWriter) {
+	for key, values := range r.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(r.status)
+	w.Write(r.body.Bytes())
+}
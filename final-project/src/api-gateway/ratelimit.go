@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/auth"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/metrics"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+)
+
+// Routes using the ratelimit middleware are limited by the token buckets of
+// their policy. A request takes a token from each bucket it falls in and is
+// refused with 429 when one of them is empty. Responses carry the
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers of the
+// bucket closest to running out.
+
+const (
+	limitByIP    = "ip"
+	limitByUser  = "user"
+	limitByRoute = "route"
+
+	storeMemory = "memory"
+	storeMongo  = "mongo"
+
+	// bucketSweepInterval is how often idle in-memory buckets are dropped
+	bucketSweepInterval = time.Minute
+)
+
+type rateLimiter struct {
+	config RateLimitConfig
+	store  bucketStore
+}
+
+// bucketStore keeps the token buckets.
+type bucketStore interface {
+	// take removes a token from the bucket if it has one. It returns
+	// whether it did and the tokens left.
+	take(ctx context.Context, key string, rate, burst float64) (bool, float64, error)
+	// ping checks that the store can be reached
+	ping(ctx context.Context) error
+	close() error
+}
+
+// newRateLimiter builds the limiter for a configuration, keeping the
+// current table's buckets when the store has not changed.
+func newRateLimiter(config RateLimitConfig, current *routeTable) (*rateLimiter, error) {
+	if current != nil && current.limiter.config.Store == config.Store && current.limiter.config.MongoURI == config.MongoURI {
+		return &rateLimiter{config: config, store: current.limiter.store}, nil
+	}
+
+	limiter := &rateLimiter{config: config}
+	switch config.Store {
+	case storeMongo:
+		store, err := newMongoBuckets(config.MongoURI)
+		if err != nil {
+			return nil, err
+		}
+		limiter.store = store
+	default:
+		limiter.store = newMemoryBuckets()
+	}
+	return limiter, nil
+}
+
+func (l *rateLimiter) middleware(route RouteConfig, next http.Handler) http.Handler {
+	limits := l.config.Policies[route.RateLimit]
+	if len(limits) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			closest   LimitConfig
+			remaining = math.Inf(1)
+			refused   bool
+		)
+		for _, limit := range limits {
+			key := limitKey(limit.Key, r)
+			if key == "" {
+				continue
+			}
+			rate := float64(limit.Limit) / limit.Per.Seconds()
+			allowed, tokens, err := l.store.take(r.Context(), route.RateLimit+"|"+route.Path+"|"+limit.Key+"|"+key, rate, float64(limit.Burst))
+			if err != nil {
+				// Better to let requests through than to fail them all
+				slog.ErrorContext(r.Context(), "Rate limit store failed, not limiting", "route", route.Path, "error", err)
+				continue
+			}
+			// A refusing bucket outranks any that allowed the request
+			if refused && allowed {
+				continue
+			}
+			if (!allowed && !refused) || tokens < remaining {
+				closest, remaining, refused = limit, tokens, !allowed
+			}
+		}
+		if math.IsInf(remaining, 1) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rate := float64(closest.Limit) / closest.Per.Seconds()
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(closest.Burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(remaining)))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil((float64(closest.Burst)-remaining)/rate))))
+		if refused {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil((1-remaining)/rate))))
+			problem.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitKey returns who a request counts against, or an empty string if
+// the limit does not apply to it.
+func limitKey(kind string, r *http.Request) string {
+	switch kind {
+	case limitByIP:
+		return clientIP(r)
+	case limitByUser:
+		userID, _ := auth.Claims(r)["userID"].(string)
+		return userID
+	default:
+		return "all"
+	}
+}
+
+// memoryBuckets keeps the buckets of a single gateway replica.
+type memoryBuckets struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	stop    chan struct{}
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket will have refilled
+	full time.Time
+}
+
+func newMemoryBuckets() *memoryBuckets {
+	store := &memoryBuckets{buckets: map[string]*bucket{}, stop: make(chan struct{})}
+	go store.sweep()
+	return store
+}
+
+func (s *memoryBuckets) take(ctx context.Context, key string, rate, burst float64) (bool, float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, updated: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	b.full = now.Add(time.Duration((burst - b.tokens) / rate * float64(time.Second)))
+	return allowed, b.tokens, nil
+}
+
+// sweep drops buckets that have refilled, as a new bucket starts full.
+func (s *memoryBuckets) sweep() {
+	ticker := time.NewTicker(bucketSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for key, b := range s.buckets {
+				if now.After(b.full) {
+					delete(s.buckets, key)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *memoryBuckets) ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryBuckets) close() error {
+	close(s.stop)
+	return nil
+}
+
+// mongoBuckets keeps the buckets in MongoDB so every gateway replica draws
+// from the same ones. Each take is a single atomic update.
+type mongoBuckets struct {
+	client  *mongo.Client
+	buckets *mongo.Collection
+}
+
+func newMongoBuckets(uri string) (*mongoBuckets, error) {
+	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(uri).SetMonitor(metrics.MongoMonitor()))
+	if err != nil {
+		return nil, err
+	}
+	buckets := client.Database("gateway").Collection("rate_limit_buckets")
+
+	// Drop buckets once they would have refilled
+	_, err = buckets.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "full", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		slog.Error("Failed to create the rate limit bucket index", "error", err)
+	}
+	return &mongoBuckets{client: client, buckets: buckets}, nil
+}
+
+func (s *mongoBuckets) take(ctx context.Context, key string, rate, burst float64) (bool, float64, error) {
+	now := time.Now()
+	// Refill for the time since the last take, then take a token if there
+	// is a whole one
+	refilled := bson.M{"$min": bson.A{burst, bson.M{"$add": bson.A{
+		bson.M{"$ifNull": bson.A{"$tokens", burst}},
+		bson.M{"$multiply": bson.A{
+			bson.M{"$divide": bson.A{bson.M{"$subtract": bson.A{now, bson.M{"$ifNull": bson.A{"$updated", now}}}}, 1000}},
+			rate,
+		}},
+	}}}}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"tokens": refilled, "updated": now}}},
+		{{Key: "$set", Value: bson.M{"allowed": bson.M{"$gte": bson.A{"$tokens", 1}}}}},
+		{{Key: "$set", Value: bson.M{"tokens": bson.M{"$cond": bson.A{"$allowed", bson.M{"$subtract": bson.A{"$tokens", 1}}, "$tokens"}}}}},
+		{{Key: "$set", Value: bson.M{"full": bson.M{"$add": bson.A{now, bson.M{"$multiply": bson.A{
+			bson.M{"$divide": bson.A{bson.M{"$subtract": bson.A{burst, "$tokens"}}, rate}}, 1000,
+		}}}}}}},
+	}
+
+	var result struct {
+		Tokens  float64 `bson:"tokens"`
+		Allowed bool    `bson:"allowed"`
+	}
+	err := s.buckets.FindOneAndUpdate(ctx, bson.M{"_id": key}, update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&result)
+	if err != nil {
+		return false, 0, err
+	}
+	return result.Allowed, result.Tokens, nil
+}
+
+func (s *mongoBuckets) ping(ctx context.Context) error {
+	return s.client.Ping(ctx, nil)
+}
+
+func (s *mongoBuckets) close() error {
+	return s.client.Disconnect(context.TODO())
+}
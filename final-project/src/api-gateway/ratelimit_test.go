@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMemoryBucketsTake(t *testing.T) {
+	const rate, burst = 1.0, 2.0
+	store := &memoryBuckets{buckets: map[string]*bucket{}, stop: make(chan struct{})}
+
+	// Each step first lets elapsed pass for the key's bucket, if it has one
+	steps := []struct {
+		name    string
+		key     string
+		elapsed time.Duration
+		allowed bool
+		tokens  float64
+	}{
+		{"new bucket starts full", "a", 0, true, 1},
+		{"takes the last token", "a", 0, true, 0},
+		{"empty bucket refuses", "a", 0, false, 0},
+		{"other keys have their own bucket", "b", 0, true, 1},
+		{"refills at the rate", "a", 1500 * time.Millisecond, true, 0.5},
+		{"partial token refuses", "a", 0, false, 0.5},
+		{"refill stops at the burst", "a", time.Hour, true, 1},
+	}
+	for _, step := range steps {
+		if b, ok := store.buckets[step.key]; ok {
+			b.updated = b.updated.Add(-step.elapsed)
+		}
+		allowed, tokens, err := store.take(context.Background(), step.key, rate, burst)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		// Allow for the real time that passes between steps
+		if allowed != step.allowed || math.Abs(tokens-step.tokens) > 0.01 {
+			t.Errorf("%s: take = %v, %.3f, want %v, %.3f", step.name, allowed, tokens, step.allowed, step.tokens)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+)
+
+// routes holds the routing table built from the current configuration.
+// A reload swaps in a new table; requests already in flight finish on the
+// table they started with.
+var routes atomic.Pointer[routeTable]
+
+type routeTable struct {
+	mux       *http.ServeMux
+	upstreams map[string]*upstream
+	limiter   *rateLimiter
+	// oidc is nil unless OIDC login is configured
+	oidc *oidcProvider
+	// apiKeys is nil unless API keys are accepted
+	apiKeys *keyExchanger
+	// stop ends the table's health checks once it is replaced
+	stop chan struct{}
+}
+
+// middlewares are the wrappers a route can list in its configuration.
+var middlewares = map[string]func(table *routeTable, route RouteConfig, next http.Handler) http.Handler{
+	"cors": func(table *routeTable, route RouteConfig, next http.Handler) http.Handler {
+		return corsMiddleware(next)
+	},
+	"deprecated": func(table *routeTable, route RouteConfig, next http.Handler) http.Handler {
+		return deprecated(route.Successor, next)
+	},
+	"ratelimit": func(table *routeTable, route RouteConfig, next http.Handler) http.Handler {
+		return table.limiter.middleware(route, next)
+	},
+	"register": func(table *routeTable, route RouteConfig, next http.Handler) http.Handler {
+		return registerMiddleware(next)
+	},
+	"oidc": func(table *routeTable, route RouteConfig, next http.Handler) http.Handler {
+		return table.oidcCallback(next)
+	},
+}
+
+// buildRoutes constructs the handlers and proxies for a configuration.
+func buildRoutes(config *Config) (*routeTable, error) {
+	table := &routeTable{mux: http.NewServeMux(), upstreams: map[string]*upstream{}, stop: make(chan struct{})}
+
+	limiter, err := newRateLimiter(config.RateLimit, routes.Load())
+	if err != nil {
+		return nil, err
+	}
+	table.limiter = limiter
+	if config.OIDC.Issuer != "" {
+		table.oidc = newOIDCProvider(config.OIDC)
+	}
+
+	for name, upstreamConfig := range config.Upstreams {
+		up, err := newUpstream(name, upstreamConfig)
+		if err != nil {
+			return nil, err
+		}
+		table.upstreams[name] = up
+	}
+	if config.APIKeys.Upstream != "" {
+		table.apiKeys = newKeyExchanger(table.upstreams[config.APIKeys.Upstream], config.APIKeys.Cache)
+	}
+
+	for _, route := range config.Routes {
+		route := route
+		up := table.upstreams[route.Upstream]
+		var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if route.Rewrite != "" {
+				r.URL.Path = route.Rewrite
+				r.URL.RawPath = ""
+			}
+			forwardRequest(w, r, up, route)
+		})
+		for i := len(route.Middleware) - 1; i >= 0; i-- {
+			handler = middlewares[route.Middleware[i]](table, route, handler)
+		}
+		table.mux.Handle(route.Path, handler)
+	}
+
+	// Built-in routes that are not forwarded as they are
+	table.mux.Handle("/openapi.json", corsMiddleware(http.HandlerFunc(serveOpenAPI)))
+	table.mux.Handle("/v1/", v1Handler(http.HandlerFunc(serveRoute)))
+	table.mux.Handle("/admin/upstreams", corsMiddleware(adminMiddleware(http.HandlerFunc(listUpstreams))))
+	table.mux.Handle(oidcLoginPath, corsMiddleware(http.HandlerFunc(table.oidcLogin)))
+
+	return table, nil
+}
+
+// serveRoute dispatches a request with the current routing table.
+func serveRoute(w http.ResponseWriter, r *http.Request) {
+	routes.Load().mux.ServeHTTP(w, r)
+}
+
+func forwardRequest(w http.ResponseWriter, r *http.Request, up *upstream, route RouteConfig) {
+	// Forward the JWT token to the downstream service
+	token := r.Header.Get("Authorization")
+	if token != "" {
+		r.Header.Set("Authorization", token)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), route.Timeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	attempts := 1
+	if idempotent(r.Method) {
+		attempts = route.Retry.Attempts
+	}
+	// Keep the body so it can be sent again
+	var body []byte
+	if attempts > 1 && r.Body != nil {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			problem.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		target := up.pick(r)
+		if target == nil {
+			upstreamErrors.WithLabelValues(up.name, reasonNoInstance).Inc()
+			problem.Error(w, "No healthy instances of "+up.name, http.StatusServiceUnavailable)
+			return
+		}
+		if wait, ok := up.breaker.allow(); !ok {
+			upstreamErrors.WithLabelValues(up.name, reasonCircuitOpen).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+			problem.Error(w, "Upstream "+up.name+" is unavailable, its circuit breaker is open", http.StatusServiceUnavailable)
+			return
+		}
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		// Hold back the response of an attempt that may be retried
+		if attempt == attempts {
+			serveTarget(w, r, target)
+			return
+		}
+		recorder := &responseRecorder{header: http.Header{}, status: http.StatusOK}
+		serveTarget(recorder, r, target)
+		if !retryable(recorder.status) || ctx.Err() != nil {
+			recorder.writeTo(w)
+			return
+		}
+
+		delay := backoff(route.Retry, attempt)
+		slog.WarnContext(r.Context(), "Retrying request", "method", r.Method, "path", r.URL.Path, "upstream", up.name,
+			"delay", delay, "status", recorder.status, "attempt", attempt+1, "attempts", attempts)
+		upstreamRetries.WithLabelValues(up.name).Inc()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			recorder.writeTo(w)
+			return
+		}
+	}
+}
+
+func serveTarget(w http.ResponseWriter, r *http.Request, target *target) {
+	target.inFlight.Add(1)
+	defer target.inFlight.Add(-1)
+	target.proxy.ServeHTTP(w, r)
+}
+
+// idempotent reports whether a request can be repeated without changing
+// its effect (RFC 9110, section 9.2.2).
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryable reports whether a response means the upstream, not the
+// request, was at fault.
+func retryable(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// backoff returns a random wait of up to Backoff doubled for each attempt
+// so far, capped at MaxBackoff ("full jitter").
+func backoff(config RetryConfig, attempt int) time.Duration {
+	limit := config.Backoff << (attempt - 1)
+	if limit > config.MaxBackoff || limit <= 0 {
+		limit = config.MaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// The gateway starts a trace, or continues the one in a client's W3C
+// traceparent header, and passes it on to the upstreams, so a request's
+// spans in every service form one trace. Its server spans are named after
+// the OpenAPI path a request matched.
+
+// upstreamTransport sends proxied requests in the trace of the request
+// they forward, as client spans named after the upstream.
+func upstreamTransport(upstream string) http.RoundTripper {
+	return otelhttp.NewTransport(http.DefaultTransport, otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return r.Method + " " + upstream
+	}))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+)
+
+// The /v1/ routes are a REST surface over the legacy RPC-style routes. Each
+// v1 request is rewritten to the legacy route that serves it and handled
+// by the same handler, so the services do not know about versions.
+
+// legacyDeprecatedAt is when the /v1/ routes replaced the legacy ones.
+var legacyDeprecatedAt = time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC)
+
+type v1Route struct {
+	method  string
+	pattern string
+	target  func(params map[string]string, query url.Values) string
+}
+
+// to returns a target that fills the pattern's parameters into path.
+func to(path string) func(map[string]string, url.Values) string {
+	return func(params map[string]string, query url.Values) string {
+		target := path
+		for name, value := range params {
+			target = strings.ReplaceAll(target, "{"+name+"}", url.PathEscape(value))
+		}
+		return target
+	}
+}
+
+var v1Routes = []v1Route{
+	{http.MethodPost, "/v1/auth/register", to("/auth/register")},
+	{http.MethodPost, "/v1/auth/login", to("/auth/login")},
+	{http.MethodPost, "/v1/auth/login/mfa", to("/auth/login/mfa")},
+	{http.MethodPost, "/v1/auth/verify-email", to("/auth/verify-email")},
+	{http.MethodPost, "/v1/auth/verify-email/resend", to("/auth/verify-email/resend")},
+	{http.MethodPost, "/v1/auth/password/forgot", to("/auth/password/forgot")},
+	{http.MethodPost, "/v1/auth/password/reset", to("/auth/password/reset")},
+	{http.MethodGet, "/v1/auth/oidc/login", to("/auth/oidc/login")},
+	{http.MethodGet, "/v1/auth/oidc/callback", to("/auth/oidc/callback")},
+	{http.MethodPost, "/v1/mfa/enroll", to("/users/mfa/enroll")},
+	{http.MethodPost, "/v1/mfa/confirm", to("/users/mfa/confirm")},
+	{http.MethodPost, "/v1/mfa/disable", to("/users/mfa/disable")},
+	{http.MethodPost, "/v1/mfa/recovery-codes", to("/users/mfa/recovery-codes")},
+
+	{http.MethodGet, "/v1/users", to("/users/list")},
+	{http.MethodPost, "/v1/users", to("/users/create")},
+	{http.MethodGet, "/v1/users/{id}", to("/users/get/{id}")},
+	{http.MethodPut, "/v1/users/{id}", to("/users/update/{id}")},
+	{http.MethodPatch, "/v1/users/{id}", to("/users/update/{id}")},
+	{http.MethodDelete, "/v1/users/{id}", to("/users/remove/{id}")},
+	{http.MethodPost, "/v1/users/{id}/restore", to("/users/restore/{id}")},
+	{http.MethodGet, "/v1/users/{id}/deactivation-report", to("/users/deactivation-report/{id}")},
+	{http.MethodPost, "/v1/users/{id}/unlock", to("/users/unlock/{id}")},
+	{http.MethodGet, "/v1/users/{id}/login-history", to("/users/login-history/{id}")},
+	{http.MethodDelete, "/v1/users/{id}/mfa", to("/users/mfa/reset/{id}")},
+	{http.MethodGet, "/v1/deactivation-reports", to("/users/deactivation-reports")},
+
+	{http.MethodGet, "/v1/orgs", to("/orgs/list")},
+	{http.MethodPost, "/v1/orgs", to("/orgs/create")},
+	{http.MethodGet, "/v1/orgs/{id}", to("/orgs/get/{id}")},
+	{http.MethodPost, "/v1/orgs/{id}/switch", to("/orgs/switch/{id}")},
+	{http.MethodGet, "/v1/orgs/{id}/members", to("/orgs/members/{id}")},
+	{http.MethodPut, "/v1/orgs/{id}/members/{user_id}", to("/orgs/members/{id}/{user_id}")},
+	{http.MethodDelete, "/v1/orgs/{id}/members/{user_id}", to("/orgs/members/{id}/{user_id}")},
+	{http.MethodGet, "/v1/orgs/{id}/invitations", to("/orgs/invitations/{id}")},
+	{http.MethodPost, "/v1/orgs/{id}/invitations", to("/orgs/invitations/{id}")},
+	{http.MethodDelete, "/v1/orgs/{id}/invitations/{invitation_id}", to("/orgs/invitations/{id}/{invitation_id}")},
+	{http.MethodPost, "/v1/invitations/accept", to("/orgs/accept")},
+
+	{http.MethodGet, "/v1/tokens", to("/tokens/list")},
+	{http.MethodPost, "/v1/tokens", to("/tokens/create")},
+	{http.MethodDelete, "/v1/tokens/{id}", to("/tokens/revoke/{id}")},
+	{http.MethodGet, "/v1/api-keys", to("/apikeys/list")},
+	{http.MethodPost, "/v1/api-keys", to("/apikeys/create")},
+	{http.MethodDelete, "/v1/api-keys/{id}", to("/apikeys/revoke/{id}")},
+
+	{http.MethodGet, "/v1/tasks", listTasksTarget},
+	{http.MethodPost, "/v1/tasks", to("/tasks/create")},
+	{http.MethodGet, "/v1/tasks/{id}", to("/tasks/get/{id}")},
+	{http.MethodPut, "/v1/tasks/{id}", to("/tasks/update/{id}")},
+	{http.MethodPatch, "/v1/tasks/{id}", to("/tasks/update/{id}")},
+	{http.MethodDelete, "/v1/tasks/{id}", to("/tasks/remove/{id}")},
+	{http.MethodPost, "/v1/tasks/{id}/restore", to("/tasks/restore/{id}")},
+
+	{http.MethodGet, "/v1/projects", to("/projects/list")},
+	{http.MethodPost, "/v1/projects", to("/projects/create")},
+	{http.MethodGet, "/v1/projects/{id}", to("/projects/get/{id}")},
+	{http.MethodPatch, "/v1/projects/{id}", to("/projects/update/{id}")},
+	{http.MethodDelete, "/v1/projects/{id}", to("/projects/remove/{id}")},
+	{http.MethodPost, "/v1/projects/{id}/restore", to("/projects/restore/{id}")},
+	{http.MethodGet, "/v1/projects/{id}/dashboard", to("/projects/dashboard/{id}")},
+
+	{http.MethodGet, "/v1/teams", to("/teams/list")},
+	{http.MethodPost, "/v1/teams", to("/teams/create")},
+	{http.MethodGet, "/v1/teams/{id}", to("/teams/get/{id}")},
+	{http.MethodPatch, "/v1/teams/{id}", to("/teams/update/{id}")},
+	{http.MethodDelete, "/v1/teams/{id}", to("/teams/remove/{id}")},
+	{http.MethodPost, "/v1/teams/{id}/restore", to("/teams/restore/{id}")},
+
+	{http.MethodGet, "/v1/billings", to("/billings/list")},
+	{http.MethodPost, "/v1/billings", to("/billings/create")},
+	{http.MethodGet, "/v1/billings/{id}", to("/billings/get/{id}")},
+	{http.MethodPut, "/v1/billings/{id}", to("/billings/update/{id}")},
+	{http.MethodPatch, "/v1/billings/{id}", to("/billings/update/{id}")},
+	{http.MethodDelete, "/v1/billings/{id}", to("/billings/remove/{id}")},
+	{http.MethodPost, "/v1/billings/{id}/restore", to("/billings/restore/{id}")},
+	{http.MethodGet, "/v1/accounts/{id}", to("/billings/account/{id}")},
+	{http.MethodGet, "/v1/project-billings", to("/billings/byProject")},
+
+	{http.MethodGet, "/v1/webhooks", to("/webhooks/list")},
+	{http.MethodPost, "/v1/webhooks", to("/webhooks/create")},
+	{http.MethodGet, "/v1/webhooks/{id}", to("/webhooks/get/{id}")},
+	{http.MethodDelete, "/v1/webhooks/{id}", to("/webhooks/remove/{id}")},
+	{http.MethodGet, "/v1/webhooks/{id}/deliveries", to("/webhooks/deliveries/{id}")},
+	{http.MethodPost, "/v1/webhook-deliveries/{id}/redeliver", to("/webhooks/redeliver/{id}")},
+
+	{http.MethodGet, "/v1/audit/entries", to("/audit/list")},
+	{http.MethodGet, "/v1/audit/verify", to("/audit/verify")},
+}
+
+// listTasksTarget serves GET /v1/tasks?assignee=<user_id> from the
+// per-user listing and everything else from the full list.
+func listTasksTarget(params map[string]string, query url.Values) string {
+	assignee := query.Get("assignee")
+	if assignee == "" {
+		return "/tasks/list"
+	}
+	query.Del("assignee")
+	return "/tasks/listByUser/" + url.PathEscape(assignee)
+}
+
+// matchV1 matches a path against a pattern, returning its parameters.
+func matchV1(pattern, path string) (map[string]string, bool) {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(patternParts) != len(pathParts) {
+		return nil, false
+	}
+
+	params := map[string]string{}
+	for i, part := range patternParts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			if pathParts[i] == "" {
+				return nil, false
+			}
+			params[part[1:len(part)-1]] = pathParts[i]
+		} else if part != pathParts[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+type v1ContextKey struct{}
+
+// fromV1 reports whether a request arrived on a /v1/ route.
+func fromV1(r *http.Request) bool {
+	return r.Context().Value(v1ContextKey{}) != nil
+}
+
+// v1Handler rewrites /v1/ requests to their legacy routes and hands them
+// back to the gateway's mux.
+func v1Handler(mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		for _, route := range v1Routes {
+			params, ok := matchV1(route.pattern, r.URL.Path)
+			if !ok {
+				continue
+			}
+			if route.method != r.Method && r.Method != http.MethodOptions {
+				allowed = append(allowed, route.method)
+				continue
+			}
+
+			query := r.URL.Query()
+			legacy := r.Clone(context.WithValue(r.Context(), v1ContextKey{}, route.pattern))
+			legacy.URL.Path = route.target(params, query)
+			legacy.URL.RawPath = ""
+			legacy.URL.RawQuery = query.Encode()
+			mux.ServeHTTP(w, legacy)
+			return
+		}
+
+		if len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		problem.Error(w, "No route for "+r.URL.Path, http.StatusNotFound)
+	})
+}
+
+// deprecated marks responses from a legacy route with the Deprecation
+// header (RFC 9745) and a link to the /v1/ route replacing it.
+func deprecated(successor string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !fromV1(r) {
+			w.Header().Set("Deprecation", "@"+strconv.FormatInt(legacyDeprecatedAt.Unix(), 10))
+			w.Header().Add("Link", "<"+successor+">; rel=\"successor-version\"")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
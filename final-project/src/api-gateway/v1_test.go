@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestMatchV1(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    map[string]string
+		ok      bool
+	}{
+		{"/v1/tasks", "/v1/tasks", map[string]string{}, true},
+		{"/v1/tasks", "/v1/tasks/", map[string]string{}, true},
+		{"/v1/tasks/{id}", "/v1/tasks/42", map[string]string{"id": "42"}, true},
+		{"/v1/orgs/{id}/members/{user_id}", "/v1/orgs/1/members/2", map[string]string{"id": "1", "user_id": "2"}, true},
+		{"/v1/tasks/{id}", "/v1/tasks", nil, false},
+		{"/v1/tasks/{id}", "/v1/tasks/42/restore", nil, false},
+		{"/v1/tasks/{id}/restore", "/v1/tasks/42/remove", nil, false},
+		// A parameter cannot be empty
+		{"/v1/orgs/{id}/members", "/v1/orgs//members", nil, false},
+	}
+	for _, tt := range tests {
+		params, ok := matchV1(tt.pattern, tt.path)
+		if ok != tt.ok || (ok && !reflect.DeepEqual(params, tt.want)) {
+			t.Errorf("matchV1(%q, %q) = %v, %v, want %v, %v", tt.pattern, tt.path, params, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestV1Handler(t *testing.T) {
+	// The mux answers with the legacy route it was handed
+	var legacy *http.Request
+	mux := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		legacy = r
+	})
+	handler := v1Handler(mux)
+
+	tests := []struct {
+		method    string
+		target    string
+		status    int
+		wantPath  string
+		wantQuery string
+		allow     string
+	}{
+		{http.MethodGet, "/v1/tasks", http.StatusOK, "/tasks/list", "", ""},
+		{http.MethodPost, "/v1/tasks", http.StatusOK, "/tasks/create", "", ""},
+		{http.MethodGet, "/v1/tasks?assignee=abc&page=2", http.StatusOK, "/tasks/listByUser/abc", "page=2", ""},
+		{http.MethodGet, "/v1/tasks?page=2", http.StatusOK, "/tasks/list", "page=2", ""},
+		{http.MethodPatch, "/v1/tasks/42", http.StatusOK, "/tasks/update/42", "", ""},
+		{http.MethodDelete, "/v1/orgs/1/members/2", http.StatusOK, "/orgs/members/1/2", "", ""},
+		{http.MethodPost, "/v1/webhook-deliveries/7/redeliver", http.StatusOK, "/webhooks/redeliver/7", "", ""},
+		{http.MethodGet, "/v1/users/42/login-history", http.StatusOK, "/users/login-history/42", "", ""},
+		// Preflight requests go through for the CORS middleware to answer
+		{http.MethodOptions, "/v1/teams", http.StatusOK, "/teams/list", "", ""},
+		{http.MethodPut, "/v1/tasks", http.StatusMethodNotAllowed, "", "", "GET, POST"},
+		{http.MethodPut, "/v1/projects/1", http.StatusMethodNotAllowed, "", "", "GET, PATCH, DELETE"},
+		{http.MethodGet, "/v1/nothing", http.StatusNotFound, "", "", ""},
+	}
+	for _, tt := range tests {
+		legacy = nil
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+
+		if w.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.target, w.Code, tt.status)
+			continue
+		}
+		if got := w.Header().Get("Allow"); got != tt.allow {
+			t.Errorf("%s %s: Allow %q, want %q", tt.method, tt.target, got, tt.allow)
+		}
+		if tt.wantPath == "" {
+			if legacy != nil {
+				t.Errorf("%s %s: handed on to %s", tt.method, tt.target, legacy.URL.Path)
+			}
+			continue
+		}
+		if legacy == nil {
+			t.Errorf("%s %s: not handed on", tt.method, tt.target)
+			continue
+		}
+		if legacy.URL.Path != tt.wantPath || legacy.URL.RawQuery != tt.wantQuery {
+			t.Errorf("%s %s: handed on to %s?%s, want %s?%s", tt.method, tt.target, legacy.URL.Path, legacy.URL.RawQuery, tt.wantPath, tt.wantQuery)
+		}
+		if !fromV1(legacy) {
+			t.Errorf("%s %s: not marked as a v1 request", tt.method, tt.target)
+		}
+	}
+}
+
+func TestDeprecated(t *testing.T) {
+	handler := deprecated("/v1/tasks", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	v1 := v1Handler(handler)
+
+	tests := []struct {
+		name        string
+		handler     http.Handler
+		target      string
+		deprecation string
+		link        string
+	}{
+		{"legacy route", handler, "/tasks/list", "@1792281600", `</v1/tasks>; rel="successor-version"`},
+		{"v1 route", v1, "/v1/tasks", "", ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if got := w.Header().Get("Deprecation"); got != tt.deprecation {
+			t.Errorf("%s: Deprecation %q, want %q", tt.name, got, tt.deprecation)
+		}
+		if got := w.Header().Get("Link"); got != tt.link {
+			t.Errorf("%s: Link %q, want %q", tt.name, got, tt.link)
+		}
+	}
+}
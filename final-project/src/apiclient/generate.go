@@ -0,0 +1,5 @@
+// Package apiclient is a typed client for the API gateway, generated from
+// the gateway's OpenAPI document. Run go generate after changing it.
+package apiclient
+
+//go:generate go run github.com/oapi-codegen/oapi-codegen/v2/cmd/oapi-codegen@v2.3.0 -config oapi-codegen.yaml ../api-gateway/openapi.json
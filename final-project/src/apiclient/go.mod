@@ -0,0 +1,13 @@
+module github.com/DavidN0809/Cloud-Computing/final-project/apiclient
+
+go 1.21.6
+
+require (
+	github.com/oapi-codegen/nullable v1.1.0
+	github.com/oapi-codegen/runtime v1.1.1
+)
+
+require (
+	github.com/apapsch/go-jsonmerge/v2 v2.0.0 // indirect
+	github.com/google/uuid v1.5.0 // indirect
+)
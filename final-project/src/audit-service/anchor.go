@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// The hash chain shows that no entry was changed or taken out of the
+// middle of the log, but not that the newest ones are still there: a log
+// cut short is a valid chain. So the head of the chain, the sequence
+// number and hash of the newest entry, is also kept outside the database,
+// in AUDIT_ANCHOR_FILE, and verification checks the log against it.
+
+const defaultAnchorFile = "/var/lib/audit/head.json"
+
+// chainHead is the newest entry of the chain as recorded outside the database.
+type chainHead struct {
+	Seq  int64  `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+func anchorFile() string {
+	if path := os.Getenv("AUDIT_ANCHOR_FILE"); path != "" {
+		return path
+	}
+	return defaultAnchorFile
+}
+
+// readAnchor returns the anchored head, or the zero head if nothing has
+// been anchored yet.
+func readAnchor() (chainHead, error) {
+	var head chainHead
+	raw, err := os.ReadFile(anchorFile())
+	if errors.Is(err, fs.ErrNotExist) {
+		return head, nil
+	}
+	if err != nil {
+		return head, err
+	}
+	err = json.Unmarshal(raw, &head)
+	return head, err
+}
+
+// advanceAnchor records entry as the head of the chain unless the anchor is
+// already at or past it. The file is replaced in one rename, so a reader
+// never sees it half written.
+func advanceAnchor(entry AuditEntry) error {
+	head, err := readAnchor()
+	if err != nil {
+		return err
+	}
+	if entry.Seq <= head.Seq {
+		return nil
+	}
+
+	raw, err := json.Marshal(chainHead{Seq: entry.Seq, Hash: entry.Hash})
+	if err != nil {
+		return err
+	}
+	path := anchorFile()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/auth"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/eventbus"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/health"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/logging"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/metrics"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/server"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
+)
+
+var client *mongo.Client
+
+// eventSource names the service in the events it publishes and its logs
+const eventSource = "audit-service"
+
+var bus eventbus.Broker
+
+// genesisHash is the previous hash of the first entry in the chain.
+const genesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// hashKey keys the entry hashes. It comes from AUDIT_HMAC_KEY and is kept
+// out of the database, so whoever can write to the log cannot compute the
+// hashes that would make an edited chain verify.
+var hashKey []byte
+
+func main() {
+	logging.Setup(eventSource)
+	shutdownTracing := tracing.Setup(eventSource)
+	defer shutdownTracing(context.Background())
+
+	hashKey = []byte(os.Getenv("AUDIT_HMAC_KEY"))
+	if len(hashKey) == 0 {
+		log.Fatal("AUDIT_HMAC_KEY must be set")
+	}
+
+	// Create a new MongoDB client
+	var err error
+	client, err = mongo.NewClient(options.Client().ApplyURI("mongodb://audit-mongodb:27017").SetMonitor(metrics.MongoMonitor()))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Connect to MongoDB
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = client.Connect(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Disconnect(context.Background())
+	health.AddCheck("mongodb", health.PingMongo(client))
+
+	err = ensureIndexes(client)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Connect to the event bus
+	bus, err = eventbus.Connect()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer bus.Close()
+	health.AddCheck("eventbus", bus.Ping)
+
+	// Append the audit records published by the other services
+	if err := startConsumers(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Create a new HTTP server
+	mux := http.NewServeMux()
+
+	// Audit endpoints. The log is append-only, so there is no update or delete.
+	mux.Handle("/audit/list", authMiddleware(adminMiddleware(http.HandlerFunc(listEntries))))
+	mux.Handle("/audit/verify", authMiddleware(adminMiddleware(http.HandlerFunc(verifyChain))))
+
+	// Liveness and readiness checks, used by the API gateway and Kubernetes
+	mux.HandleFunc("/healthz", health.Healthz)
+	mux.HandleFunc("/readyz", health.Readyz)
+
+	// Prometheus metrics
+	mux.Handle("/metrics", promhttp.Handler())
+
+	// Start the server
+	log.Println("Audit Service listening on port 8005...")
+	route := metrics.MuxRoute(mux)
+	server.Run(":8005", tracing.Middleware(logging.Middleware(metrics.Middleware(auth.RequireScopes(mux), route)), route))
+}
+
+func ensureIndexes(client *mongo.Client) error {
+	_, err := entries().Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "seq", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "target_id", Value: 1}, {Key: "seq", Value: -1}}},
+		{Keys: bson.D{{Key: "actor", Value: 1}, {Key: "seq", Value: -1}}},
+	})
+	return err
+}
+
+// AuditEntry is one link of the hash chain. Hash is an HMAC of every other
+// field, including the previous entry's hash, so editing or removing an
+// entry breaks the chain from that point on. Removing the newest entries
+// is caught by the anchor (see anchor.go).
+type AuditEntry struct {
+	ID        string          `bson:"_id" json:"id"`
+	Seq       int64           `bson:"seq" json:"seq"`
+	Time      time.Time       `bson:"time" json:"time"`
+	Service   string          `bson:"service" json:"service"`
+	Actor     string          `bson:"actor" json:"actor"`
+	Role      string          `bson:"role" json:"role"`
+	Method    string          `bson:"method" json:"method"`
+	Route     string          `bson:"route" json:"route"`
+	Action    string          `bson:"action" json:"action"`
+	TargetID  string          `bson:"target_id" json:"target_id"`
+	RequestID string          `bson:"request_id" json:"request_id"`
+	DiffJSON  string          `bson:"diff" json:"-"`
+	Diff      json.RawMessage `bson:"-" json:"diff"`
+	PrevHash  string          `bson:"prev_hash" json:"prev_hash"`
+	Hash      string          `bson:"hash" json:"hash"`
+}
+
+func entries() *mongo.Collection {
+	return client.Database("audit").Collection("entries")
+}
+
+// computeHash hashes the entry's fields in a fixed order with hashKey.
+func computeHash(entry AuditEntry) string {
+	fields := []string{
+		entry.PrevHash,
+		strconv.FormatInt(entry.Seq, 10),
+		entry.ID,
+		entry.Time.UTC().Format(time.RFC3339Nano),
+		entry.Service,
+		entry.Actor,
+		entry.Role,
+		entry.Method,
+		entry.Route,
+		entry.Action,
+		entry.TargetID,
+		entry.RequestID,
+		entry.DiffJSON,
+	}
+	mac := hmac.New(sha256.New, hashKey)
+	mac.Write([]byte(strings.Join(fields, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// startConsumers appends audit.recorded events to the chain. A single
+// consumer group processes events in order, so entries are chained
+// without concurrent writers.
+func startConsumers() error {
+	return bus.Subscribe(server.Background(), "audit-service", []string{"audit.recorded"}, appendEntry)
+}
+
+func appendEntry(ctx context.Context, event eventbus.Event) error {
+	var record struct {
+		Service   string          `json:"service"`
+		Actor     string          `json:"actor"`
+		Role      string          `json:"role"`
+		Method    string          `json:"method"`
+		Route     string          `json:"route"`
+		Action    string          `json:"action"`
+		TargetID  string          `json:"target_id"`
+		RequestID string          `json:"request_id"`
+		Diff      json.RawMessage `json:"diff"`
+		Time      time.Time       `json:"time"`
+	}
+	if err := json.Unmarshal(event.Data, &record); err != nil {
+		log.Printf("Ignoring malformed audit.recorded event %s: %v", event.ID, err)
+		return nil
+	}
+
+	// The event is delivered at least once; the event ID keys the entry.
+	// An entry appended before its anchor could be written is anchored now.
+	var existing AuditEntry
+	err := entries().FindOne(ctx, bson.M{"_id": event.ID}).Decode(&existing)
+	if err == nil {
+		return advanceAnchor(existing)
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+
+	var last AuditEntry
+	prevHash, seq := genesisHash, int64(1)
+	err = entries().FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.D{{Key: "seq", Value: -1}})).Decode(&last)
+	if err == nil {
+		prevHash, seq = last.Hash, last.Seq+1
+	} else if !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+
+	entry := AuditEntry{
+		ID: event.ID,
+		// Mongo stores milliseconds; truncate so the stored time hashes the same
+		Time:      record.Time.UTC().Truncate(time.Millisecond),
+		Seq:       seq,
+		Service:   record.Service,
+		Actor:     record.Actor,
+		Role:      record.Role,
+		Method:    record.Method,
+		Route:     record.Route,
+		Action:    record.Action,
+		TargetID:  record.TargetID,
+		RequestID: record.RequestID,
+		DiffJSON:  string(record.Diff),
+		PrevHash:  prevHash,
+	}
+	entry.Hash = computeHash(entry)
+
+	if _, err = entries().InsertOne(ctx, entry); err != nil {
+		return err
+	}
+	return advanceAnchor(entry)
+}
+
+func listEntries(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := req.URL.Query()
+	filter := bson.M{}
+	for _, field := range []string{"service", "actor", "action", "target_id", "request_id"} {
+		if value := query.Get(field); value != "" {
+			filter[field] = value
+		}
+	}
+
+	limit := int64(100)
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 || parsed > 1000 {
+			problem.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: -1}}).SetLimit(limit)
+	cursor, err := entries().Find(tracing.Traced(req), filter, opts)
+	if err != nil {
+		problem.Error(w, "Failed to list audit entries", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	list := []AuditEntry{}
+	if err = cursor.All(context.Background(), &list); err != nil {
+		problem.Error(w, "Failed to decode audit entries", http.StatusInternalServerError)
+		return
+	}
+	for i := range list {
+		list[i].Diff = json.RawMessage(list[i].DiffJSON)
+		if len(list[i].Diff) == 0 {
+			list[i].Diff = json.RawMessage("{}")
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// verifyChain walks the whole log in order and reports the first entry
+// whose hash or link to its predecessor does not match, or entries missing
+// from the end of the log.
+func verifyChain(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	head, err := readAnchor()
+	if err != nil {
+		log.Printf("Failed to read the audit chain anchor: %v", err)
+		problem.Error(w, "Failed to read the audit chain anchor", http.StatusInternalServerError)
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}})
+	cursor, err := entries().Find(tracing.Traced(req), bson.M{}, opts)
+	if err != nil {
+		problem.Error(w, "Failed to read audit entries", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	check := newChainCheck(head)
+	for cursor.Next(context.Background()) {
+		var entry AuditEntry
+		if err := cursor.Decode(&entry); err != nil {
+			problem.Error(w, "Failed to decode audit entry", http.StatusInternalServerError)
+			return
+		}
+		if !check.add(entry) {
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(check.result())
+}
+
+// ChainCheck is the outcome of verifying the log.
+type ChainCheck struct {
+	Valid       bool   `json:"valid"`
+	Entries     int64  `json:"entries"`
+	AnchoredSeq int64  `json:"anchored_seq"`
+	BrokenAt    int64  `json:"broken_at,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// chainCheck verifies entries one at a time, in sequence order.
+type chainCheck struct {
+	head        chainHead
+	check       ChainCheck
+	prevHash    string
+	expectedSeq int64
+}
+
+func newChainCheck(head chainHead) *chainCheck {
+	return &chainCheck{
+		head:        head,
+		check:       ChainCheck{Valid: true, AnchoredSeq: head.Seq},
+		prevHash:    genesisHash,
+		expectedSeq: 1,
+	}
+}
+
+// add checks the next entry, returning false once the chain is broken.
+func (c *chainCheck) add(entry AuditEntry) bool {
+	switch {
+	case entry.Seq != c.expectedSeq:
+		c.check.Reason = "entry missing"
+	case entry.PrevHash != c.prevHash:
+		c.check.Reason = "previous hash mismatch"
+	case !hmac.Equal([]byte(computeHash(entry)), []byte(entry.Hash)):
+		c.check.Reason = "hash mismatch"
+	case entry.Seq == c.head.Seq && entry.Hash != c.head.Hash:
+		c.check.Reason = "anchored hash mismatch"
+	}
+	if c.check.Reason != "" {
+		c.check.Valid = false
+		c.check.BrokenAt = c.expectedSeq
+		return false
+	}
+
+	c.check.Entries++
+	c.prevHash, c.expectedSeq = entry.Hash, entry.Seq+1
+	return true
+}
+
+// result finishes the check: a valid chain must reach the anchored head.
+func (c *chainCheck) result() ChainCheck {
+	if c.check.Valid && c.check.Entries < c.head.Seq {
+		c.check.Valid = false
+		c.check.BrokenAt = c.expectedSeq
+		c.check.Reason = "entries missing from the end"
+	}
+	return c.check
+}
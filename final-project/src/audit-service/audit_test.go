@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testChain builds a valid chain of n entries.
+func testChain(n int) []AuditEntry {
+	hashKey = []byte("test-key")
+	chain := make([]AuditEntry, 0, n)
+	prevHash := genesisHash
+	for i := 1; i <= n; i++ {
+		entry := AuditEntry{
+			ID:       fmt.Sprintf("event-%d", i),
+			Seq:      int64(i),
+			Time:     time.Date(2026, 1, 1, 0, 0, i, 0, time.UTC),
+			Service:  "task-service",
+			Actor:    "user-1",
+			Action:   "update",
+			TargetID: "task-1",
+			DiffJSON: `{"status":{"before":"open","after":"done"}}`,
+			PrevHash: prevHash,
+		}
+		entry.Hash = computeHash(entry)
+		prevHash = entry.Hash
+		chain = append(chain, entry)
+	}
+	return chain
+}
+
+func TestComputeHashIsKeyed(t *testing.T) {
+	entry := testChain(1)[0]
+	hashKey = []byte("another-key")
+	if computeHash(entry) == entry.Hash {
+		t.Fatal("the hash does not depend on the key")
+	}
+}
+
+func TestChainCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		tamper   func([]AuditEntry) []AuditEntry
+		head     func([]AuditEntry) chainHead
+		valid    bool
+		brokenAt int64
+		reason   string
+	}{
+		{
+			name:  "intact",
+			valid: true,
+		},
+		{
+			name: "field edited",
+			tamper: func(chain []AuditEntry) []AuditEntry {
+				chain[1].Actor = "someone-else"
+				return chain
+			},
+			brokenAt: 2,
+			reason:   "hash mismatch",
+		},
+		{
+			name: "entry edited and rehashed without the key",
+			tamper: func(chain []AuditEntry) []AuditEntry {
+				chain[1].Actor = "someone-else"
+				hashKey = []byte("guessed-key")
+				chain[1].Hash = computeHash(chain[1])
+				hashKey = []byte("test-key")
+				return chain
+			},
+			brokenAt: 2,
+			reason:   "hash mismatch",
+		},
+		{
+			name: "entry removed from the middle",
+			tamper: func(chain []AuditEntry) []AuditEntry {
+				return append(chain[:1], chain[2:]...)
+			},
+			brokenAt: 2,
+			reason:   "entry missing",
+		},
+		{
+			name: "entry relinked",
+			tamper: func(chain []AuditEntry) []AuditEntry {
+				chain[2].PrevHash = chain[0].Hash
+				return chain
+			},
+			brokenAt: 3,
+			reason:   "previous hash mismatch",
+		},
+		{
+			name: "newest entries removed",
+			tamper: func(chain []AuditEntry) []AuditEntry {
+				return chain[:2]
+			},
+			brokenAt: 3,
+			reason:   "entries missing from the end",
+		},
+		{
+			name: "everything removed",
+			tamper: func(chain []AuditEntry) []AuditEntry {
+				return nil
+			},
+			brokenAt: 1,
+			reason:   "entries missing from the end",
+		},
+		{
+			name: "head does not match the anchor",
+			head: func(chain []AuditEntry) chainHead {
+				return chainHead{Seq: 4, Hash: chain[2].Hash}
+			},
+			brokenAt: 4,
+			reason:   "anchored hash mismatch",
+		},
+		{
+			name: "nothing anchored yet",
+			head: func(chain []AuditEntry) chainHead {
+				return chainHead{}
+			},
+			valid: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := testChain(4)
+			head := chainHead{Seq: 4, Hash: chain[3].Hash}
+			if tt.head != nil {
+				head = tt.head(chain)
+			}
+			if tt.tamper != nil {
+				chain = tt.tamper(chain)
+			}
+
+			check := newChainCheck(head)
+			for _, entry := range chain {
+				if !check.add(entry) {
+					break
+				}
+			}
+			got := check.result()
+			if got.Valid != tt.valid || got.BrokenAt != tt.brokenAt || got.Reason != tt.reason {
+				t.Errorf("got valid=%v broken_at=%d reason=%q, want valid=%v broken_at=%d reason=%q",
+					got.Valid, got.BrokenAt, got.Reason, tt.valid, tt.brokenAt, tt.reason)
+			}
+		})
+	}
+}
+
+func TestAdvanceAnchor(t *testing.T) {
+	t.Setenv("AUDIT_ANCHOR_FILE", t.TempDir()+"/anchor/head.json")
+
+	chain := testChain(3)
+	for _, i := range []int{0, 2, 1} {
+		if err := advanceAnchor(chain[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An older entry, such as a redelivered one, does not move the anchor back
+	head, err := readAnchor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Seq != 3 || head.Hash != chain[2].Hash {
+		t.Errorf("anchor = %+v, want seq 3 with the hash of entry 3", head)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/eventbus"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/server"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/softdelete"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tenant"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
+)
+
+// Account is the billing state of a user. Users without an account document
+// are treated as open; an account is closed when its user is removed.
+type Account struct {
+	UserID   primitive.ObjectID `bson:"_id" json:"user_id"`
+	Status   string             `bson:"status" json:"status"`
+	ClosedAt *time.Time         `bson:"closed_at,omitempty" json:"closed_at,omitempty"`
+}
+
+func accounts() *mongo.Collection {
+	return client.Database("billing").Collection("accounts")
+}
+
+// accountClosed reports whether new billings for the user must be rejected.
+func accountClosed(ctx context.Context, userID primitive.ObjectID) (bool, error) {
+	var account Account
+	err := accounts().FindOne(ctx, bson.M{"_id": userID}).Decode(&account)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	return account.Status == "closed", err
+}
+
+// startConsumers subscribes the billing service to events from the other services.
+func startConsumers() error {
+	types := []string{"user.deactivated", "user.restored", "task.completed", tenant.RevokedEvent}
+	return bus.Subscribe(server.Background(), "billing-service", types, func(ctx context.Context, event eventbus.Event) error {
+		switch event.Type {
+		case tenant.RevokedEvent:
+			return tenants.Handle(ctx, event)
+		case "user.deactivated":
+			return handleUserDeactivated(ctx, event)
+		case "user.restored":
+			return handleUserRestored(ctx, event)
+		case "task.completed":
+			return handleTaskCompleted(ctx, event)
+		}
+		return nil
+	})
+}
+
+// handleUserRestored reopens the billing account of a restored user.
+func handleUserRestored(ctx context.Context, event eventbus.Event) error {
+	var data struct {
+		UserID primitive.ObjectID `json:"user_id"`
+	}
+	if err := json.Unmarshal(event.Data, &data); err != nil {
+		log.Printf("Ignoring malformed user.restored event %s: %v", event.ID, err)
+		return nil
+	}
+
+	_, err := accounts().UpdateOne(ctx, bson.M{"_id": data.UserID}, bson.M{
+		"$set":   bson.M{"status": "open"},
+		"$unset": bson.M{"closed_at": ""},
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Reopened billing account of restored user %s", data.UserID.Hex())
+	return nil
+}
+
+// handleUserDeactivated closes the billing account of a removed user and
+// reports the user's existing billings as affected.
+func handleUserDeactivated(ctx context.Context, event eventbus.Event) error {
+	var data struct {
+		UserID        primitive.ObjectID `json:"user_id"`
+		DeactivatedAt time.Time          `json:"deactivated_at"`
+	}
+	if err := json.Unmarshal(event.Data, &data); err != nil {
+		log.Printf("Ignoring malformed user.deactivated event %s: %v", event.ID, err)
+		return nil
+	}
+
+	_, err := accounts().UpdateOne(ctx,
+		bson.M{"_id": data.UserID},
+		bson.M{"$set": bson.M{"status": "closed", "closed_at": data.DeactivatedAt}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+
+	cursor, err := client.Database("billing").Collection("billings").Find(ctx, softdelete.NotDeleted(bson.M{"user_id": data.UserID}))
+	if err != nil {
+		return err
+	}
+	var billings []Billing
+	if err = cursor.All(ctx, &billings); err != nil {
+		return err
+	}
+
+	affected := make([]string, 0, len(billings))
+	for _, billing := range billings {
+		affected = append(affected, billing.ID.Hex())
+	}
+
+	log.Printf("Closed billing account of deactivated user %s with %d billing(s)", data.UserID.Hex(), len(affected))
+	publishEvent("user.cascade_completed", map[string]interface{}{
+		"user_id":      data.UserID,
+		"action":       "account_closed",
+		"affected_ids": affected,
+	})
+	return nil
+}
+
+func getAccount(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/billings/account/"):])
+	if err != nil {
+		problem.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	account := Account{UserID: userID, Status: "open"}
+	err = accounts().FindOne(tracing.Traced(req), bson.M{"_id": userID}).Decode(&account)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		problem.Error(w, "Failed to load account", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(account)
+}
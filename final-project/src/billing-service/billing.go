@@ -11,14 +11,53 @@ import (
     "go.mongodb.org/mongo-driver/bson/primitive"
     "go.mongodb.org/mongo-driver/mongo"
     "go.mongodb.org/mongo-driver/mongo/options"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/audit"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/auth"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/concurrency"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/eventbus"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/health"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/logging"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/mergepatch"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/metrics"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/server"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/softdelete"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tenant"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/validate"
 )
 
 var client *mongo.Client
 
+// eventSource names the service in the events it publishes and its logs
+const eventSource = "billing-service"
+
+var bus eventbus.Broker
+
+var outbox *eventbus.Outbox
+
+// publishEvent publishes an event from this service through its outbox.
+func publishEvent(eventType string, data interface{}) {
+	outbox.Publish(eventSource, eventType, data)
+}
+
+// recordAudit publishes the audit record of a mutating request. before and
+// after are the document as it was and as it is now; either may be nil for
+// creates and hard deletes.
+func recordAudit(req *http.Request, action, targetID string, before, after interface{}) {
+	publishEvent("audit.recorded", audit.FromRequest(eventSource, req, action, targetID, before, after))
+}
+
 func main() {
+    logging.Setup(eventSource)
+    shutdownTracing := tracing.Setup(eventSource)
+    defer shutdownTracing(context.Background())
+
     // Create a new MongoDB client
     var err error
-    client, err = mongo.NewClient(options.Client().ApplyURI("mongodb://billing-mongodb:27017"))
+    client, err = mongo.NewClient(options.Client().ApplyURI("mongodb://billing-mongodb:27017").SetMonitor(metrics.MongoMonitor()))
     if err != nil {
         log.Fatal(err)
     }
@@ -30,7 +69,8 @@ func main() {
     if err != nil {
         log.Fatal(err)
     }
-    defer client.Disconnect(ctx)
+    defer client.Disconnect(context.Background())
+    health.AddCheck("mongodb", health.PingMongo(client))
 
     // Check if the database and collection exist, create them if they don't
     err = ensureDatabaseAndCollection(client)
@@ -38,21 +78,71 @@ func main() {
         log.Fatal(err)
     }
 
+    // Every billing belongs to an organization
+    err = ensureTenancy(client)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    // Tokens outlive memberships, so revoked ones are recorded
+    tenants, err = tenant.NewRevocations(client.Database("billing").Collection("revocations"))
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    // Each completed task is invoiced once per completion
+    err = ensureInvoiceIndex(client)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    // Connect to the event bus
+    bus, err = eventbus.Connect()
+    if err != nil {
+        log.Fatal(err)
+    }
+    defer bus.Close()
+    health.AddCheck("eventbus", bus.Ping)
+
+    // Events go out through an outbox in the service's own database
+    outbox, err = eventbus.NewOutbox(client.Database("billing").Collection("outbox"), bus)
+    if err != nil {
+        log.Fatal(err)
+    }
+    server.Go(outbox.Relay)
+
+    // Consume events from the other services
+    if err := startConsumers(); err != nil {
+        log.Fatal(err)
+    }
+
+    // Purge soft-deleted billings once their retention period has passed
+    server.Go(func() { softdelete.RetentionJob(client.Database("billing").Collection("billings")) })
+
     // Create a new HTTP server
     mux := http.NewServeMux()
 
     // Billing endpoints
-mux.Handle("/billings/list", authMiddleware(adminMiddleware(http.HandlerFunc(listBillings))))
-mux.Handle("/billings/create", authMiddleware(http.HandlerFunc(createBilling)))
-mux.Handle("/billings/get/", authMiddleware(adminMiddleware(http.HandlerFunc(getBilling))))
-mux.Handle("/billings/update/", authMiddleware(adminMiddleware(http.HandlerFunc(updateBilling))))
-mux.Handle("/billings/remove/", authMiddleware(adminMiddleware(http.HandlerFunc(removeBilling))))
-mux.Handle("/billings/removeAllBillings", http.HandlerFunc(removeAllBillings))
-mux.Handle("/billings/createForTaskService", http.HandlerFunc(createBilling))
+mux.Handle("/billings/list", tenantMiddleware(adminMiddleware(http.HandlerFunc(listBillings))))
+mux.Handle("/billings/create", tenantMiddleware(http.HandlerFunc(createBilling)))
+mux.Handle("/billings/get/", tenantMiddleware(adminMiddleware(http.HandlerFunc(getBilling))))
+mux.Handle("/billings/update/", tenantMiddleware(adminMiddleware(http.HandlerFunc(updateBilling))))
+mux.Handle("/billings/remove/", tenantMiddleware(adminMiddleware(http.HandlerFunc(removeBilling))))
+mux.Handle("/billings/restore/", tenantMiddleware(adminMiddleware(http.HandlerFunc(restoreBilling))))
+mux.Handle("/billings/byProject", tenantMiddleware(adminMiddleware(http.HandlerFunc(billingsByProject))))
+mux.Handle("/billings/account/", tenantMiddleware(adminMiddleware(http.HandlerFunc(getAccount))))
+
+    // Liveness and readiness checks, used by the API gateway and Kubernetes
+    mux.HandleFunc("/healthz", health.Healthz)
+    mux.HandleFunc("/readyz", health.Readyz)
+
+    // Prometheus metrics
+    mux.Handle("/metrics", promhttp.Handler())
 
     // Start the server
     log.Println("Billing Service listening on port 8003...")
-    log.Fatal(http.ListenAndServe(":8003", mux))
+    route := metrics.MuxRoute(mux)
+    server.Run(":8003", tracing.Middleware(logging.Middleware(metrics.Middleware(auth.RequireScopes(mux), route)), route))
 }
 func ensureDatabaseAndCollection(client *mongo.Client) error {
     dbName := "billing"
@@ -112,138 +202,327 @@ type Billing struct {
 	ID     primitive.ObjectID `bson:"_id" json:"id"`
 	UserID primitive.ObjectID `bson:"user_id" json:"user_id"`
 	TaskID primitive.ObjectID `bson:"task_id" json:"task_id"`
+	OrgID  primitive.ObjectID `bson:"org_id" json:"org_id"`
+	ProjectID *primitive.ObjectID `bson:"project_id,omitempty" json:"project_id,omitempty"`
 	Hours  float64             `bson:"hours" json:"hours"`
+	Rate   float64             `bson:"rate" json:"rate"`
 	Amount float64             `bson:"amount" json:"amount"`
+	DeletedAt *time.Time       `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	DeletedBy string           `bson:"deleted_by,omitempty" json:"deleted_by,omitempty"`
+	Version   int64            `bson:"version" json:"version"`
+	// EventID is the task.completed event an invoice was raised for
+	EventID   string           `bson:"event_id,omitempty" json:"-"`
 }
 
 func createBilling(w http.ResponseWriter, req *http.Request) {
     if req.Method != http.MethodPost {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         return
     }
 
     var billing Billing
-    err := json.NewDecoder(req.Body).Decode(&billing)
-    if err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+    if errs := validate.DecodeBody(req, &billing); errs != nil {
+        problem.Validation(w, http.StatusBadRequest, errs)
         return
     }
 
-    hourlyRate := 100.0 // Adjust this value as necessary
-    billing.Amount = float64(billing.Hours) * hourlyRate
+    // Invoices carry their project's hourly rate; anything else is billed
+    // at the default one.
+    if billing.Rate <= 0 {
+        billing.Rate = defaultHourlyRate
+    }
+    billing.Amount = float64(billing.Hours) * billing.Rate
+
+    if errs := validateBilling(billing); len(errs) > 0 {
+        problem.Validation(w, http.StatusUnprocessableEntity, errs)
+        return
+    }
+
+    closed, err := accountClosed(tracing.Traced(req), billing.UserID)
+    if err != nil {
+        problem.Error(w, "Failed to check billing account", http.StatusInternalServerError)
+        return
+    }
+    if closed {
+        problem.Error(w, "Billing account is closed", http.StatusConflict)
+        return
+    }
 
     collection := client.Database("billing").Collection("billings")
     billing.ID = primitive.NewObjectID()
-    _, err = collection.InsertOne(context.TODO(), billing)
+    billing.OrgID = tenant.Org(req)
+    billing.Version = 1
+    _, err = collection.InsertOne(tracing.Traced(req), billing)
     if err != nil {
-        http.Error(w, "Failed to create billing", http.StatusInternalServerError)
+        problem.Error(w, "Failed to create billing", http.StatusInternalServerError)
         return
     }
 
+    publishEvent("billing.created", billing)
+    recordAudit(req, "create", billing.ID.Hex(), nil, billing)
+
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(billing)
 }
 
 func getBilling(w http.ResponseWriter, req *http.Request) {
     if req.Method != http.MethodGet {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         return
     }
 
     billingID := req.URL.Path[len("/billings/get/"):]
     objectID, err := primitive.ObjectIDFromHex(billingID)
     if err != nil {
-        http.Error(w, "Invalid billing ID", http.StatusBadRequest)
+        problem.Error(w, "Invalid billing ID", http.StatusBadRequest)
         return
     }
 
     collection := client.Database("billing").Collection("billings")
-    filter := bson.M{"_id": objectID}
+    filter := softdelete.Scope(req, tenant.InOrg(req, bson.M{"_id": objectID}))
 
     var billing Billing
-    err = collection.FindOne(context.TODO(), filter).Decode(&billing)
+    err = collection.FindOne(tracing.Traced(req), filter).Decode(&billing)
     if err != nil {
-        http.Error(w, "Billing not found", http.StatusNotFound)
+        problem.Error(w, "Billing not found", http.StatusNotFound)
         return
     }
 
     w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("ETag", concurrency.ETag(billing.Version))
     json.NewEncoder(w).Encode(billing)
 }
 
 func updateBilling(w http.ResponseWriter, req *http.Request) {
+    if req.Method == http.MethodPatch {
+        patchBilling(w, req)
+        return
+    }
     if req.Method != http.MethodPut {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         return
     }
 
     billingID := req.URL.Path[len("/billings/update/"):]
     objectID, err := primitive.ObjectIDFromHex(billingID)
     if err != nil {
-        http.Error(w, "Invalid billing ID", http.StatusBadRequest)
+        problem.Error(w, "Invalid billing ID", http.StatusBadRequest)
         return
     }
 
-    var billing Billing
-    err = json.NewDecoder(req.Body).Decode(&billing)
+    version, status, err := concurrency.IfMatch(req)
     if err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        problem.Error(w, err.Error(), status)
+        return
+    }
+
+    var billing Billing
+    if errs := validate.DecodeBody(req, &billing); errs != nil {
+        problem.Validation(w, http.StatusBadRequest, errs)
+        return
+    }
+    if errs := validateBilling(billing); len(errs) > 0 {
+        problem.Validation(w, http.StatusUnprocessableEntity, errs)
         return
     }
 
     collection := client.Database("billing").Collection("billings")
-    filter := bson.M{"_id": objectID}
+    filter := concurrency.MatchVersion(softdelete.NotDeleted(tenant.InOrg(req, bson.M{"_id": objectID})), version)
     update := bson.M{"$set": bson.M{
         "user_id": billing.UserID,
         "task_id": billing.TaskID,
+        "project_id": billing.ProjectID,
         "hours":   billing.Hours,
+        "rate":    billing.Rate,
         "amount":  billing.Amount,
     }}
 
-    _, err = collection.UpdateOne(context.TODO(), filter, update)
+    before := loadBilling(objectID)
+    result, err := collection.UpdateOne(tracing.Traced(req), filter, concurrency.BumpVersion(update))
     if err != nil {
-        http.Error(w, "Failed to update billing", http.StatusInternalServerError)
+        problem.Error(w, "Failed to update billing", http.StatusInternalServerError)
+        return
+    }
+    if result.MatchedCount == 0 {
+        status, message := concurrency.Conflict(collection, tenant.InOrg(req, bson.M{"_id": objectID}))
+        problem.Error(w, "Billing "+message, status)
         return
     }
 
+    recordAudit(req, "update", billingID, before, loadBilling(objectID))
+
+    w.Header().Set("ETag", concurrency.ETag(version+1))
     w.WriteHeader(http.StatusNoContent)
 }
 
+// Fields each role may change with PATCH. The billing routes are admin only.
+var billingPatchFields = map[string]map[string]bool{
+    "admin": {"user_id": true, "task_id": true, "project_id": true, "hours": true, "rate": true, "amount": true},
+}
+
+// patchBilling applies a JSON merge patch to a billing, so only the fields
+// in the patch change. The patched billing is validated and written in one
+// versioned replace.
+func patchBilling(w http.ResponseWriter, req *http.Request) {
+    billingID := req.URL.Path[len("/billings/update/"):]
+    objectID, err := primitive.ObjectIDFromHex(billingID)
+    if err != nil {
+        problem.Error(w, "Invalid billing ID", http.StatusBadRequest)
+        return
+    }
+
+    version, status, err := concurrency.IfMatch(req)
+    if err != nil {
+        problem.Error(w, err.Error(), status)
+        return
+    }
+
+    patch, err := mergepatch.Decode(req)
+    if err != nil {
+        problem.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if err := mergepatch.CheckFields(patch, billingPatchFields[auth.Role(req)]); err != nil {
+        problem.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+
+    collection := client.Database("billing").Collection("billings")
+    var currentBilling Billing
+    err = collection.FindOne(tracing.Traced(req), softdelete.NotDeleted(tenant.InOrg(req, bson.M{"_id": objectID}))).Decode(&currentBilling)
+    if err != nil {
+        problem.Error(w, "Billing not found", http.StatusNotFound)
+        return
+    }
+    if currentBilling.Version != version {
+        problem.Error(w, "Billing has been modified, fetch it again and retry", http.StatusPreconditionFailed)
+        return
+    }
+
+    patched := currentBilling
+    if err := mergepatch.Into(&patched, patch); err != nil {
+        problem.Validation(w, http.StatusBadRequest, validate.JSONErrors(err))
+        return
+    }
+    // The event an invoice was raised for is not part of its JSON
+    patched.EventID = currentBilling.EventID
+    if errs := validateBilling(patched); len(errs) > 0 {
+        problem.Validation(w, http.StatusUnprocessableEntity, errs)
+        return
+    }
+
+    patched.Version = version + 1
+    result, err := collection.ReplaceOne(tracing.Traced(req), concurrency.MatchVersion(softdelete.NotDeleted(tenant.InOrg(req, bson.M{"_id": objectID})), version), patched)
+    if err != nil {
+        problem.Error(w, "Failed to update billing", http.StatusInternalServerError)
+        return
+    }
+    if result.MatchedCount == 0 {
+        status, message := concurrency.Conflict(collection, tenant.InOrg(req, bson.M{"_id": objectID}))
+        problem.Error(w, "Billing "+message, status)
+        return
+    }
+
+    recordAudit(req, "update", billingID, currentBilling, patched)
+
+    w.Header().Set("ETag", concurrency.ETag(patched.Version))
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// validateBilling checks a complete billing against the billing schema.
+func validateBilling(billing Billing) validate.Errors {
+    var errs validate.Errors
+    if billing.UserID.IsZero() {
+        errs.Add("user_id", "is required")
+    }
+    errs.AtLeast("hours", billing.Hours, 0)
+    errs.AtLeast("rate", billing.Rate, 0)
+    errs.AtLeast("amount", billing.Amount, 0)
+    return errs
+}
+
 func removeBilling(w http.ResponseWriter, req *http.Request) {
     if req.Method != http.MethodDelete {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         return
     }
 
     billingID := req.URL.Path[len("/billings/remove/"):]
     objectID, err := primitive.ObjectIDFromHex(billingID)
     if err != nil {
-        http.Error(w, "Invalid billing ID", http.StatusBadRequest)
+        problem.Error(w, "Invalid billing ID", http.StatusBadRequest)
         return
     }
 
     collection := client.Database("billing").Collection("billings")
-    filter := bson.M{"_id": objectID}
+    filter := tenant.InOrg(req, bson.M{"_id": objectID})
+    before := loadBilling(objectID)
+
+    result, err := softdelete.Delete(req, collection, filter)
+    if err != nil {
+        problem.Error(w, "Failed to remove billing", http.StatusInternalServerError)
+        return
+    }
+    if result.MatchedCount == 0 {
+        problem.Error(w, "Billing not found", http.StatusNotFound)
+        return
+    }
+
+    recordAudit(req, "delete", billingID, before, loadBilling(objectID))
 
-    _, err = collection.DeleteOne(context.TODO(), filter)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+func restoreBilling(w http.ResponseWriter, req *http.Request) {
+    if req.Method != http.MethodPost {
+        problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    billingID := req.URL.Path[len("/billings/restore/"):]
+    objectID, err := primitive.ObjectIDFromHex(billingID)
+    if err != nil {
+        problem.Error(w, "Invalid billing ID", http.StatusBadRequest)
+        return
+    }
+
+    collection := client.Database("billing").Collection("billings")
+    before := loadBilling(objectID)
+    result, err := softdelete.Restore(collection, tenant.InOrg(req, bson.M{"_id": objectID}))
     if err != nil {
-        http.Error(w, "Failed to remove billing", http.StatusInternalServerError)
+        problem.Error(w, "Failed to restore billing", http.StatusInternalServerError)
+        return
+    }
+    if result.MatchedCount == 0 {
+        problem.Error(w, "Deleted billing not found", http.StatusNotFound)
         return
     }
 
+    recordAudit(req, "restore", billingID, before, loadBilling(objectID))
+
     w.WriteHeader(http.StatusNoContent)
 }
 
 func listBillings(w http.ResponseWriter, req *http.Request) {
     if req.Method != http.MethodGet {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         return
     }
 
+    filter := softdelete.Scope(req, tenant.InOrg(req, bson.M{}))
+    if value := req.URL.Query().Get("project_id"); value != "" {
+        projectID, err := primitive.ObjectIDFromHex(value)
+        if err != nil {
+            problem.Error(w, "Invalid project ID", http.StatusBadRequest)
+            return
+        }
+        filter["project_id"] = projectID
+    }
+
     collection := client.Database("billing").Collection("billings")
-    cursor, err := collection.Find(context.TODO(), bson.M{})
+    cursor, err := collection.Find(tracing.Traced(req), filter)
     if err != nil {
-        http.Error(w, "Failed to list billings", http.StatusInternalServerError)
+        problem.Error(w, "Failed to list billings", http.StatusInternalServerError)
         return
     }
     defer cursor.Close(context.Background())
@@ -251,7 +530,7 @@ func listBillings(w http.ResponseWriter, req *http.Request) {
     var billings []Billing
     err = cursor.All(context.Background(), &billings)
     if err != nil {
-        http.Error(w, "Failed to decode billings", http.StatusInternalServerError)
+        problem.Error(w, "Failed to decode billings", http.StatusInternalServerError)
         return
     }
 
@@ -259,20 +538,13 @@ func listBillings(w http.ResponseWriter, req *http.Request) {
     json.NewEncoder(w).Encode(billings)
 }
 
-
-func removeAllBillings(w http.ResponseWriter, req *http.Request) {
-    if req.Method != http.MethodDelete {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-        return
-    }
-
-    collection := client.Database("billing").Collection("billings")
-
-    _, err := collection.DeleteMany(context.TODO(), bson.M{})
+// loadBilling returns the billing with the given ID, including a
+// soft-deleted one, or nil if it does not exist.
+func loadBilling(objectID primitive.ObjectID) *Billing {
+    var billing Billing
+    err := client.Database("billing").Collection("billings").FindOne(context.TODO(), bson.M{"_id": objectID}).Decode(&billing)
     if err != nil {
-        http.Error(w, "Failed to remove all billings", http.StatusInternalServerError)
-        return
+        return nil
     }
-
-    w.WriteHeader(http.StatusNoContent)
+    return &billing
 }
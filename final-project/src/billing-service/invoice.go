@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/audit"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/eventbus"
+)
+
+// Completed tasks are invoiced from their task.completed event rather than
+// by a call from the task service. The event bus delivers at least once, so
+// an invoice records the event it was raised for, and a unique index on the
+// task and event makes a redelivered event a no-op. A task that is reopened
+// and completed again is invoiced again, from its new event.
+
+// ensureInvoiceIndex makes sure each task.completed event raises at most
+// one invoice. Billings created through the API carry no event.
+func ensureInvoiceIndex(client *mongo.Client) error {
+	collection := client.Database("billing").Collection("billings")
+	_, err := collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "task_id", Value: 1}, {Key: "event_id", Value: 1}},
+		Options: options.Index().
+			SetName("task_event_id").
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"event_id": bson.M{"$exists": true}}),
+	})
+	return err
+}
+
+// handleTaskCompleted invoices a completed task to its assignee, in the
+// task's organization and at the rate the task service billed it at.
+func handleTaskCompleted(ctx context.Context, event eventbus.Event) error {
+	var data struct {
+		TaskID     primitive.ObjectID  `json:"task_id"`
+		OrgID      primitive.ObjectID  `json:"org_id"`
+		ProjectID  *primitive.ObjectID `json:"project_id"`
+		AssignedTo primitive.ObjectID  `json:"assigned_to"`
+		Hours      float64             `json:"hours"`
+		Rate       float64             `json:"rate"`
+	}
+	if err := json.Unmarshal(event.Data, &data); err != nil {
+		log.Printf("Ignoring malformed task.completed event %s: %v", event.ID, err)
+		return nil
+	}
+
+	closed, err := accountClosed(ctx, data.AssignedTo)
+	if err != nil {
+		return err
+	}
+	if closed {
+		log.Printf("Not invoicing task %s: the billing account of user %s is closed", data.TaskID.Hex(), data.AssignedTo.Hex())
+		return nil
+	}
+
+	invoice := Billing{
+		ID:        primitive.NewObjectID(),
+		UserID:    data.AssignedTo,
+		TaskID:    data.TaskID,
+		OrgID:     data.OrgID,
+		ProjectID: data.ProjectID,
+		Hours:     data.Hours,
+		Rate:      data.Rate,
+		EventID:   event.ID,
+		Version:   1,
+	}
+	if invoice.Rate <= 0 {
+		invoice.Rate = defaultHourlyRate
+	}
+	invoice.Amount = invoice.Hours * invoice.Rate
+	if errs := validateBilling(invoice); len(errs) > 0 {
+		log.Printf("Not invoicing task %s from event %s: %v", data.TaskID.Hex(), event.ID, errs)
+		return nil
+	}
+
+	_, err = client.Database("billing").Collection("billings").InsertOne(ctx, invoice)
+	if mongo.IsDuplicateKeyError(err) {
+		log.Printf("Task %s was already invoiced for event %s", data.TaskID.Hex(), event.ID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Invoiced task %s to user %s as billing %s", data.TaskID.Hex(), data.AssignedTo.Hex(), invoice.ID.Hex())
+	publishEvent("billing.created", invoice)
+	publishEvent("invoice.created", invoice)
+	publishEvent("audit.recorded", audit.FromEvent(eventSource, event, "create", invoice.ID.Hex(), nil, invoice))
+	return nil
+}
@@ -7,6 +7,8 @@ import (
     "strings"
 
     "github.com/dgrijalva/jwt-go"
+
+    "github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
 )
 
 func corsMiddleware(next http.Handler) http.Handler {
@@ -18,7 +20,7 @@ func corsMiddleware(next http.Handler) http.Handler {
        if w.Header().Get("Access-Control-Allow-Origin") == "" {
            w.Header().Set("Access-Control-Allow-Origin", origin)
        }
-       w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+       w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
        w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
        w.Header().Set("Access-Control-Allow-Credentials", "true")
 
@@ -36,7 +38,7 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
     return func(w http.ResponseWriter, req *http.Request) {
         tokenString := req.Header.Get("Authorization")
         if tokenString == "" {
-            http.Error(w, "Missing token", http.StatusUnauthorized)
+            problem.Error(w, "Missing token", http.StatusUnauthorized)
             return
         }
 
@@ -53,7 +55,7 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
         })
 
         if err != nil {
-            http.Error(w, "Invalid token", http.StatusUnauthorized)
+            problem.Error(w, "Invalid token", http.StatusUnauthorized)
             return
         }
 
@@ -68,7 +70,7 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
             next(w, req)
         } else {
-            http.Error(w, "Invalid token", http.StatusUnauthorized)
+            problem.Error(w, "Invalid token", http.StatusUnauthorized)
         }
     }
 }
@@ -78,7 +80,7 @@ func adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
     return func(w http.ResponseWriter, req *http.Request) {
         role := req.Context().Value("role")
         if role != "admin" {
-            http.Error(w, "Unauthorized", http.StatusForbidden)
+            problem.Error(w, "Unauthorized", http.StatusForbidden)
             return
         }
         next(w, req)
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/softdelete"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tenant"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
+)
+
+// defaultHourlyRate is what billings without a project rate are billed at.
+const defaultHourlyRate = 100.0
+
+// ProjectBilling sums an organization's billings for one project. Billings
+// outside any project are grouped under a nil ProjectID.
+type ProjectBilling struct {
+	ProjectID *primitive.ObjectID `bson:"_id" json:"project_id"`
+	Billings  int                 `bson:"billings" json:"billings"`
+	Hours     float64             `bson:"hours" json:"hours"`
+	Amount    float64             `bson:"amount" json:"amount"`
+}
+
+// billingsByProject groups the organization's live billings by project.
+func billingsByProject(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	collection := client.Database("billing").Collection("billings")
+	pipeline := []bson.M{
+		{"$match": softdelete.NotDeleted(tenant.InOrg(req, bson.M{}))},
+		{"$group": bson.M{
+			"_id":      bson.M{"$ifNull": []interface{}{"$project_id", nil}},
+			"billings": bson.M{"$sum": 1},
+			"hours":    bson.M{"$sum": "$hours"},
+			"amount":   bson.M{"$sum": "$amount"},
+		}},
+		{"$sort": bson.M{"amount": -1}},
+	}
+	cursor, err := collection.Aggregate(tracing.Traced(req), pipeline)
+	if err != nil {
+		problem.Error(w, "Failed to group billings", http.StatusInternalServerError)
+		return
+	}
+	groups := []ProjectBilling{}
+	if err := cursor.All(tracing.Traced(req), &groups); err != nil {
+		problem.Error(w, "Failed to decode billings", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tenant"
+)
+
+// Every billing belongs to the organization it was created in, which for
+// invoices is the organization of the completed task. The billing routes
+// take a token naming an organization in its org_id claim, and every
+// billing query they run is scoped to it with tenant.InOrg. Admins of the
+// organization have admin rights here, until the user service revokes
+// their role. Billing accounts belong to users,
+// not organizations, so they are not scoped.
+
+// ensureTenancy indexes billings by organization and moves billings
+// without one into the default organization.
+func ensureTenancy(client *mongo.Client) error {
+	collection := client.Database("billing").Collection("billings")
+	_, err := collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "org_id", Value: 1}, {Key: "user_id", Value: 1}},
+		Options: options.Index().SetName("org_user_id"),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = collection.UpdateMany(context.Background(),
+		bson.M{"org_id": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"org_id": tenant.DefaultOrgID}})
+	return err
+}
+
+// tenants holds the membership revocations that tenantMiddleware checks.
+var tenants *tenant.Revocations
+
+// tenantMiddleware authenticates the request and scopes it to the
+// organization its token names; see tenant.Revocations.Middleware.
+func tenantMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(tenants.Middleware(next))
+}
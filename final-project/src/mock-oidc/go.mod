@@ -0,0 +1,5 @@
+module github.com/DavidN0809/Cloud-Computing/final-project/mock-oidc
+
+go 1.21.6
+
+require github.com/dgrijalva/jwt-go v3.2.0+incompatible
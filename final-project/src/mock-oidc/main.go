@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// A mock OpenID Connect provider for trying out SSO logins locally. It
+// supports the authorization code flow with PKCE (S256 only) for one
+// client. Its login page signs in anyone as whoever they type in, with the
+// groups they type in. Never run it anywhere real.
+
+const (
+	codeTTL    = time.Minute
+	idTokenTTL = 5 * time.Minute
+	keyID      = "mock-1"
+)
+
+var (
+	issuer       = env("ISSUER", "http://localhost:9000")
+	clientID     = env("CLIENT_ID", "task-management")
+	clientSecret = env("CLIENT_SECRET", "mock-client-secret")
+	redirectURIs = strings.Split(env("REDIRECT_URIS", "http://localhost:8000/v1/auth/oidc/callback"), ",")
+
+	signingKey *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes = map[string]*authorization{}
+)
+
+// authorization is an issued code waiting to be exchanged.
+type authorization struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+	username    string
+	email       string
+	groups      []string
+	expires     time.Time
+}
+
+func env(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func main() {
+	var err error
+	signingKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", discovery)
+	mux.HandleFunc("/authorize", authorize)
+	mux.HandleFunc("/token", token)
+	mux.HandleFunc("/jwks", jwks)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"ok"}`))
+	})
+
+	log.Printf("Mock OIDC provider for %s listening on port 9000...", issuer)
+	log.Fatal(http.ListenAndServe(":9000", mux))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// tokenError answers a token request with an OAuth 2.0 error (RFC 6749,
+// section 5.2).
+func tokenError(w http.ResponseWriter, status int, code, description string) {
+	writeJSON(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+func discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"jwks_uri":                              issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "email", "profile", "groups"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "email", "email_verified", "preferred_username", "name", "groups"},
+	})
+}
+
+func jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(signingKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(signingKey.E)).Bytes()),
+		}},
+	})
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Mock OIDC login</title></head>
+<body>
+<h1>Mock OIDC login</h1>
+<p>Signs you in as anyone. For local testing only.</p>
+<form method="post" action="/authorize">
+{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}<p><label>Username <input name="username" value="sso_user" required></label></p>
+<p><label>Email <input name="email" value="sso_user@example.com" required></label></p>
+<p><label>Groups (comma separated) <input name="groups" value="task-users"></label></p>
+<p><button type="submit">Sign in</button></p>
+</form>
+</body>
+</html>
+`))
+
+// authorize shows the login page, and on submit sends the browser back to
+// the client with a code.
+func authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Errors about the client or redirect URI cannot be sent back to it
+	redirectURI := r.Form.Get("redirect_uri")
+	if r.Form.Get("client_id") != clientID {
+		http.Error(w, "Unknown client_id", http.StatusBadRequest)
+		return
+	}
+	registered := false
+	for _, uri := range redirectURIs {
+		registered = registered || uri == redirectURI
+	}
+	if !registered {
+		http.Error(w, "Unregistered redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	back, _ := url.Parse(redirectURI)
+	query := back.Query()
+	query.Set("state", r.Form.Get("state"))
+	fail := func(code, description string) {
+		query.Set("error", code)
+		query.Set("error_description", description)
+		back.RawQuery = query.Encode()
+		http.Redirect(w, r, back.String(), http.StatusFound)
+	}
+	switch {
+	case r.Form.Get("response_type") != "code":
+		fail("unsupported_response_type", "only the code flow is supported")
+		return
+	case !strings.Contains(" "+r.Form.Get("scope")+" ", " openid "):
+		fail("invalid_scope", "the openid scope is required")
+		return
+	case r.Form.Get("code_challenge") == "" || r.Form.Get("code_challenge_method") != "S256":
+		fail("invalid_request", "PKCE with S256 is required")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		params := map[string]string{}
+		for _, name := range []string{"response_type", "client_id", "redirect_uri", "scope", "state", "nonce", "code_challenge", "code_challenge_method"} {
+			params[name] = r.Form.Get(name)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		loginPage.Execute(w, map[string]interface{}{"Params": params})
+		return
+	}
+
+	username := strings.TrimSpace(r.Form.Get("username"))
+	if username == "" {
+		fail("access_denied", "no username given")
+		return
+	}
+	var groups []string
+	for _, group := range strings.Split(r.Form.Get("groups"), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+
+	code := randomString()
+	mu.Lock()
+	codes[code] = &authorization{
+		redirectURI: redirectURI,
+		challenge:   r.Form.Get("code_challenge"),
+		nonce:       r.Form.Get("nonce"),
+		username:    username,
+		email:       strings.TrimSpace(r.Form.Get("email")),
+		groups:      groups,
+		expires:     time.Now().Add(codeTTL),
+	}
+	mu.Unlock()
+
+	query.Set("code", code)
+	back.RawQuery = query.Encode()
+	http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+// token exchanges a code for an ID token.
+func token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		tokenError(w, http.StatusMethodNotAllowed, "invalid_request", "use POST")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, http.StatusBadRequest, "invalid_request", "invalid form")
+		return
+	}
+
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if id != clientID || subtle.ConstantTimeCompare([]byte(secret), []byte(clientSecret)) != 1 {
+		tokenError(w, http.StatusUnauthorized, "invalid_client", "unknown client or wrong secret")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	// Codes work once
+	mu.Lock()
+	auth := codes[r.PostForm.Get("code")]
+	delete(codes, r.PostForm.Get("code"))
+	for code, pending := range codes {
+		if time.Now().After(pending.expires) {
+			delete(codes, code)
+		}
+	}
+	mu.Unlock()
+
+	if auth == nil || time.Now().After(auth.expires) || auth.redirectURI != r.PostForm.Get("redirect_uri") {
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "unknown or expired code")
+		return
+	}
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.challenge {
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "code_verifier does not match")
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":                issuer,
+		"sub":                "mock|" + auth.username,
+		"aud":                clientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(idTokenTTL).Unix(),
+		"email":              auth.email,
+		"email_verified":     auth.email != "",
+		"preferred_username": auth.username,
+		"name":               auth.username,
+		"groups":             auth.groups,
+	}
+	if auth.nonce != "" {
+		claims["nonce"] = auth.nonce
+	}
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idToken.Header["kid"] = keyID
+	signed, err := idToken.SignedString(signingKey)
+	if err != nil {
+		tokenError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   int(idTokenTTL.Seconds()),
+		"id_token":     signed,
+	})
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
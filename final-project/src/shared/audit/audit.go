@@ -0,0 +1,167 @@
+// Package audit builds the records of the audit log. Services publish a
+// record for every change as an audit.recorded event, and the audit
+// service appends it to the hash-chained log.
+package audit
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/auth"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/eventbus"
+)
+
+// redacted lists fields whose values never leave the service in an audit
+// record, at any depth; only the fact that they changed is recorded.
+var redacted = map[string]bool{
+	"password":           true,
+	"secret":             true,
+	"pending_secret":     true,
+	"totp_secret":        true,
+	"recovery_codes":     true,
+	"recovery_code":      true,
+	"token":              true,
+	"token_hash":         true,
+	"verification_token": true,
+	"reset_token":        true,
+	"challenge_token":    true,
+	"key":                true,
+	"api_key":            true,
+	"webhook_secret":     true,
+}
+
+// Record is the payload of an audit.recorded event.
+type Record struct {
+	Service   string           `json:"service"`
+	Actor     string           `json:"actor"`
+	Role      string           `json:"role"`
+	Method    string           `json:"method"`
+	Route     string           `json:"route"`
+	Action    string           `json:"action"`
+	TargetID  string           `json:"target_id"`
+	RequestID string           `json:"request_id"`
+	Diff      map[string]Delta `json:"diff"`
+	Time      time.Time        `json:"time"`
+}
+
+type Delta struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// FromRequest makes the record of a mutating request. before and after are
+// the document as it was and as it is now; either may be nil for creates
+// and hard deletes.
+func FromRequest(service string, req *http.Request, action, targetID string, before, after interface{}) Record {
+	actor, role := Actor(req)
+	return Record{
+		Service:   service,
+		Actor:     actor,
+		Role:      role,
+		Method:    req.Method,
+		Route:     req.URL.Path,
+		Action:    action,
+		TargetID:  targetID,
+		RequestID: req.Header.Get("X-Request-ID"),
+		Diff:      Diff(before, after),
+		Time:      time.Now().UTC(),
+	}
+}
+
+// FromEvent makes the record of a change made while handling an event. The
+// service that published the event is the actor.
+func FromEvent(service string, event eventbus.Event, action, targetID string, before, after interface{}) Record {
+	return Record{
+		Service:   service,
+		Actor:     event.Source,
+		Role:      "service",
+		Method:    "EVENT",
+		Route:     event.Type,
+		Action:    action,
+		TargetID:  targetID,
+		RequestID: event.ID,
+		Diff:      Diff(before, after),
+		Time:      time.Now().UTC(),
+	}
+}
+
+// Actor identifies who made the request from the auth context or
+// bearer token, falling back to "anonymous".
+func Actor(req *http.Request) (string, string) {
+	if userID, ok := req.Context().Value("userID").(string); ok {
+		role, _ := req.Context().Value("role").(string)
+		return userID, role
+	}
+	if claims := auth.Claims(req); claims != nil {
+		userID, _ := claims["userID"].(string)
+		role, _ := claims["role"].(string)
+		return userID, role
+	}
+	return "anonymous", ""
+}
+
+// Diff compares the top-level JSON fields of two documents.
+func Diff(before, after interface{}) map[string]Delta {
+	beforeFields := fields(before)
+	afterFields := fields(after)
+
+	diff := make(map[string]Delta)
+	for key, value := range beforeFields {
+		if !reflect.DeepEqual(value, afterFields[key]) {
+			diff[key] = Delta{Before: value, After: afterFields[key]}
+		}
+	}
+	for key, value := range afterFields {
+		if _, seen := beforeFields[key]; !seen {
+			diff[key] = Delta{Before: nil, After: value}
+		}
+	}
+
+	for key, delta := range diff {
+		if redacted[strings.ToLower(key)] {
+			diff[key] = Delta{Before: "[redacted]", After: "[redacted]"}
+			continue
+		}
+		diff[key] = Delta{Before: redact(delta.Before), After: redact(delta.After)}
+	}
+	return diff
+}
+
+// redact replaces the values of redacted fields inside nested objects.
+func redact(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			if redacted[strings.ToLower(key)] {
+				value[key] = "[redacted]"
+			} else {
+				value[key] = redact(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = redact(item)
+		}
+	}
+	return value
+}
+
+func fields(doc interface{}) map[string]interface{} {
+	fields := make(map[string]interface{})
+	if doc == nil || reflect.ValueOf(doc).IsZero() {
+		return fields
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		log.Printf("Failed to marshal document for audit: %v", err)
+		return fields
+	}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		log.Printf("Failed to unmarshal document for audit: %v", err)
+	}
+	return fields
+}
@@ -0,0 +1,74 @@
+package audit
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffRedactsSecrets(t *testing.T) {
+	type mfa struct {
+		Secret        string   `json:"secret"`
+		RecoveryCodes []string `json:"recovery_codes"`
+		Enabled       bool     `json:"enabled"`
+	}
+	type user struct {
+		Username string              `json:"username"`
+		Password string              `json:"password"`
+		Token    string              `json:"token,omitempty"`
+		MFA      *mfa                `json:"mfa,omitempty"`
+		Keys     []map[string]string `json:"keys,omitempty"`
+	}
+
+	tests := []struct {
+		name          string
+		before, after interface{}
+		want          map[string]Delta
+	}{
+		{
+			name:   "changed password",
+			before: user{Username: "ann", Password: "old-hash"},
+			after:  user{Username: "ann", Password: "new-hash"},
+			want:   map[string]Delta{"password": {"[redacted]", "[redacted]"}},
+		},
+		{
+			name:  "created with secrets",
+			after: user{Username: "ann", Password: "hash", Token: "verify-me"},
+			want: map[string]Delta{
+				"username": {nil, "ann"},
+				"password": {"[redacted]", "[redacted]"},
+				"token":    {"[redacted]", "[redacted]"},
+			},
+		},
+		{
+			name:   "nested secrets",
+			before: user{Username: "ann"},
+			after:  user{Username: "ann", MFA: &mfa{Secret: "JBSWY3DP", RecoveryCodes: []string{"a", "b"}, Enabled: true}},
+			want: map[string]Delta{"mfa": {nil, map[string]interface{}{
+				"secret":         "[redacted]",
+				"recovery_codes": "[redacted]",
+				"enabled":        true,
+			}}},
+		},
+		{
+			name:   "secrets in arrays",
+			before: user{Username: "ann"},
+			after:  user{Username: "ann", Keys: []map[string]string{{"name": "ci", "api_key": "tm_key_123"}}},
+			want: map[string]Delta{"keys": {nil, []interface{}{
+				map[string]interface{}{"name": "ci", "api_key": "[redacted]"},
+			}}},
+		},
+		{
+			name:   "unchanged",
+			before: user{Username: "ann", Password: "hash"},
+			after:  user{Username: "ann", Password: "hash"},
+			want:   map[string]Delta{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Diff(tt.before, tt.after); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestRequireScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		claims jwt.MapClaims
+		want   int
+	}{
+		{"login token writes", http.MethodPost, jwt.MapClaims{"userID": "u"}, http.StatusOK},
+		{"read key reads", http.MethodGet, jwt.MapClaims{"scopes": []string{"read"}}, http.StatusOK},
+		{"read key writes", http.MethodPost, jwt.MapClaims{"scopes": []string{"read"}}, http.StatusForbidden},
+		{"read key deletes", http.MethodDelete, jwt.MapClaims{"scopes": []string{"read", "admin"}}, http.StatusForbidden},
+		{"write key writes", http.MethodPatch, jwt.MapClaims{"scopes": []string{"read", "write"}}, http.StatusOK},
+		{"key without scopes writes", http.MethodPut, jwt.MapClaims{"scopes": []string{}}, http.StatusForbidden},
+		{"anonymous request", http.MethodPost, nil, http.StatusOK},
+	}
+	handler := RequireScopes(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/tasks/create", nil)
+		if tt.claims != nil {
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, tt.claims).SignedString(secretKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Package concurrency implements optimistic concurrency control for
+// MongoDB documents.
+package concurrency
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/softdelete"
+)
+
+// Documents carry a version that every write increments. GET responses
+// expose it as an ETag and PUT requests must send it back in If-Match, so
+// a write based on a stale read is rejected instead of overwriting.
+
+// ETag formats a document version as an entity tag.
+func ETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// IfMatch returns the version in the request's If-Match header. The
+// int is the status to respond with when the header is missing or invalid.
+func IfMatch(req *http.Request) (int64, int, error) {
+	header := strings.TrimSpace(req.Header.Get("If-Match"))
+	if header == "" {
+		return 0, http.StatusPreconditionRequired, fmt.Errorf("If-Match header required")
+	}
+
+	unquoted, err := strconv.Unquote(strings.TrimPrefix(header, "W/"))
+	if err != nil {
+		return 0, http.StatusBadRequest, fmt.Errorf("Invalid If-Match header")
+	}
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil || version < 0 {
+		return 0, http.StatusBadRequest, fmt.Errorf("Invalid If-Match header")
+	}
+	return version, http.StatusOK, nil
+}
+
+// MatchVersion restricts a filter to the expected version. Documents written
+// before versioning have no version field and count as version 0.
+func MatchVersion(filter bson.M, version int64) bson.M {
+	if version == 0 {
+		filter["$or"] = bson.A{bson.M{"version": 0}, bson.M{"version": bson.M{"$exists": false}}}
+	} else {
+		filter["version"] = version
+	}
+	return filter
+}
+
+// BumpVersion adds the version increment to an update document.
+func BumpVersion(update bson.M) bson.M {
+	update["$inc"] = bson.M{"version": 1}
+	return update
+}
+
+// Conflict tells a failed versioned update apart: 412 if the document
+// still exists (its version moved), 404 if it is gone.
+func Conflict(collection *mongo.Collection, filter bson.M) (int, string) {
+	err := collection.FindOne(context.TODO(), softdelete.NotDeleted(filter)).Err()
+	if err != nil {
+		return http.StatusNotFound, "not found"
+	}
+	return http.StatusPreconditionFailed, "has been modified, fetch it again and retry"
+}
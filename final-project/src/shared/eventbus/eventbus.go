@@ -0,0 +1,116 @@
+// Package eventbus carries domain events between the services. Delivery is
+// at-least-once: a consumer group only moves past an event once its
+// handler succeeds, so handlers must be idempotent. The transport is
+// chosen with EVENT_BROKER: a MongoDB event log (the default), NATS
+// JetStream, or an in-process log for tests.
+package eventbus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Event is a domain event exchanged between the services.
+type Event struct {
+	ID     string          `bson:"_id" json:"id"`
+	Type   string          `bson:"type" json:"type"`
+	Source string          `bson:"source" json:"source"`
+	Time   time.Time       `bson:"time" json:"time"`
+	Data   json.RawMessage `bson:"data" json:"data"`
+	Seq    int64           `bson:"seq" json:"seq,omitempty"`
+}
+
+// Handler processes one event. Returning an error leaves the event
+// unacknowledged so it is delivered again; handlers must be idempotent.
+type Handler func(ctx context.Context, event Event) error
+
+// Broker is implemented by every event transport. Delivery is at-least-once:
+// a consumer group's offset only moves past an event once its handler succeeds.
+type Broker interface {
+	Publish(ctx context.Context, event Event) error
+	// Subscribe consumes the given event types as the named consumer group
+	// in the background until ctx is cancelled.
+	Subscribe(ctx context.Context, group string, types []string, handler Handler) error
+	// Ping checks that the broker can be reached.
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+const eventPollInterval = time.Second
+
+// redeliveryDelay is how long a failed event waits before it is handled
+// again. Tests shorten it.
+var redeliveryDelay = 5 * time.Second
+
+// Connect selects the transport from EVENT_BROKER (mongo, nats or memory)
+// and connects to EVENT_BUS_URI.
+func Connect() (Broker, error) {
+	uri := os.Getenv("EVENT_BUS_URI")
+
+	switch kind := os.Getenv("EVENT_BROKER"); kind {
+	case "", "mongo":
+		if uri == "" {
+			uri = "mongodb://event-mongodb:27017"
+		}
+		return newMongoBroker(uri)
+	case "nats":
+		if uri == "" {
+			uri = nats.DefaultURL
+		}
+		return newNATSBroker(uri)
+	case "memory":
+		return newMemoryBroker(), nil
+	default:
+		return nil, fmt.Errorf("unknown event broker %q", kind)
+	}
+}
+
+// NewEvent makes an event of the given type from source, with data as its
+// JSON payload.
+func NewEvent(source, eventType string, data interface{}) (Event, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{
+		ID:     primitive.NewObjectID().Hex(),
+		Type:   eventType,
+		Source: source,
+		Time:   time.Now().UTC(),
+		Data:   raw,
+	}, nil
+}
+
+func matchesType(types []string, eventType string) bool {
+	for _, t := range types {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// handleWithRetry runs the handler until it succeeds or ctx is cancelled.
+// A cancelled ctx does not cut short the attempt already running.
+func handleWithRetry(ctx context.Context, group string, event Event, handler Handler) bool {
+	for {
+		err := handler(context.WithoutCancel(ctx), event)
+		if err == nil {
+			return true
+		}
+		log.Printf("Consumer %s failed to handle %s event %s: %v", group, event.Type, event.ID, err)
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(redeliveryDelay):
+		}
+	}
+}
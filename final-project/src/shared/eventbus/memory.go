@@ -0,0 +1,69 @@
+package eventbus
+
+import (
+	"context"
+	"sync"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/server"
+)
+
+// memoryBroker keeps the event log in process. It is meant for local
+// development and tests where every consumer runs in the same binary.
+type memoryBroker struct {
+	mu      sync.Mutex
+	events  []Event
+	offsets map[string]int64
+	notify  chan struct{}
+}
+
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{offsets: make(map[string]int64), notify: make(chan struct{})}
+}
+
+func (b *memoryBroker) Publish(ctx context.Context, event Event) error {
+	b.mu.Lock()
+	event.Seq = int64(len(b.events)) + 1
+	b.events = append(b.events, event)
+	close(b.notify)
+	b.notify = make(chan struct{})
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(ctx context.Context, group string, types []string, handler Handler) error {
+	server.Go(func() {
+		for {
+			b.mu.Lock()
+			offset := b.offsets[group]
+			pending := b.events[offset:]
+			notify := b.notify
+			b.mu.Unlock()
+
+			for _, event := range pending {
+				if matchesType(types, event.Type) && !handleWithRetry(ctx, group, event, handler) {
+					return
+				}
+				b.mu.Lock()
+				b.offsets[group] = event.Seq
+				b.mu.Unlock()
+			}
+
+			if len(pending) == 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-notify:
+				}
+			}
+		}
+	})
+	return nil
+}
+
+func (b *memoryBroker) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (b *memoryBroker) Close() error {
+	return nil
+}
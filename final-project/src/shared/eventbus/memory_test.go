@@ -0,0 +1,152 @@
+package eventbus
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryBroker(t *testing.T) {
+	saved := redeliveryDelay
+	defer func() { redeliveryDelay = saved }()
+	redeliveryDelay = time.Millisecond
+
+	tests := []struct {
+		name      string
+		published []string
+		types     []string
+		failures  map[int64]int // failed attempts per sequence number
+		want      []int64       // sequence numbers in the order handled
+	}{
+		{"in order", []string{"a", "a", "a"}, []string{"a"}, nil, []int64{1, 2, 3}},
+		{"other types skipped", []string{"a", "b", "a"}, []string{"a"}, nil, []int64{1, 3}},
+		{"several types", []string{"a", "b", "c"}, []string{"a", "c"}, nil, []int64{1, 3}},
+		// A failed event is handled again before the ones after it
+		{"redelivered", []string{"a", "a", "a"}, []string{"a"}, map[int64]int{2: 1}, []int64{1, 2, 2, 3}},
+		{"redelivered twice", []string{"a", "a"}, []string{"a"}, map[int64]int{1: 2}, []int64{1, 1, 1, 2}},
+		{"nothing to handle", []string{"b"}, []string{"a"}, nil, nil},
+	}
+	for _, tt := range tests {
+		b := newMemoryBroker()
+		for _, eventType := range tt.published {
+			publish(t, b, eventType)
+		}
+
+		var mu sync.Mutex
+		var handled []int64
+		failures := map[int64]int{}
+		for seq, n := range tt.failures {
+			failures[seq] = n
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		b.Subscribe(ctx, "test", tt.types, func(ctx context.Context, event Event) error {
+			mu.Lock()
+			defer mu.Unlock()
+			handled = append(handled, event.Seq)
+			if failures[event.Seq] > 0 {
+				failures[event.Seq]--
+				return errors.New("handler failed")
+			}
+			return nil
+		})
+		waitForOffset(t, b, "test", int64(len(tt.published)))
+		cancel()
+
+		mu.Lock()
+		if !reflect.DeepEqual(handled, tt.want) {
+			t.Errorf("%s: handled %v, want %v", tt.name, handled, tt.want)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestMemoryBrokerSequence(t *testing.T) {
+	b := newMemoryBroker()
+	for i := 0; i < 5; i++ {
+		publish(t, b, "a")
+	}
+	for i, event := range b.events {
+		if event.Seq != int64(i)+1 {
+			t.Errorf("event %d has sequence %d, want %d", i, event.Seq, i+1)
+		}
+	}
+}
+
+// A consumer group picks up after the last event it handled, and each
+// group keeps its own offset.
+func TestMemoryBrokerOffsets(t *testing.T) {
+	b := newMemoryBroker()
+	for i := 0; i < 3; i++ {
+		publish(t, b, "a")
+	}
+	b.offsets["resumed"] = 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resumed := make(chan int64, 10)
+	b.Subscribe(ctx, "resumed", []string{"a"}, recordSeq(resumed))
+	fresh := make(chan int64, 10)
+	b.Subscribe(ctx, "fresh", []string{"a"}, recordSeq(fresh))
+	waitForOffset(t, b, "resumed", 3)
+	waitForOffset(t, b, "fresh", 3)
+
+	if got, want := drain(resumed), []int64{3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resumed group handled %v, want %v", got, want)
+	}
+	if got, want := drain(fresh), []int64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fresh group handled %v, want %v", got, want)
+	}
+}
+
+func publish(t *testing.T, b Broker, eventType string) Event {
+	t.Helper()
+	event, err := NewEvent("test", eventType, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func recordSeq(handled chan<- int64) Handler {
+	return func(ctx context.Context, event Event) error {
+		handled <- event.Seq
+		return nil
+	}
+}
+
+func drain(handled <-chan int64) []int64 {
+	var seqs []int64
+	for {
+		select {
+		case seq := <-handled:
+			seqs = append(seqs, seq)
+		default:
+			return seqs
+		}
+	}
+}
+
+// waitForOffset waits until the group has moved past the event with the
+// given sequence number.
+func waitForOffset(t *testing.T, b *memoryBroker, group string, seq int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mu.Lock()
+		offset := b.offsets[group]
+		b.mu.Unlock()
+		if offset >= seq {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("group %s stuck at offset %d, want %d", group, offset, seq)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
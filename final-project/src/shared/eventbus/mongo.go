@@ -0,0 +1,161 @@
+package eventbus
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/metrics"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/server"
+)
+
+// mongoBroker stores events in a shared "eventbus" database. Each event
+// gets a sequence number from a counter document and every consumer group
+// stores the last sequence it has handled in the offsets collection.
+type mongoBroker struct {
+	client *mongo.Client
+	db     *mongo.Database
+}
+
+// gapTimeout is how long a consumer waits for a missing sequence number
+// before assuming its publisher failed between allocating and inserting it.
+const gapTimeout = 10 * time.Second
+
+func newMongoBroker(uri string) (*mongoBroker, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	busClient, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetMonitor(metrics.MongoMonitor()))
+	if err != nil {
+		return nil, err
+	}
+
+	db := busClient.Database("eventbus")
+	_, err = db.Collection("events").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "seq", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "type", Value: 1}, {Key: "seq", Value: 1}}},
+	})
+	if err != nil {
+		busClient.Disconnect(ctx)
+		return nil, err
+	}
+
+	return &mongoBroker{client: busClient, db: db}, nil
+}
+
+func (b *mongoBroker) nextSeq(ctx context.Context) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := b.db.Collection("counters").FindOneAndUpdate(ctx,
+		bson.M{"_id": "events"}, bson.M{"$inc": bson.M{"seq": 1}}, opts).Decode(&counter)
+	return counter.Seq, err
+}
+
+func (b *mongoBroker) Publish(ctx context.Context, event Event) error {
+	seq, err := b.nextSeq(ctx)
+	if err != nil {
+		return err
+	}
+	event.Seq = seq
+	_, err = b.db.Collection("events").InsertOne(ctx, event)
+	return err
+}
+
+func (b *mongoBroker) loadOffset(ctx context.Context, group string) (int64, error) {
+	var offset struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := b.db.Collection("offsets").FindOne(ctx, bson.M{"_id": group}).Decode(&offset)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	}
+	return offset.Seq, err
+}
+
+func (b *mongoBroker) commitOffset(ctx context.Context, group string, seq int64) error {
+	_, err := b.db.Collection("offsets").UpdateOne(ctx,
+		bson.M{"_id": group},
+		bson.M{"$set": bson.M{"seq": seq, "updated_at": time.Now().UTC()}},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+func (b *mongoBroker) Subscribe(ctx context.Context, group string, types []string, handler Handler) error {
+	offset, err := b.loadOffset(ctx, group)
+	if err != nil {
+		return err
+	}
+
+	server.Go(func() {
+		ticker := time.NewTicker(eventPollInterval)
+		defer ticker.Stop()
+
+		for {
+			offset = b.consume(ctx, group, types, handler, offset)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+	return nil
+}
+
+// consume handles every available event after offset and returns the new offset.
+func (b *mongoBroker) consume(ctx context.Context, group string, types []string, handler Handler, offset int64) int64 {
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}).SetLimit(100)
+	cursor, err := b.db.Collection("events").Find(ctx, bson.M{"seq": bson.M{"$gt": offset}}, opts)
+	if err != nil {
+		log.Printf("Consumer %s failed to read events: %v", group, err)
+		return offset
+	}
+	var events []Event
+	err = cursor.All(ctx, &events)
+	cursor.Close(context.Background())
+	if err != nil {
+		log.Printf("Consumer %s failed to decode events: %v", group, err)
+		return offset
+	}
+
+	for _, event := range events {
+		// Take no more events once the consumer is stopped
+		if ctx.Err() != nil {
+			break
+		}
+		// Sequence numbers are allocated before the insert, so a later
+		// event can become visible first. Wait for the gap to fill in.
+		if event.Seq != offset+1 && time.Since(event.Time) < gapTimeout {
+			break
+		}
+
+		if matchesType(types, event.Type) && !handleWithRetry(ctx, group, event, handler) {
+			break
+		}
+
+		if err := b.commitOffset(context.WithoutCancel(ctx), group, event.Seq); err != nil {
+			log.Printf("Consumer %s failed to commit offset %d: %v", group, event.Seq, err)
+			break
+		}
+		offset = event.Seq
+	}
+	return offset
+}
+
+func (b *mongoBroker) Ping(ctx context.Context) error {
+	return b.client.Ping(ctx, nil)
+}
+
+func (b *mongoBroker) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return b.client.Disconnect(ctx)
+}
@@ -0,0 +1,159 @@
+package eventbus
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testDatabase returns an empty database on the MongoDB server at
+// MONGO_TEST_URI, dropped when the test ends. Tests that need MongoDB are
+// skipped without one.
+func testDatabase(t *testing.T) *mongo.Database {
+	t.Helper()
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database("eventbus_test_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	return db
+}
+
+func TestMongoBrokerConsume(t *testing.T) {
+	saved := redeliveryDelay
+	defer func() { redeliveryDelay = saved }()
+	redeliveryDelay = time.Millisecond
+
+	recent := time.Now().UTC()
+	stale := recent.Add(-2 * gapTimeout)
+	tests := []struct {
+		name       string
+		offset     int64
+		events     []Event
+		failures   map[int64]int // failed attempts per sequence number
+		wantSeqs   []int64       // sequence numbers in the order handled
+		wantOffset int64
+	}{
+		{
+			name:       "in order",
+			events:     []Event{{Seq: 1, Type: "a", Time: recent}, {Seq: 2, Type: "a", Time: recent}, {Seq: 3, Type: "a", Time: recent}},
+			wantSeqs:   []int64{1, 2, 3},
+			wantOffset: 3,
+		},
+		{
+			name:       "after the offset",
+			offset:     2,
+			events:     []Event{{Seq: 1, Type: "a", Time: recent}, {Seq: 2, Type: "a", Time: recent}, {Seq: 3, Type: "a", Time: recent}},
+			wantSeqs:   []int64{3},
+			wantOffset: 3,
+		},
+		{
+			name:       "other types committed unhandled",
+			events:     []Event{{Seq: 1, Type: "b", Time: recent}, {Seq: 2, Type: "a", Time: recent}},
+			wantSeqs:   []int64{2},
+			wantOffset: 2,
+		},
+		{
+			// Sequence 2 may still be on its way, so 3 waits
+			name:       "recent gap",
+			events:     []Event{{Seq: 1, Type: "a", Time: recent}, {Seq: 3, Type: "a", Time: recent}},
+			wantSeqs:   []int64{1},
+			wantOffset: 1,
+		},
+		{
+			// Sequence 2 is given up on once 3 is older than gapTimeout
+			name:       "stale gap",
+			events:     []Event{{Seq: 1, Type: "a", Time: stale}, {Seq: 3, Type: "a", Time: stale}},
+			wantSeqs:   []int64{1, 3},
+			wantOffset: 3,
+		},
+		{
+			name:       "redelivered",
+			events:     []Event{{Seq: 1, Type: "a", Time: recent}, {Seq: 2, Type: "a", Time: recent}},
+			failures:   map[int64]int{1: 2},
+			wantSeqs:   []int64{1, 1, 1, 2},
+			wantOffset: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testDatabase(t)
+			b := &mongoBroker{client: db.Client(), db: db}
+			ctx := context.Background()
+			for _, event := range tt.events {
+				event.ID = primitive.NewObjectID().Hex()
+				if _, err := db.Collection("events").InsertOne(ctx, event); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var handled []int64
+			failures := map[int64]int{}
+			for seq, n := range tt.failures {
+				failures[seq] = n
+			}
+			offset := b.consume(ctx, "test", []string{"a"}, func(ctx context.Context, event Event) error {
+				handled = append(handled, event.Seq)
+				if failures[event.Seq] > 0 {
+					failures[event.Seq]--
+					return errors.New("handler failed")
+				}
+				return nil
+			}, tt.offset)
+
+			if !reflect.DeepEqual(handled, tt.wantSeqs) {
+				t.Errorf("handled %v, want %v", handled, tt.wantSeqs)
+			}
+			if offset != tt.wantOffset {
+				t.Errorf("offset = %d, want %d", offset, tt.wantOffset)
+			}
+			committed, err := b.loadOffset(ctx, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if committed != tt.wantOffset {
+				t.Errorf("committed offset = %d, want %d", committed, tt.wantOffset)
+			}
+		})
+	}
+}
+
+func TestMongoBrokerPublishSequence(t *testing.T) {
+	db := testDatabase(t)
+	b := &mongoBroker{client: db.Client(), db: db}
+	for i := 0; i < 3; i++ {
+		publish(t, b, "a")
+	}
+
+	cursor, err := db.Collection("events").Find(context.Background(), bson.M{}, options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []Event
+	if err := cursor.All(context.Background(), &events); err != nil {
+		t.Fatal(err)
+	}
+	for i, event := range events {
+		if event.Seq != int64(i)+1 {
+			t.Errorf("event %d has sequence %d, want %d", i, event.Seq, i+1)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package eventbus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsBroker publishes to a JetStream stream. Each consumer group maps to
+// durable consumers, so JetStream tracks the offsets and redelivers
+// anything that is not acknowledged.
+type natsBroker struct {
+	conn *nats.Conn
+	js   nats.JetStreamContext
+}
+
+const natsStream = "EVENTS"
+
+func newNATSBroker(uri string) (*natsBroker, error) {
+	conn, err := nats.Connect(uri)
+	if err != nil {
+		return nil, err
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	_, err = js.StreamInfo(natsStream)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:      natsStream,
+			Subjects:  []string{"events.>"},
+			Retention: nats.LimitsPolicy,
+			MaxAge:    7 * 24 * time.Hour,
+		})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &natsBroker{conn: conn, js: js}, nil
+}
+
+func (b *natsBroker) Publish(ctx context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	// The event ID doubles as the JetStream message ID for duplicate detection
+	_, err = b.js.Publish("events."+event.Type, data, nats.MsgId(event.ID), nats.Context(ctx))
+	return err
+}
+
+func (b *natsBroker) Subscribe(ctx context.Context, group string, types []string, handler Handler) error {
+	for _, eventType := range types {
+		durable := group + "_" + strings.ReplaceAll(eventType, ".", "_")
+		sub, err := b.js.Subscribe("events."+eventType, func(msg *nats.Msg) {
+			var event Event
+			if err := json.Unmarshal(msg.Data, &event); err != nil {
+				log.Printf("Consumer %s dropped malformed event: %v", group, err)
+				msg.Term()
+				return
+			}
+			if meta, err := msg.Metadata(); err == nil {
+				event.Seq = int64(meta.Sequence.Stream)
+			}
+
+			if err := handler(context.WithoutCancel(ctx), event); err != nil {
+				log.Printf("Consumer %s failed to handle %s event %s: %v", group, event.Type, event.ID, err)
+				msg.NakWithDelay(redeliveryDelay)
+				return
+			}
+			msg.Ack()
+		}, nats.Durable(durable), nats.ManualAck(), nats.DeliverAll(), nats.AckExplicit())
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			<-ctx.Done()
+			sub.Drain()
+		}()
+	}
+	return nil
+}
+
+func (b *natsBroker) Ping(ctx context.Context) error {
+	if status := b.conn.Status(); status != nats.CONNECTED {
+		return fmt.Errorf("nats connection is %s", status)
+	}
+	return nil
+}
+
+func (b *natsBroker) Close() error {
+	return b.conn.Drain()
+}
@@ -0,0 +1,135 @@
+package eventbus
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/server"
+)
+
+// A service does not publish its events on the bus directly. It writes
+// them to an outbox collection in its own database, next to the change
+// they announce and before the request is answered, and a relay publishes
+// them from there. An event is therefore not lost when the bus is down:
+// it stays in the outbox until the relay gets it out. The service
+// databases run standalone, without transactions, so the outbox write
+// follows the change rather than committing with it. The event keeps its
+// ID through any retries, and consumers are idempotent, so publishing it
+// twice is harmless.
+
+const (
+	outboxPollInterval = time.Second
+	outboxBatch        = 100
+	// outboxRetention is how long published events stay in the outbox
+	outboxRetention = 7 * 24 * time.Hour
+)
+
+// Outbox holds a service's events until they are published.
+type Outbox struct {
+	collection *mongo.Collection
+	bus        Broker
+	wake       chan struct{}
+}
+
+type outboxEntry struct {
+	ID     string     `bson:"_id"`
+	Event  Event      `bson:"event"`
+	SentAt *time.Time `bson:"sent_at,omitempty"`
+}
+
+// NewOutbox keeps events in collection until they are published on bus.
+func NewOutbox(collection *mongo.Collection, bus Broker) (*Outbox, error) {
+	_, err := collection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "sent_at", Value: 1}, {Key: "event.time", Value: 1}, {Key: "_id", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "sent_at", Value: 1}},
+			Options: options.Index().SetName("sent_at_ttl").SetExpireAfterSeconds(int32(outboxRetention.Seconds())),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Outbox{collection: collection, bus: bus, wake: make(chan struct{}, 1)}, nil
+}
+
+// Publish writes an event to the outbox and wakes the relay. Failures are
+// logged; the request that triggered the event has already succeeded and
+// is not rolled back.
+func (o *Outbox) Publish(source, eventType string, data interface{}) {
+	event, err := NewEvent(source, eventType, data)
+	if err != nil {
+		log.Printf("Error marshalling %s event: %v", eventType, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := o.collection.InsertOne(ctx, outboxEntry{ID: event.ID, Event: event}); err != nil {
+		log.Printf("Error writing %s event %s to the outbox: %v", eventType, event.ID, err)
+		return
+	}
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Relay publishes the events in the outbox in the order they were written,
+// until the service shuts down. Run it with server.Go.
+func (o *Outbox) Relay() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := o.flush(server.Background()); err != nil {
+			log.Printf("Outbox relay: %v", err)
+		}
+		select {
+		case <-server.Background().Done():
+			return
+		case <-o.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// flush publishes unsent events until the outbox is empty or publishing
+// fails. It stops at the first failure so events go out in order.
+func (o *Outbox) flush(ctx context.Context) error {
+	for ctx.Err() == nil {
+		opts := options.Find().SetSort(bson.D{{Key: "event.time", Value: 1}, {Key: "_id", Value: 1}}).SetLimit(outboxBatch)
+		cursor, err := o.collection.Find(ctx, bson.M{"sent_at": nil}, opts)
+		if err != nil {
+			return err
+		}
+		var pending []outboxEntry
+		if err := cursor.All(ctx, &pending); err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+
+		for _, entry := range pending {
+			publishCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			err := o.bus.Publish(publishCtx, entry.Event)
+			cancel()
+			// The broker already has an event it is handed again
+			if err != nil && !mongo.IsDuplicateKeyError(err) {
+				return err
+			}
+			now := time.Now().UTC()
+			_, err = o.collection.UpdateOne(ctx, bson.M{"_id": entry.ID}, bson.M{"$set": bson.M{"sent_at": now}})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
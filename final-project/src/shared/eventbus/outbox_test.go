@@ -0,0 +1,105 @@
+package eventbus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// flakyBroker fails to publish the events it is told to, once each.
+type flakyBroker struct {
+	*memoryBroker
+	fail map[string]bool
+}
+
+func (b *flakyBroker) Publish(ctx context.Context, event Event) error {
+	if b.fail[event.ID] {
+		delete(b.fail, event.ID)
+		return errors.New("broker unavailable")
+	}
+	return b.memoryBroker.Publish(ctx, event)
+}
+
+func TestOutboxFlush(t *testing.T) {
+	tests := []struct {
+		name   string
+		events int
+		fail   []int // indexes of the events whose first publish fails
+	}{
+		{"empty", 0, nil},
+		{"in order", 5, nil},
+		{"more than a batch", outboxBatch + 3, nil},
+		// Later events wait for a failed one, so order is kept
+		{"first fails", 3, []int{0}},
+		{"middle fails", 4, []int{2}},
+		{"several fail", 5, []int{1, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			bus := &flakyBroker{memoryBroker: newMemoryBroker(), fail: map[string]bool{}}
+			outbox, err := NewOutbox(testDatabase(t).Collection("outbox"), bus)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < tt.events; i++ {
+				outbox.Publish("test", "a", map[string]int{"n": i})
+			}
+			// The events in the order they were written, by their payload
+			var entries []outboxEntry
+			cursor, err := outbox.collection.Find(ctx, bson.M{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cursor.All(ctx, &entries); err != nil {
+				t.Fatal(err)
+			}
+			written := make([]string, len(entries))
+			for _, entry := range entries {
+				var data struct{ N int }
+				if err := json.Unmarshal(entry.Event.Data, &data); err != nil {
+					t.Fatal(err)
+				}
+				written[data.N] = entry.ID
+			}
+			for _, i := range tt.fail {
+				bus.fail[written[i]] = true
+			}
+
+			// Each failure stops a flush; the next one carries on
+			for attempt := 0; attempt <= len(tt.fail); attempt++ {
+				err := outbox.flush(ctx)
+				if attempt < len(tt.fail) {
+					if err == nil {
+						t.Fatalf("flush %d succeeded, want the broker's error", attempt)
+					}
+					if got := len(bus.events); got != tt.fail[attempt] {
+						t.Errorf("flush %d published %d events, want %d", attempt, got, tt.fail[attempt])
+					}
+				} else if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			published := make([]string, 0, len(bus.events))
+			for _, event := range bus.events {
+				published = append(published, event.ID)
+			}
+			if !reflect.DeepEqual(published, written) {
+				t.Errorf("published %v, want %v", published, written)
+			}
+			unsent, err := outbox.collection.CountDocuments(ctx, bson.M{"sent_at": nil})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unsent != 0 {
+				t.Errorf("%d events left unsent", unsent)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+// Package health serves a service's probes. /healthz is the liveness
+// check: it answers as long as the process is running. /readyz is the
+// readiness check: it answers 503 while a dependency the service cannot
+// work without is down, or once the service is shutting down, so no new
+// requests are sent its way.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/server"
+)
+
+const readinessTimeout = 2 * time.Second
+
+// readinessCheck checks one dependency of the service.
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+	// optional dependencies are reported but do not make the service
+	// unready
+	optional bool
+}
+
+var (
+	readinessMu     sync.Mutex
+	readinessChecks []readinessCheck
+)
+
+// AddCheck makes readiness depend on a check.
+func AddCheck(name string, check func(ctx context.Context) error) {
+	readinessMu.Lock()
+	defer readinessMu.Unlock()
+	readinessChecks = append(readinessChecks, readinessCheck{name: name, check: check})
+}
+
+// AddOptionalCheck reports a check in /readyz without depending on it.
+func AddOptionalCheck(name string, check func(ctx context.Context) error) {
+	readinessMu.Lock()
+	defer readinessMu.Unlock()
+	readinessChecks = append(readinessChecks, readinessCheck{name: name, check: check, optional: true})
+}
+
+// PingMongo checks that a MongoDB client reaches its primary.
+func PingMongo(client *mongo.Client) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return client.Ping(ctx, readpref.Primary())
+	}
+}
+
+// Healthz reports that the service is up.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// Readyz runs every readiness check at once and reports each one.
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	readinessMu.Lock()
+	checks := append([]readinessCheck(nil), readinessChecks...)
+	readinessMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	results := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c readinessCheck) {
+			defer wg.Done()
+			results[i] = c.check(ctx)
+		}(i, c)
+	}
+	wg.Wait()
+
+	status, code := "ok", http.StatusOK
+	report := map[string]string{}
+	for i, c := range checks {
+		if results[i] == nil {
+			report[c.name] = "ok"
+			continue
+		}
+		report[c.name] = results[i].Error()
+		if !c.optional {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	if server.ShuttingDown() {
+		status, code = "shutting down", http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "checks": report})
+}
+
+// ProbePath reports whether a path is only requested by probes and
+// scrapers, which are not worth logging or tracing.
+func ProbePath(path string) bool {
+	return path == "/healthz" || path == "/readyz" || path == "/metrics"
+}
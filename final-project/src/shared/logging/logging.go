@@ -0,0 +1,196 @@
+// Package logging writes logs as JSON lines with log/slog, and log.Printf
+// goes through the same handler. Records logged with a request's context
+// carry its request ID, which the gateway generates and every service
+// passes on, and its trace and span IDs, so one request can be followed
+// from service to service. Secrets and personal data are redacted wherever
+// they appear in a record's attributes, including fields of logged
+// structs.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/health"
+)
+
+type requestIDKey struct{}
+
+// redactedKeys are attribute and field names whose values are never
+// logged.
+var redactedKeys = map[string]bool{
+	"password":       true,
+	"token":          true,
+	"token_hash":     true,
+	"secret":         true,
+	"authorization":  true,
+	"cookie":         true,
+	"x-api-key":      true,
+	"assertion":      true,
+	"code":           true,
+	"recovery_codes": true,
+	"email":          true,
+}
+
+// Setup makes a JSON handler the default logger, for log.Printf too.
+func Setup(service string) {
+	handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{ReplaceAttr: redactAttr})
+	slog.SetDefault(slog.New(contextHandler{handler}).With("service", service))
+}
+
+// contextHandler adds the request ID and trace of the context a record is
+// logged with.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestID := RequestID(ctx); requestID != "" {
+		record.AddAttrs(slog.String("request_id", requestID))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(slog.String("trace_id", span.TraceID().String()), slog.String("span_id", span.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// redactAttr replaces the values of sensitive attributes, and of sensitive
+// fields in structs and maps, with "[redacted]".
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	if redactedKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, "[redacted]")
+	}
+	if attr.Value.Kind() != slog.KindAny {
+		return attr
+	}
+	value := attr.Value.Any()
+	if _, ok := value.(error); ok {
+		return attr
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return attr
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		return attr
+	}
+	return slog.Any(attr.Key, redactJSON(decoded))
+}
+
+func redactJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if redactedKeys[strings.ToLower(key)] {
+				v[key] = "[redacted]"
+			} else {
+				v[key] = redactJSON(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactJSON(item)
+		}
+	}
+	return value
+}
+
+// RequestID returns the request ID of a request's context.
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// validRequestID accepts the IDs the gateway makes, and other short
+// printable ones.
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > 128 {
+		return false
+	}
+	for _, c := range requestID {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// StatusRecorder records the status and size of the response written
+// through it. Status must start out as 200.
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+	Bytes  int
+}
+
+func (r *StatusRecorder) WriteHeader(status int) {
+	r.Status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *StatusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.Bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *StatusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Middleware puts the request's X-Request-ID, or a new one, in its
+// context and logs the request once it is answered. Probes and metrics
+// scrapes are only logged at debug level.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestID := req.Header.Get("X-Request-ID")
+		if !validRequestID(requestID) {
+			id := make([]byte, 16)
+			rand.Read(id)
+			requestID = hex.EncodeToString(id)
+			req.Header.Set("X-Request-ID", requestID)
+		}
+		w.Header().Set("X-Request-ID", requestID)
+		req = req.WithContext(context.WithValue(req.Context(), requestIDKey{}, requestID))
+
+		start := time.Now()
+		recorder := &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+		next.ServeHTTP(recorder, req)
+
+		level := slog.LevelInfo
+		switch {
+		case health.ProbePath(req.URL.Path):
+			level = slog.LevelDebug
+		case recorder.Status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		}
+		slog.LogAttrs(req.Context(), level, "request",
+			slog.String("method", req.Method),
+			slog.String("path", req.URL.Path),
+			slog.Int("status", recorder.Status),
+			slog.Int("bytes", recorder.Bytes),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("remote_addr", req.RemoteAddr),
+			slog.String("user_agent", req.UserAgent()),
+		)
+	})
+}
@@ -0,0 +1,78 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type credentials struct {
+	Username string              `json:"username"`
+	Token    string              `json:"token"`
+	Factors  []map[string]string `json:"factors"`
+}
+
+func TestRedaction(t *testing.T) {
+	tests := []struct {
+		name string
+		attr slog.Attr
+		want interface{}
+	}{
+		{"sensitive attribute", slog.String("password", "hunter2"), "[redacted]"},
+		{"any case", slog.String("Authorization", "Bearer abc"), "[redacted]"},
+		{"other attribute", slog.String("route", "/users/login"), "/users/login"},
+		{"number", slog.Int("count", 3), float64(3)},
+		{"error", slog.Any("error", errors.New("token expired")), "token expired"},
+		{"map field", slog.Any("user", map[string]interface{}{"email": "a@example.com", "name": "a"}),
+			map[string]interface{}{"email": "[redacted]", "name": "a"}},
+		{"nested struct fields", slog.Any("login", credentials{
+			Username: "a",
+			Token:    "t",
+			Factors:  []map[string]string{{"code": "123456", "kind": "totp"}},
+		}), map[string]interface{}{
+			"username": "a",
+			"token":    "[redacted]",
+			"factors":  []interface{}{map[string]interface{}{"code": "[redacted]", "kind": "totp"}},
+		}},
+		{"group member", slog.Group("headers", slog.String("cookie", "session=1"), slog.String("accept", "*/*")),
+			map[string]interface{}{"cookie": "[redacted]", "accept": "*/*"}},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		logger := slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{ReplaceAttr: redactAttr}))
+		logger.LogAttrs(context.Background(), slog.LevelInfo, "test", tt.attr)
+
+		var record map[string]interface{}
+		if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+			t.Fatalf("%s: decoding %s: %v", tt.name, out.String(), err)
+		}
+		if got := record[tt.attr.Key]; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: logged %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"3f2c9a1e-7b4d-4c1a-9e2f-0d8b6a5c4e31", true},
+		{"job-42", true},
+		{"", false},
+		{strings.Repeat("a", 129), false},
+		{"with space", false},
+		{"line\nbreak", false},
+		{"naïve", false},
+	}
+	for _, tt := range tests {
+		if got := validRequestID(tt.id); got != tt.want {
+			t.Errorf("validRequestID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
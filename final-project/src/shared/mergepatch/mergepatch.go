@@ -0,0 +1,88 @@
+// Package mergepatch applies JSON Merge Patch (RFC 7396), which PATCH
+// requests use: object members in the patch replace or recurse into the
+// target, null removes a member and any other value replaces the target
+// wholesale.
+package mergepatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Apply returns the result of applying patch to target.
+func Apply(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = Apply(targetObject[key], value)
+	}
+	return targetObject
+}
+
+// Decode reads a merge patch body, which must be a JSON object.
+func Decode(req *http.Request) (map[string]interface{}, error) {
+	contentType := strings.TrimSpace(strings.Split(req.Header.Get("Content-Type"), ";")[0])
+	if contentType != "" && contentType != "application/merge-patch+json" && contentType != "application/json" {
+		return nil, fmt.Errorf("Unsupported Content-Type, use application/merge-patch+json")
+	}
+
+	var patch map[string]interface{}
+	if err := json.NewDecoder(req.Body).Decode(&patch); err != nil || patch == nil {
+		return nil, fmt.Errorf("Invalid merge patch, expected a JSON object")
+	}
+	return patch, nil
+}
+
+// CheckFields rejects patches touching fields the role may not change.
+func CheckFields(patch map[string]interface{}, allowed map[string]bool) error {
+	var denied []string
+	for key := range patch {
+		if !allowed[key] {
+			denied = append(denied, key)
+		}
+	}
+	if len(denied) > 0 {
+		sort.Strings(denied)
+		return fmt.Errorf("Fields not allowed in patch: %s", strings.Join(denied, ", "))
+	}
+	return nil
+}
+
+// Into applies patch to the JSON form of doc and decodes the result back
+// into doc, so the patched document gets the same type checks as a full
+// request body. doc must be a pointer to a struct.
+func Into(doc interface{}, patch map[string]interface{}) error {
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	var current interface{}
+	if err := json.Unmarshal(raw, &current); err != nil {
+		return err
+	}
+
+	merged, err := json.Marshal(Apply(current, patch))
+	if err != nil {
+		return err
+	}
+
+	// Start from the zero value so members removed by the patch are cleared
+	value := reflect.ValueOf(doc).Elem()
+	value.Set(reflect.Zero(value.Type()))
+	return json.Unmarshal(merged, doc)
+}
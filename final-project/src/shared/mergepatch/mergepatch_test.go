@@ -0,0 +1,103 @@
+package mergepatch
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func decodeJSON(t *testing.T, raw string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		t.Fatalf("decoding %s: %v", raw, err)
+	}
+	return value
+}
+
+func TestApply(t *testing.T) {
+	// RFC 7396 appendix A
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tt := range tests {
+		got := Apply(decodeJSON(t, tt.target), decodeJSON(t, tt.patch))
+		if want := decodeJSON(t, tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("Apply(%s, %s) = %v, want %s", tt.target, tt.patch, got, tt.want)
+		}
+	}
+}
+
+type patched struct {
+	Title    string            `json:"title"`
+	Hours    float64           `json:"hours,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Assignee *string           `json:"assignee,omitempty"`
+}
+
+func TestInto(t *testing.T) {
+	assignee := "u1"
+	tests := []struct {
+		name    string
+		patch   string
+		want    patched
+		wantErr bool
+	}{
+		{"replaces a member", `{"title":"new"}`,
+			patched{Title: "new", Hours: 2, Labels: map[string]string{"team": "a", "size": "s"}, Assignee: &assignee}, false},
+		{"removes a member", `{"assignee":null,"hours":null}`,
+			patched{Title: "old", Labels: map[string]string{"team": "a", "size": "s"}}, false},
+		{"recurses into objects", `{"labels":{"size":null,"area":"api"}}`,
+			patched{Title: "old", Hours: 2, Labels: map[string]string{"team": "a", "area": "api"}, Assignee: &assignee}, false},
+		{"rejects a wrong type", `{"hours":"two"}`, patched{}, true},
+	}
+	for _, tt := range tests {
+		doc := patched{Title: "old", Hours: 2, Labels: map[string]string{"team": "a", "size": "s"}, Assignee: &assignee}
+		patch := decodeJSON(t, tt.patch).(map[string]interface{})
+		err := Into(&doc, patch)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Into error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(doc, tt.want) {
+			t.Errorf("%s: Into = %+v, want %+v", tt.name, doc, tt.want)
+		}
+	}
+}
+
+func TestCheckFields(t *testing.T) {
+	allowed := map[string]bool{"title": true, "status": true}
+	tests := []struct {
+		patch string
+		want  string
+	}{
+		{`{"title":"x","status":"done"}`, ""},
+		{`{"title":"x","role":"admin","hours":1}`, "Fields not allowed in patch: hours, role"},
+	}
+	for _, tt := range tests {
+		err := CheckFields(decodeJSON(t, tt.patch).(map[string]interface{}), allowed)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("CheckFields(%s) = %q, want %q", tt.patch, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Package metrics serves Prometheus metrics in the text format at
+// /metrics, next to the Go runtime and process metrics of the default
+// registry. Requests are labelled with the route they matched rather than
+// their path, so IDs in paths do not each start a new series.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/logging"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests answered, by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time taken to answer HTTP requests, by route, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	mongoCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mongodb_command_duration_seconds",
+		Help:    "Time taken by MongoDB commands, by database, command and outcome.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"database", "command", "outcome"})
+)
+
+// RouteFunc names the route a request matches, for labels and span names.
+type RouteFunc func(req *http.Request) string
+
+// MuxRoute returns the mux pattern a request matches.
+func MuxRoute(mux *http.ServeMux) RouteFunc {
+	return func(req *http.Request) string {
+		if _, pattern := mux.Handler(req); pattern != "" {
+			return pattern
+		}
+		return "unmatched"
+	}
+}
+
+// Middleware counts and times the requests served by next.
+func Middleware(next http.Handler, route RouteFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := route(req)
+		start := time.Now()
+		recorder := &logging.StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+		next.ServeHTTP(recorder, req)
+
+		labels := prometheus.Labels{"route": name, "method": metricMethod(req.Method), "status": strconv.Itoa(recorder.Status)}
+		httpRequests.With(labels).Inc()
+		httpRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// metricMethod keeps clients from adding a series per made-up method.
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+// MongoMonitor times every command a MongoDB client sends, and traces the
+// ones sent while handling a traced request. Background work such as
+// polling the event bus is not traced, or each poll would be a trace.
+func MongoMonitor() *event.CommandMonitor {
+	tracing := otelmongo.NewMonitor()
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			if trace.SpanContextFromContext(ctx).IsValid() {
+				tracing.Started(ctx, e)
+			}
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			tracing.Succeeded(ctx, e)
+			mongoCommandDuration.WithLabelValues(e.DatabaseName, e.CommandName, "success").Observe(e.Duration.Seconds())
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			tracing.Failed(ctx, e)
+			mongoCommandDuration.WithLabelValues(e.DatabaseName, e.CommandName, "failure").Observe(e.Duration.Seconds())
+		},
+	}
+}
+
+// countGauge is a gauge of the documents in a collection that match a
+// filter, counted whenever metrics are scraped.
+type countGauge struct {
+	desc       *prometheus.Desc
+	collection func() *mongo.Collection
+	filter     bson.M
+}
+
+// NewCountGauge returns a gauge of the documents in a collection that
+// match filter, to register with prometheus.MustRegister.
+func NewCountGauge(name, help string, collection func() *mongo.Collection, filter bson.M) prometheus.Collector {
+	return &countGauge{
+		desc:       prometheus.NewDesc(name, help, nil, nil),
+		collection: collection,
+		filter:     filter,
+	}
+}
+
+func (g *countGauge) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+func (g *countGauge) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	count, err := g.collection().CountDocuments(ctx, g.filter)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(g.desc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, float64(count))
+}
@@ -0,0 +1,52 @@
+// Package problem writes errors as RFC 7807 problem details: a JSON body
+// with the status, a short title and a human-readable detail, plus one
+// message per field when a request body fails validation.
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type Problem struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError describes one invalid field of a request body.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func Write(w http.ResponseWriter, problem Problem) {
+	if problem.Type == "" {
+		problem.Type = "about:blank"
+	}
+	if problem.Title == "" {
+		problem.Title = http.StatusText(problem.Status)
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// Error replaces http.Error, sending the message as the problem detail.
+func Error(w http.ResponseWriter, detail string, status int) {
+	Write(w, Problem{Status: status, Detail: detail})
+}
+
+// Validation rejects a request body with the given field errors.
+func Validation(w http.ResponseWriter, status int, errors []FieldError) {
+	Write(w, Problem{
+		Type:   "/problems/validation-error",
+		Title:  "Request validation failed",
+		Status: status,
+		Detail: "One or more fields are invalid",
+		Errors: errors,
+	})
+}
@@ -0,0 +1,119 @@
+// Package server runs a service's HTTP server and shuts it down
+// gracefully. On SIGTERM (or SIGINT) it does so within the 30 seconds
+// Kubernetes allows by default:
+//
+//  1. /readyz starts failing, and new requests keep being served for
+//     shutdownDelay while load balancers stop sending them.
+//  2. The server stops accepting connections and waits up to drainTimeout
+//     for in-flight requests.
+//  3. Background work is told to stop and given up to backgroundTimeout to
+//     finish what it is doing.
+//
+// Run then returns, so main's deferred clean-up, such as closing the
+// event bus and disconnecting from MongoDB, runs.
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	readHeaderTimeout = 5 * time.Second
+	readTimeout       = 30 * time.Second
+	// writeTimeout is longer than the gateway's longest route timeout, so a
+	// slow request is answered by the gateway's 504 rather than cut off
+	writeTimeout      = 65 * time.Second
+	idleTimeout       = 2 * time.Minute
+	shutdownDelay     = 5 * time.Second
+	drainTimeout      = 15 * time.Second
+	backgroundTimeout = 8 * time.Second
+)
+
+var (
+	// shuttingDown is set once a shutdown starts
+	shuttingDown atomic.Bool
+
+	// backgroundCtx is cancelled when background work has to stop
+	backgroundCtx, stopBackground = context.WithCancel(context.Background())
+	backgroundWork                sync.WaitGroup
+)
+
+// ShuttingDown reports whether a shutdown has started.
+func ShuttingDown() bool {
+	return shuttingDown.Load()
+}
+
+// Background returns the context of background work, which is cancelled
+// when the work has to stop.
+func Background() context.Context {
+	return backgroundCtx
+}
+
+// Go runs fn in a goroutine that a shutdown waits for. fn should return
+// soon after Background is done.
+func Go(fn func()) {
+	backgroundWork.Add(1)
+	go func() {
+		defer backgroundWork.Done()
+		fn()
+	}()
+}
+
+// Run serves handler on addr until the service is told to stop, then
+// shuts down gracefully.
+func Run(addr string, handler http.Handler) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	failed := make(chan error, 1)
+	go func() {
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			failed <- err
+		}
+	}()
+	select {
+	case err := <-failed:
+		log.Fatal(err)
+	case <-stop.Done():
+	}
+
+	slog.Info("Shutting down", "delay", shutdownDelay)
+	shuttingDown.Store(true)
+	time.Sleep(shutdownDelay)
+
+	ctx, cancelDrain := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancelDrain()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Requests still in flight were cut off", "error", err)
+	}
+
+	stopBackground()
+	done := make(chan struct{})
+	go func() {
+		backgroundWork.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(backgroundTimeout):
+		slog.Warn("Background work still running was cut off")
+	}
+	slog.Info("Shut down")
+}
@@ -0,0 +1,99 @@
+// Package softdelete marks documents deleted instead of removing them.
+// Deleted documents are hidden from queries, can be restored, and are
+// purged by a retention job once they have been deleted for longer than
+// the retention period.
+package softdelete
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/auth"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/server"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
+)
+
+// defaultRetention is how long soft-deleted documents are kept before the
+// retention job purges them, unless SOFT_DELETE_RETENTION overrides it.
+const defaultRetention = 30 * 24 * time.Hour
+
+// NotDeleted restricts a filter to documents that have not been
+// soft-deleted.
+func NotDeleted(filter bson.M) bson.M {
+	filter["deleted_at"] = bson.M{"$exists": false}
+	return filter
+}
+
+// Scope applies NotDeleted unless an admin asked for soft-deleted
+// documents with ?include_deleted=true.
+func Scope(req *http.Request, filter bson.M) bson.M {
+	if req.URL.Query().Get("include_deleted") == "true" && auth.Role(req) == "admin" {
+		return filter
+	}
+	return NotDeleted(filter)
+}
+
+// Delete marks a document deleted by the requesting user.
+func Delete(req *http.Request, collection *mongo.Collection, filter bson.M) (*mongo.UpdateResult, error) {
+	deletedBy, _ := req.Context().Value("userID").(string)
+	return collection.UpdateOne(tracing.Traced(req), NotDeleted(filter), bson.M{
+		"$set": bson.M{
+			"deleted_at": time.Now().UTC(),
+			"deleted_by": deletedBy,
+		},
+		"$inc": bson.M{"version": 1},
+	})
+}
+
+// Restore clears the soft-delete markers of a deleted document.
+func Restore(collection *mongo.Collection, filter bson.M) (*mongo.UpdateResult, error) {
+	filter["deleted_at"] = bson.M{"$exists": true}
+	return collection.UpdateOne(context.TODO(), filter, bson.M{
+		"$unset": bson.M{
+			"deleted_at": "",
+			"deleted_by": "",
+		},
+		"$inc": bson.M{"version": 1},
+	})
+}
+
+func retentionPeriod() time.Duration {
+	if value := os.Getenv("SOFT_DELETE_RETENTION"); value != "" {
+		period, err := time.ParseDuration(value)
+		if err == nil && period > 0 {
+			return period
+		}
+		log.Printf("Invalid SOFT_DELETE_RETENTION %q, using %v", value, defaultRetention)
+	}
+	return defaultRetention
+}
+
+// RetentionJob permanently removes documents that were soft-deleted more
+// than the retention period ago, checking once an hour until the service
+// shuts down.
+func RetentionJob(collection *mongo.Collection) {
+	period := retentionPeriod()
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		cutoff := time.Now().UTC().Add(-period)
+		result, err := collection.DeleteMany(context.TODO(), bson.M{"deleted_at": bson.M{"$lt": cutoff}})
+		if err != nil {
+			log.Printf("Retention job failed for %s: %v", collection.Name(), err)
+		} else if result.DeletedCount > 0 {
+			log.Printf("Retention job purged %d %s deleted before %s", result.DeletedCount, collection.Name(), cutoff.Format(time.RFC3339))
+		}
+		select {
+		case <-server.Background().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
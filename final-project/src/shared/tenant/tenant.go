@@ -0,0 +1,157 @@
+// Package tenant scopes a service to the organization named by the token
+// of each request, and refuses tokens whose user has since lost their
+// place in that organization.
+package tenant
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/auth"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/eventbus"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
+)
+
+// A token names the organization its user worked in when it was issued,
+// in its org_id claim, and their role there in org_role. The claims can
+// outlive the membership: a user who is removed from an organization, or
+// is no longer one of its admins, still holds the token. The user service
+// announces such changes with an org.membership.revoked event, each
+// service records them, and the middleware refuses tokens for that
+// organization issued before the change. Tokens last a day at most, so a
+// revocation is dropped after a day.
+
+// RevokedEvent is the type of the event announcing a lost membership or
+// org admin role.
+const RevokedEvent = "org.membership.revoked"
+
+// GrantedEvent is the type of the event announcing a new membership.
+// Services that need to know who belongs to an organization keep their
+// own list of members from it and RevokedEvent.
+const GrantedEvent = "org.membership.granted"
+
+// tokenLifetime is the longest the user service issues tokens for.
+const tokenLifetime = 24 * time.Hour
+
+// DefaultOrgID is the user service's default organization, which data
+// from before organizations existed belongs to.
+var DefaultOrgID = primitive.ObjectID{11: 1}
+
+// Revocations records, per organization and user, when the user last lost
+// their membership or admin role there.
+type Revocations struct {
+	collection *mongo.Collection
+}
+
+type revocation struct {
+	OrgID     primitive.ObjectID `bson:"org_id"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	RevokedAt time.Time          `bson:"revoked_at"`
+}
+
+// NewRevocations keeps revocations in collection.
+func NewRevocations(collection *mongo.Collection) (*Revocations, error) {
+	_, err := collection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "org_id", Value: 1}, {Key: "user_id", Value: 1}},
+			Options: options.Index().SetName("org_user_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "revoked_at", Value: 1}},
+			Options: options.Index().SetName("revoked_at_ttl").SetExpireAfterSeconds(int32(tokenLifetime.Seconds())),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Revocations{collection: collection}, nil
+}
+
+// Handle records an org.membership.revoked event.
+func (r *Revocations) Handle(ctx context.Context, event eventbus.Event) error {
+	var data struct {
+		OrgID  primitive.ObjectID `json:"org_id"`
+		UserID primitive.ObjectID `json:"user_id"`
+	}
+	if err := json.Unmarshal(event.Data, &data); err != nil {
+		log.Printf("Ignoring malformed %s event %s: %v", event.Type, event.ID, err)
+		return nil
+	}
+
+	// A redelivered or late event never moves a revocation back
+	_, err := r.collection.UpdateOne(ctx,
+		bson.M{"org_id": data.OrgID, "user_id": data.UserID},
+		bson.M{"$max": bson.M{"revoked_at": event.Time}},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+// Middleware requires a token that names an organization and was issued
+// after its user's last revocation there, and puts the organization in
+// the request context. Org admins get the admin role. It goes inside the
+// service's auth middleware.
+func (r *Revocations) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := auth.Claims(req)
+		orgID, err := primitive.ObjectIDFromHex(fmt.Sprint(claims["org_id"]))
+		if err != nil {
+			problem.Error(w, "Token does not name an organization, log in again", http.StatusForbidden)
+			return
+		}
+		userID, err := primitive.ObjectIDFromHex(fmt.Sprint(claims["userID"]))
+		if err != nil {
+			problem.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		var revoked revocation
+		err = r.collection.FindOne(tracing.Traced(req), bson.M{"org_id": orgID, "user_id": userID}).Decode(&revoked)
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+		case err != nil:
+			log.Printf("Failed to check membership revocations: %v", err)
+			problem.Error(w, "Failed to check the organization membership", http.StatusInternalServerError)
+			return
+		case issuedBefore(claims, revoked.RevokedAt):
+			problem.Error(w, "Organization membership has changed, log in again", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), "orgID", orgID)
+		if claims["org_role"] == "admin" {
+			ctx = context.WithValue(ctx, "role", "admin")
+		}
+		next(w, req.WithContext(ctx))
+	}
+}
+
+// issuedBefore reports whether a token was issued before t, or in the same
+// second. Tokens without an issue time predate revocations altogether.
+func issuedBefore(claims jwt.MapClaims, t time.Time) bool {
+	issuedAt, ok := claims["iat"].(float64)
+	return !ok || int64(issuedAt) <= t.Unix()
+}
+
+// Org returns the organization of a request that passed the middleware.
+func Org(req *http.Request) primitive.ObjectID {
+	orgID, _ := req.Context().Value("orgID").(primitive.ObjectID)
+	return orgID
+}
+
+// InOrg restricts a filter to the request's organization.
+func InOrg(req *http.Request, filter bson.M) bson.M {
+	filter["org_id"] = Org(req)
+	return filter
+}
@@ -0,0 +1,28 @@
+package tenant
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestIssuedBefore(t *testing.T) {
+	revokedAt := time.Unix(1700000000, 500)
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   bool
+	}{
+		{"issued earlier", jwt.MapClaims{"iat": float64(1699999999)}, true},
+		{"issued in the same second", jwt.MapClaims{"iat": float64(1700000000)}, true},
+		{"issued later", jwt.MapClaims{"iat": float64(1700000001)}, false},
+		{"no issue time", jwt.MapClaims{}, true},
+		{"malformed issue time", jwt.MapClaims{"iat": "1700000001"}, true},
+	}
+	for _, tt := range tests {
+		if got := issuedBefore(tt.claims, revokedAt); got != tt.want {
+			t.Errorf("%s: issuedBefore = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
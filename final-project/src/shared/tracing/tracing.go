@@ -0,0 +1,77 @@
+// Package tracing traces requests with OpenTelemetry. The W3C trace
+// context arrives in traceparent and is passed on to the services called,
+// so a request's spans in every service form one trace. Spans are exported
+// with OTLP over HTTP to the collector the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT (or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT)
+// variable points at. Without one the trace context is still passed on,
+// but nothing is recorded.
+package tracing
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/health"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/metrics"
+)
+
+// Client sends requests in the trace of their context.
+var Client = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+
+// Setup installs trace context propagation and, if a collector is
+// configured, the tracer provider exporting to it. The returned function
+// flushes the spans not exported yet.
+func Setup(service string) func(context.Context) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }
+	}
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		slog.Error("Not exporting traces", "error", err)
+		return func(context.Context) error { return nil }
+	}
+	provider := NewTracerProvider(service, exporter)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown
+}
+
+// NewTracerProvider batches a service's spans to an exporter, which can
+// also be an in-memory one to check the spans in-process.
+func NewTracerProvider(service string, exporter sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service)))
+	if err != nil {
+		res = resource.Default()
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+}
+
+// Traced returns a context with a request's trace but not its
+// cancellation. Database calls made with it show up in the request's trace,
+// and still run to the end if the client goes away halfway through.
+func Traced(req *http.Request) context.Context {
+	return context.WithoutCancel(req.Context())
+}
+
+// Middleware starts a server span for every request to next but probes
+// and scrapes, named after the route it matched.
+func Middleware(next http.Handler, route metrics.RouteFunc) http.Handler {
+	return otelhttp.NewHandler(next, "http.server",
+		otelhttp.WithSpanNameFormatter(func(_ string, req *http.Request) string {
+			return req.Method + " " + route(req)
+		}),
+		otelhttp.WithFilter(func(req *http.Request) bool {
+			return !health.ProbePath(req.URL.Path)
+		}))
+}
@@ -0,0 +1,107 @@
+// Package validate checks request bodies against a small schema per
+// resource before anything is written. Each check records a message
+// against the JSON name of the field, so a client sees every problem with
+// a payload at once.
+package validate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+)
+
+// Errors collects the field errors of a request body.
+type Errors []problem.FieldError
+
+func (e *Errors) Add(field, format string, args ...interface{}) {
+	*e = append(*e, problem.FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Required checks that a string field is present and not blank.
+func (e *Errors) Required(field, value string) bool {
+	if strings.TrimSpace(value) == "" {
+		e.Add(field, "is required")
+		return false
+	}
+	return true
+}
+
+func (e *Errors) Length(field, value string, min, max int) {
+	if n := utf8.RuneCountInString(value); n < min || n > max {
+		e.Add(field, "must be between %d and %d characters", min, max)
+	}
+}
+
+func (e *Errors) Pattern(field, value string, re *regexp.Regexp, description string) {
+	if !re.MatchString(value) {
+		e.Add(field, "must %s", description)
+	}
+}
+
+func (e *Errors) Email(field, value string) {
+	address, err := mail.ParseAddress(value)
+	if err != nil || address.Address != value {
+		e.Add(field, "must be a valid email address")
+	}
+}
+
+func (e *Errors) OneOf(field, value string, options ...string) {
+	for _, option := range options {
+		if value == option {
+			return
+		}
+	}
+	e.Add(field, "must be one of: %s", strings.Join(options, ", "))
+}
+
+func (e *Errors) AtLeast(field string, value, min float64) {
+	if value < min {
+		e.Add(field, "must be at least %g", min)
+	}
+}
+
+// DecodeBody decodes a JSON request body into v. Values of the wrong type
+// are reported against their field rather than as one opaque error.
+func DecodeBody(req *http.Request, v interface{}) Errors {
+	if err := json.NewDecoder(req.Body).Decode(v); err != nil {
+		return JSONErrors(err)
+	}
+	return nil
+}
+
+// JSONErrors converts an error from decoding JSON into field errors.
+func JSONErrors(err error) Errors {
+	var errs Errors
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		errs.Add(typeErr.Field, "must be %s", jsonKind(typeErr.Type))
+		return errs
+	}
+	errs.Add("body", "is not valid: %v", err)
+	return errs
+}
+
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
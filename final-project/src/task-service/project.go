@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/concurrency"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/mergepatch"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/softdelete"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tenant"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/validate"
+)
+
+// Projects group an organization's tasks. A project has members, who are
+// users and teams, a budget in hours and money, the client the work is
+// for, and the hourly rate its tasks are invoiced at. Tasks join a project
+// through their project_id. Every member of the organization can see its
+// projects; org admins manage them.
+
+// defaultHourlyRate is what tasks outside a project, or in a project
+// without a default rate, are invoiced at.
+const defaultHourlyRate = 100.0
+
+type Project struct {
+	ID           primitive.ObjectID   `bson:"_id" json:"id"`
+	OrgID        primitive.ObjectID   `bson:"org_id" json:"org_id"`
+	Name         string               `bson:"name" json:"name"`
+	Description  string               `bson:"description" json:"description"`
+	Client       string               `bson:"client" json:"client"`
+	Members      []primitive.ObjectID `bson:"members" json:"members"`
+	Teams        []primitive.ObjectID `bson:"teams" json:"teams"`
+	BudgetHours  float64              `bson:"budget_hours" json:"budget_hours"`
+	BudgetAmount float64              `bson:"budget_amount" json:"budget_amount"`
+	DefaultRate  float64              `bson:"default_rate" json:"default_rate"`
+	DeletedAt    *time.Time           `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	DeletedBy    string               `bson:"deleted_by,omitempty" json:"deleted_by,omitempty"`
+	Version      int64                `bson:"version" json:"version"`
+}
+
+// ProjectDashboard sums up a project's tasks against its budget. Burned
+// hours are those of done tasks, which have been invoiced; open hours are
+// those of the other tasks. A zero budget means the project has none.
+type ProjectDashboard struct {
+	ProjectID       primitive.ObjectID `json:"project_id"`
+	Name            string             `json:"name"`
+	OpenTasks       int                `json:"open_tasks"`
+	DoneTasks       int                `json:"done_tasks"`
+	TasksByStatus   map[string]int     `json:"tasks_by_status"`
+	BudgetHours     float64            `json:"budget_hours"`
+	BurnedHours     float64            `json:"burned_hours"`
+	OpenHours       float64            `json:"open_hours"`
+	RemainingHours  float64            `json:"remaining_hours"`
+	BudgetAmount    float64            `json:"budget_amount"`
+	BurnedAmount    float64            `json:"burned_amount"`
+	RemainingAmount float64            `json:"remaining_amount"`
+	OverBudget      bool               `json:"over_budget"`
+}
+
+// Fields org admins may change with PATCH.
+var projectPatchFields = map[string]bool{
+	"name": true, "description": true, "client": true, "members": true, "teams": true,
+	"budget_hours": true, "budget_amount": true, "default_rate": true,
+}
+
+func projects() *mongo.Collection {
+	return client.Database("taskmanagement").Collection("projects")
+}
+
+// rate is the hourly rate the project's tasks are invoiced at.
+func (p *Project) rate() float64 {
+	if p.DefaultRate > 0 {
+		return p.DefaultRate
+	}
+	return defaultHourlyRate
+}
+
+// loadProject returns the project with the given ID in the request's
+// organization, including a soft-deleted one, or nil.
+func loadProject(req *http.Request, objectID primitive.ObjectID) *Project {
+	var project Project
+	err := projects().FindOne(tracing.Traced(req), tenant.InOrg(req, bson.M{"_id": objectID})).Decode(&project)
+	if err != nil {
+		return nil
+	}
+	return &project
+}
+
+// validateProject checks a complete project, including that its teams
+// are teams of the organization.
+func validateProject(req *http.Request, project Project) validate.Errors {
+	var errs validate.Errors
+	if errs.Required("name", project.Name) {
+		errs.Length("name", project.Name, 1, 200)
+	}
+	errs.Length("description", project.Description, 0, 2000)
+	errs.Length("client", project.Client, 0, 200)
+	errs.AtLeast("budget_hours", project.BudgetHours, 0)
+	errs.AtLeast("budget_amount", project.BudgetAmount, 0)
+	errs.AtLeast("default_rate", project.DefaultRate, 0)
+	if len(project.Teams) > 0 {
+		count, err := teams().CountDocuments(tracing.Traced(req), softdelete.NotDeleted(tenant.InOrg(req, bson.M{"_id": bson.M{"$in": project.Teams}})))
+		if err != nil || int(count) != len(uniqueIDs(project.Teams)) {
+			errs.Add("teams", "must be teams of the organization")
+		}
+	}
+	return errs
+}
+
+// uniqueIDs drops repeated IDs, keeping the first of each.
+func uniqueIDs(ids []primitive.ObjectID) []primitive.ObjectID {
+	seen := map[primitive.ObjectID]bool{}
+	unique := []primitive.ObjectID{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// projectErrors checks that a task's project is a project of the
+// organization that has not been deleted.
+func projectErrors(req *http.Request, projectID *primitive.ObjectID) validate.Errors {
+	if projectID == nil {
+		return nil
+	}
+	err := projects().FindOne(tracing.Traced(req), softdelete.NotDeleted(tenant.InOrg(req, bson.M{"_id": *projectID}))).Err()
+	if err != nil {
+		return validate.Errors{{Field: "project_id", Message: "must be a project of the organization"}}
+	}
+	return nil
+}
+
+// taskRate is the hourly rate a task is invoiced at.
+func taskRate(req *http.Request, task Task) float64 {
+	if task.ProjectID != nil {
+		if project := loadProject(req, *task.ProjectID); project != nil {
+			return project.rate()
+		}
+	}
+	return defaultHourlyRate
+}
+
+func createProject(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var project Project
+	if errs := validate.DecodeBody(req, &project); errs != nil {
+		problem.Validation(w, http.StatusBadRequest, errs)
+		return
+	}
+	project.ID = primitive.NewObjectID()
+	project.OrgID = tenant.Org(req)
+	project.Members = uniqueIDs(project.Members)
+	project.Teams = uniqueIDs(project.Teams)
+	project.DeletedAt, project.DeletedBy = nil, ""
+	if errs := validateProject(req, project); len(errs) > 0 {
+		problem.Validation(w, http.StatusUnprocessableEntity, errs)
+		return
+	}
+
+	project.Version = 1
+	if _, err := projects().InsertOne(tracing.Traced(req), project); err != nil {
+		log.Printf("Failed to create project: %v", err)
+		problem.Error(w, "Failed to create project", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(req, "project_create", project.ID.Hex(), nil, project)
+
+	log.Printf("Project created: %s", project.ID.Hex())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", concurrency.ETag(project.Version))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(project)
+}
+
+func listProjects(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cursor, err := projects().Find(tracing.Traced(req), softdelete.Scope(req, tenant.InOrg(req, bson.M{})))
+	if err != nil {
+		problem.Error(w, "Failed to list projects", http.StatusInternalServerError)
+		return
+	}
+	list := []Project{}
+	if err := cursor.All(tracing.Traced(req), &list); err != nil {
+		problem.Error(w, "Failed to decode projects", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func getProject(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/projects/get/"):])
+	if err != nil {
+		problem.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+	var project Project
+	err = projects().FindOne(tracing.Traced(req), softdelete.Scope(req, tenant.InOrg(req, bson.M{"_id": objectID}))).Decode(&project)
+	if err != nil {
+		problem.Error(w, "Project not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", concurrency.ETag(project.Version))
+	json.NewEncoder(w).Encode(project)
+}
+
+// patchProject applies a JSON merge patch to a project in one versioned
+// replace, like patchTask.
+func patchProject(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPatch {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	projectID := req.URL.Path[len("/projects/update/"):]
+	objectID, err := primitive.ObjectIDFromHex(projectID)
+	if err != nil {
+		problem.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	version, status, err := concurrency.IfMatch(req)
+	if err != nil {
+		problem.Error(w, err.Error(), status)
+		return
+	}
+
+	patch, err := mergepatch.Decode(req)
+	if err != nil {
+		problem.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := mergepatch.CheckFields(patch, projectPatchFields); err != nil {
+		problem.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var current Project
+	err = projects().FindOne(tracing.Traced(req), softdelete.NotDeleted(tenant.InOrg(req, bson.M{"_id": objectID}))).Decode(&current)
+	if err != nil {
+		problem.Error(w, "Project not found", http.StatusNotFound)
+		return
+	}
+	if current.Version != version {
+		problem.Error(w, "Project has been modified, fetch it again and retry", http.StatusPreconditionFailed)
+		return
+	}
+
+	patched := current
+	if err := mergepatch.Into(&patched, patch); err != nil {
+		problem.Validation(w, http.StatusBadRequest, validate.JSONErrors(err))
+		return
+	}
+	patched.Members = uniqueIDs(patched.Members)
+	patched.Teams = uniqueIDs(patched.Teams)
+	if errs := validateProject(req, patched); len(errs) > 0 {
+		problem.Validation(w, http.StatusUnprocessableEntity, errs)
+		return
+	}
+
+	patched.Version = version + 1
+	filter := concurrency.MatchVersion(softdelete.NotDeleted(tenant.InOrg(req, bson.M{"_id": objectID})), version)
+	result, err := projects().ReplaceOne(tracing.Traced(req), filter, patched)
+	if err != nil {
+		problem.Error(w, "Failed to update project", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		status, message := concurrency.Conflict(projects(), tenant.InOrg(req, bson.M{"_id": objectID}))
+		problem.Error(w, "Project "+message, status)
+		return
+	}
+	recordAudit(req, "project_update", projectID, current, patched)
+
+	w.Header().Set("ETag", concurrency.ETag(patched.Version))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func removeProject(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodDelete {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	projectID := req.URL.Path[len("/projects/remove/"):]
+	objectID, err := primitive.ObjectIDFromHex(projectID)
+	if err != nil {
+		problem.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	before := loadProject(req, objectID)
+	result, err := softdelete.Delete(req, projects(), tenant.InOrg(req, bson.M{"_id": objectID}))
+	if err != nil {
+		problem.Error(w, "Failed to remove project", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		problem.Error(w, "Project not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(req, "project_delete", projectID, before, loadProject(req, objectID))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func restoreProject(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	projectID := req.URL.Path[len("/projects/restore/"):]
+	objectID, err := primitive.ObjectIDFromHex(projectID)
+	if err != nil {
+		problem.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	before := loadProject(req, objectID)
+	result, err := softdelete.Restore(projects(), tenant.InOrg(req, bson.M{"_id": objectID}))
+	if err != nil {
+		problem.Error(w, "Failed to restore project", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		problem.Error(w, "Deleted project not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(req, "project_restore", projectID, before, loadProject(req, objectID))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// projectDashboard sums up a project's tasks against its budget. Money is
+// counted at the project's rate.
+func projectDashboard(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/projects/dashboard/"):])
+	if err != nil {
+		problem.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+	project := loadProject(req, objectID)
+	if project == nil || project.DeletedAt != nil {
+		problem.Error(w, "Project not found", http.StatusNotFound)
+		return
+	}
+
+	cursor, err := client.Database("taskmanagement").Collection("tasks").Find(tracing.Traced(req), softdelete.NotDeleted(tenant.InOrg(req, bson.M{"project_id": objectID})))
+	if err != nil {
+		problem.Error(w, "Failed to load project tasks", http.StatusInternalServerError)
+		return
+	}
+	var tasks []Task
+	if err := cursor.All(tracing.Traced(req), &tasks); err != nil {
+		problem.Error(w, "Failed to decode project tasks", http.StatusInternalServerError)
+		return
+	}
+
+	dashboard := ProjectDashboard{
+		ProjectID:     project.ID,
+		Name:          project.Name,
+		TasksByStatus: map[string]int{},
+		BudgetHours:   project.BudgetHours,
+		BudgetAmount:  project.BudgetAmount,
+	}
+	for _, task := range tasks {
+		dashboard.TasksByStatus[task.Status]++
+		if task.Status == "done" {
+			dashboard.DoneTasks++
+			dashboard.BurnedHours += task.Hours
+		} else {
+			dashboard.OpenTasks++
+			dashboard.OpenHours += task.Hours
+		}
+	}
+	dashboard.BurnedAmount = dashboard.BurnedHours * project.rate()
+	dashboard.RemainingHours = project.BudgetHours - dashboard.BurnedHours
+	dashboard.RemainingAmount = project.BudgetAmount - dashboard.BurnedAmount
+	dashboard.OverBudget = (project.BudgetHours > 0 && dashboard.RemainingHours < 0) ||
+		(project.BudgetAmount > 0 && dashboard.RemainingAmount < 0)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dashboard)
+}
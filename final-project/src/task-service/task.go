@@ -4,23 +4,61 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"log/slog"
 	"net/http"
 	"time"
-	"bytes"
-	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/audit"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/auth"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/concurrency"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/eventbus"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/health"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/logging"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/mergepatch"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/metrics"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/server"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/softdelete"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tenant"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/validate"
 )
 
 var client *mongo.Client
 
+// eventSource names the service in the events it publishes and its logs
+const eventSource = "task-service"
+
+var bus eventbus.Broker
+
+var outbox *eventbus.Outbox
+
+// publishEvent publishes an event from this service through its outbox.
+func publishEvent(eventType string, data interface{}) {
+	outbox.Publish(eventSource, eventType, data)
+}
+
+// recordAudit publishes the audit record of a mutating request. before and
+// after are the document as it was and as it is now; either may be nil for
+// creates and hard deletes.
+func recordAudit(req *http.Request, action, targetID string, before, after interface{}) {
+	publishEvent("audit.recorded", audit.FromRequest(eventSource, req, action, targetID, before, after))
+}
+
 func main() {
+	logging.Setup(eventSource)
+	shutdownTracing := tracing.Setup(eventSource)
+	defer shutdownTracing(context.Background())
+
 	// Create a new MongoDB client
 	var err error
-	client, err = mongo.NewClient(options.Client().ApplyURI("mongodb://task-mongodb:27017"))
+	client, err = mongo.NewClient(options.Client().ApplyURI("mongodb://task-mongodb:27017").SetMonitor(metrics.MongoMonitor()))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -32,7 +70,8 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer client.Disconnect(ctx)
+	defer client.Disconnect(context.Background())
+	health.AddCheck("mongodb", health.PingMongo(client))
 
 	// Check if the database and collection exist, create them if they don't
 	err = ensureDatabaseAndCollection(client)
@@ -40,20 +79,83 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Every task belongs to an organization
+	err = ensureTenancy(client)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Tokens outlive memberships, so revoked ones are recorded
+	tenants, err = tenant.NewRevocations(client.Database("taskmanagement").Collection("revocations"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Connect to the event bus
+	bus, err = eventbus.Connect()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer bus.Close()
+	health.AddCheck("eventbus", bus.Ping)
+
+	// Events go out through an outbox in the service's own database
+	outbox, err = eventbus.NewOutbox(client.Database("taskmanagement").Collection("outbox"), bus)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.Go(outbox.Relay)
+
+	// Consume events from the other services
+	if err := startConsumers(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Purge soft-deleted tasks once their retention period has passed
+	server.Go(func() { softdelete.RetentionJob(client.Database("taskmanagement").Collection("tasks")) })
+	server.Go(func() { softdelete.RetentionJob(projects()) })
+	server.Go(func() { softdelete.RetentionJob(teams()) })
+
 	// Create a new HTTP server
 	mux := http.NewServeMux()
 
-mux.Handle("/tasks/list", http.HandlerFunc(listTasks))
-mux.Handle("/tasks/create", http.HandlerFunc(createTask))
-mux.Handle("/tasks/get/", http.HandlerFunc(getTask))
-mux.Handle("/tasks/update/", http.HandlerFunc(updateTask))
-mux.Handle("/tasks/remove/", authMiddleware(adminMiddleware(http.HandlerFunc(removeTask))))
-mux.Handle("/tasks/removeAllTasks", http.HandlerFunc(removeAllTasks))
-mux.Handle("/tasks/listByUser/", http.HandlerFunc(listTasksByUser))
+mux.Handle("/tasks/list", tenantMiddleware(http.HandlerFunc(listTasks)))
+mux.Handle("/tasks/create", tenantMiddleware(http.HandlerFunc(createTask)))
+mux.Handle("/tasks/get/", tenantMiddleware(http.HandlerFunc(getTask)))
+mux.Handle("/tasks/update/", tenantMiddleware(http.HandlerFunc(updateTask)))
+mux.Handle("/tasks/remove/", tenantMiddleware(adminMiddleware(http.HandlerFunc(removeTask))))
+mux.Handle("/tasks/restore/", tenantMiddleware(adminMiddleware(http.HandlerFunc(restoreTask))))
+mux.Handle("/tasks/listByUser/", tenantMiddleware(http.HandlerFunc(listTasksByUser)))
+
+	// Project and team endpoints
+	mux.Handle("/projects/list", tenantMiddleware(http.HandlerFunc(listProjects)))
+	mux.Handle("/projects/create", tenantMiddleware(adminMiddleware(http.HandlerFunc(createProject))))
+	mux.Handle("/projects/get/", tenantMiddleware(http.HandlerFunc(getProject)))
+	mux.Handle("/projects/update/", tenantMiddleware(adminMiddleware(http.HandlerFunc(patchProject))))
+	mux.Handle("/projects/remove/", tenantMiddleware(adminMiddleware(http.HandlerFunc(removeProject))))
+	mux.Handle("/projects/restore/", tenantMiddleware(adminMiddleware(http.HandlerFunc(restoreProject))))
+	mux.Handle("/projects/dashboard/", tenantMiddleware(http.HandlerFunc(projectDashboard)))
+	mux.Handle("/teams/list", tenantMiddleware(http.HandlerFunc(listTeams)))
+	mux.Handle("/teams/create", tenantMiddleware(adminMiddleware(http.HandlerFunc(createTeam))))
+	mux.Handle("/teams/get/", tenantMiddleware(http.HandlerFunc(getTeam)))
+	mux.Handle("/teams/update/", tenantMiddleware(adminMiddleware(http.HandlerFunc(patchTeam))))
+	mux.Handle("/teams/remove/", tenantMiddleware(adminMiddleware(http.HandlerFunc(removeTeam))))
+	mux.Handle("/teams/restore/", tenantMiddleware(adminMiddleware(http.HandlerFunc(restoreTeam))))
+
+	// Liveness and readiness checks, used by the API gateway and Kubernetes
+	mux.HandleFunc("/healthz", health.Healthz)
+	mux.HandleFunc("/readyz", health.Readyz)
+
+	// Prometheus metrics
+	prometheus.MustRegister(metrics.NewCountGauge("tasks_open", "Tasks that are not done or deleted.",
+		func() *mongo.Collection { return client.Database("taskmanagement").Collection("tasks") },
+		softdelete.NotDeleted(bson.M{"status": bson.M{"$ne": "done"}})))
+	mux.Handle("/metrics", promhttp.Handler())
 
 	// Start the server
 	log.Println("Task Service listening on port 8002...")
-	log.Fatal(http.ListenAndServe(":8002", mux))
+	route := metrics.MuxRoute(mux)
+	server.Run(":8002", tracing.Middleware(logging.Middleware(metrics.Middleware(auth.RequireScopes(mux), route)), route))
 }
 
 func ensureDatabaseAndCollection(client *mongo.Client) error {
@@ -120,51 +222,68 @@ type Task struct {
     EndDate     time.Time          `bson:"end_date" json:"end_date"`
     InvoiceID   primitive.ObjectID `bson:"invoice_id,omitempty" json:"invoice_id,omitempty"`
     ParentTask  *primitive.ObjectID `bson:"parent_task,omitempty" json:"parent_task,omitempty"`
-}
-
-type Billing struct {
-    ID     primitive.ObjectID `bson:"_id" json:"id"`
-    UserID primitive.ObjectID `bson:"user_id" json:"user_id"`
-    TaskID primitive.ObjectID `bson:"task_id" json:"task_id"`
-    Hours  float64             `bson:"hours" json:"hours"`
-    Amount float64             `bson:"amount" json:"amount"`
+    ProjectID   *primitive.ObjectID `bson:"project_id,omitempty" json:"project_id,omitempty"`
+    OrgID       primitive.ObjectID  `bson:"org_id" json:"org_id"`
+    DeletedAt   *time.Time          `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+    DeletedBy   string              `bson:"deleted_by,omitempty" json:"deleted_by,omitempty"`
+    Version     int64               `bson:"version" json:"version"`
 }
 
 func createTask(w http.ResponseWriter, req *http.Request) {
     var task Task
-    err := json.NewDecoder(req.Body).Decode(&task)
-    if err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+    if errs := validate.DecodeBody(req, &task); errs != nil {
+        problem.Validation(w, http.StatusBadRequest, errs)
+        return
+    }
+    task.ID = primitive.NewObjectID()
+    task.OrgID = tenant.Org(req)
+    if errs := validateTask(task); len(errs) > 0 {
+        problem.Validation(w, http.StatusUnprocessableEntity, errs)
+        return
+    }
+    if errs := projectErrors(req, task.ProjectID); errs != nil {
+        problem.Validation(w, http.StatusUnprocessableEntity, errs)
+        return
+    }
+    if errs := assigneeErrors(req, task.AssignedTo); errs != nil {
+        problem.Validation(w, http.StatusUnprocessableEntity, errs)
         return
     }
 
     // Check for overlapping tasks
     var overlappingTasks []Task
-    filter := bson.M{
+    filter := softdelete.NotDeleted(tenant.InOrg(req, bson.M{
         "assigned_to": task.AssignedTo,
         "end_date": bson.M{"$gt": task.StartDate},
         "start_date": bson.M{"$lt": task.EndDate},
-    }
-    cursor, err := client.Database("taskmanagement").Collection("tasks").Find(context.TODO(), filter)
+    }))
+    cursor, err := client.Database("taskmanagement").Collection("tasks").Find(tracing.Traced(req), filter)
     if err != nil {
-        http.Error(w, "Database query error", http.StatusInternalServerError)
+        problem.Error(w, "Database query error", http.StatusInternalServerError)
+        return
+    }
+    if err = cursor.All(tracing.Traced(req), &overlappingTasks); err != nil {
+        problem.Error(w, "Database query error", http.StatusInternalServerError)
         return
     }
-    if cursor.All(context.Background(), &overlappingTasks); len(overlappingTasks) > 0 {
+    if len(overlappingTasks) > 0 {
         // Append a warning to the task description indicating overlapping dates
         task.Description += " Warning: This task overlaps with existing task(s)."
     }
 
-    task.ID = primitive.NewObjectID()
-    _, err = client.Database("taskmanagement").Collection("tasks").InsertOne(context.TODO(), task)
+    task.Version = 1
+    _, err = client.Database("taskmanagement").Collection("tasks").InsertOne(tracing.Traced(req), task)
     if err != nil {
-        http.Error(w, "Failed to create task", http.StatusInternalServerError)
+        problem.Error(w, "Failed to create task", http.StatusInternalServerError)
         return
     }
 
+    publishEvent("task.created", task)
+    recordAudit(req, "create", task.ID.Hex(), nil, task)
+
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(task)
-	log.Printf("Task created successfully: %+v", task)
+	slog.InfoContext(req.Context(), "Task created", "task", task)
 }
 
 
@@ -174,22 +293,25 @@ func getTask(w http.ResponseWriter, req *http.Request) {
 	taskID := req.URL.Path[len("/tasks/get/"):]
 	objectID, err := primitive.ObjectIDFromHex(taskID)
 	if err != nil {
-		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		problem.Error(w, "Invalid task ID", http.StatusBadRequest)
 		return
 	}
 
 	var task Task
-	err = client.Database("taskmanagement").Collection("tasks").FindOne(context.TODO(), bson.M{"_id": objectID}).Decode(&task)
+	err = client.Database("taskmanagement").Collection("tasks").FindOne(tracing.Traced(req), softdelete.Scope(req, tenant.InOrg(req, bson.M{"_id": objectID}))).Decode(&task)
 	if err != nil {
-		http.Error(w, "Task not found", http.StatusNotFound)
+		problem.Error(w, "Task not found", http.StatusNotFound)
 		return
 	}
 
 	var subtasks []Task
-	cursor, err := client.Database("taskmanagement").Collection("tasks").Find(context.TODO(), bson.M{"parent_task": objectID})
+	cursor, err := client.Database("taskmanagement").Collection("tasks").Find(tracing.Traced(req), softdelete.Scope(req, tenant.InOrg(req, bson.M{"parent_task": objectID})))
 	if err == nil {
-		defer cursor.Close(context.Background())
-		cursor.All(context.Background(), &subtasks)
+		err = cursor.All(tracing.Traced(req), &subtasks)
+	}
+	if err != nil {
+		problem.Error(w, "Failed to list subtasks", http.StatusInternalServerError)
+		return
 	}
 
 	response := struct {
@@ -201,123 +323,366 @@ func getTask(w http.ResponseWriter, req *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", concurrency.ETag(task.Version))
 	json.NewEncoder(w).Encode(response)
 }
 
 func updateTask(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPatch {
+		patchTask(w, req)
+		return
+	}
 	if req.Method != http.MethodPut {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	taskID := req.URL.Path[len("/tasks/update/"):]
 	objectID, err := primitive.ObjectIDFromHex(taskID)
 	if err != nil {
-		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		problem.Error(w, "Invalid task ID", http.StatusBadRequest)
 		return
 	}
 
-	var updates map[string]interface{}
-	err = json.NewDecoder(req.Body).Decode(&updates)
+	version, status, err := concurrency.IfMatch(req)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
-
-// Prepare update document
-    updateDoc := bson.M{"$set": bson.M{}}
-    for key, value := range updates {
-        // Ensure only allowed fields are updated and handle date parsing
-        switch key {
-        case "title", "description", "assigned_to", "status", "hours":
-            updateDoc["$set"].(bson.M)[key] = value
-        case "start_date", "end_date":
-            if dateString, ok := value.(string); ok {
-                parsedDate, err := time.Parse(time.RFC3339, dateString)
-                if err != nil {
-                    http.Error(w, "Invalid date format", http.StatusBadRequest)
-                    return
-                }
-                updateDoc["$set"].(bson.M)[key] = parsedDate
-            }
-        case "parent_task":
-            if parentTaskIDString, ok := value.(string); ok {
-                parentTaskID, err := primitive.ObjectIDFromHex(parentTaskIDString)
-                if err != nil {
-                    http.Error(w, "Invalid parent task ID", http.StatusBadRequest)
-                    return
-                }
-                updateDoc["$set"].(bson.M)["parent_task"] = parentTaskID
-            }
-        }
-    }
+		problem.Error(w, err.Error(), status)
+		return
+	}
+
+	var updates map[string]interface{}
+	if errs := validate.DecodeBody(req, &updates); errs != nil {
+		problem.Validation(w, http.StatusBadRequest, errs)
+		return
+	}
 
 	collection := client.Database("taskmanagement").Collection("tasks")
 	// Fetch the current task to compare changes
 	var currentTask Task
-	err = collection.FindOne(context.TODO(), bson.M{"_id": objectID}).Decode(&currentTask)
+	err = collection.FindOne(tracing.Traced(req), softdelete.NotDeleted(tenant.InOrg(req, bson.M{"_id": objectID}))).Decode(&currentTask)
 	if err != nil {
-		http.Error(w, "Task not found", http.StatusNotFound)
+		problem.Error(w, "Task not found", http.StatusNotFound)
 		return
 	}
 
-	// Handle InvoiceID creation if task status changes to 'done'
-if currentTask.Status != "done" && updates["status"] == "done" {
-    invoiceID, err := createInvoiceInBillingService(currentTask)
-    if err != nil {
-        log.Printf("Failed to create invoice: %v", err)
-        http.Error(w, "Failed to create invoice", http.StatusInternalServerError)
-        return
-    }
+	// Reject stale writes before validating the update
+	if currentTask.Version != version {
+		problem.Error(w, "Task has been modified, fetch it again and retry", http.StatusPreconditionFailed)
+		return
+	}
+
+	// Only these fields can be updated; others in the body are ignored
+	changes := map[string]interface{}{}
+	for key, value := range updates {
+		switch key {
+		case "title", "description", "assigned_to", "status", "hours", "start_date", "end_date", "parent_task", "project_id":
+			changes[key] = value
+		}
+	}
+
+	// Validate the task as it will be after the update, so fields are
+	// checked against each other and stored with their proper types
+	updated := currentTask
+	if err := mergepatch.Into(&updated, changes); err != nil {
+		problem.Validation(w, http.StatusBadRequest, validate.JSONErrors(err))
+		return
+	}
+	if errs := validateTask(updated); len(errs) > 0 {
+		problem.Validation(w, http.StatusUnprocessableEntity, errs)
+		return
+	}
+	// A PUT carries the whole task, so only the fields it changes count
+	changed := map[string]interface{}{}
+	for key := range audit.Diff(currentTask, updated) {
+		changed[key] = true
+	}
+	if err := mergepatch.CheckFields(changed, taskFields(req)); err != nil {
+		problem.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if _, ok := changes["project_id"]; ok {
+		if errs := projectErrors(req, updated.ProjectID); errs != nil {
+			problem.Validation(w, http.StatusUnprocessableEntity, errs)
+			return
+		}
+	}
+	if _, ok := changed["assigned_to"]; ok {
+		if errs := assigneeErrors(req, updated.AssignedTo); errs != nil {
+			problem.Validation(w, http.StatusUnprocessableEntity, errs)
+			return
+		}
+	}
+
+	updateDoc := bson.M{"$set": bson.M{
+		"title":       updated.Title,
+		"description": updated.Description,
+		"assigned_to": updated.AssignedTo,
+		"status":      updated.Status,
+		"hours":       updated.Hours,
+		"start_date":  updated.StartDate,
+		"end_date":    updated.EndDate,
+		"parent_task": updated.ParentTask,
+		"project_id":  updated.ProjectID,
+	}}
+
+	filter := concurrency.MatchVersion(softdelete.NotDeleted(tenant.InOrg(req, bson.M{"_id": objectID})), version)
+	result, err := collection.UpdateOne(tracing.Traced(req), filter, concurrency.BumpVersion(updateDoc))
+	if err != nil {
+		problem.Error(w, "Failed to update task", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		status, message := concurrency.Conflict(collection, tenant.InOrg(req, bson.M{"_id": objectID}))
+		problem.Error(w, "Task "+message, status)
+		return
+	}
+
+	updatedTask := loadTask(objectID)
+	if updatedTask != nil {
+		publishStatusChange(req, currentTask, *updatedTask)
+	}
+	recordAudit(req, "update", taskID, currentTask, updatedTask)
+
+	w.Header().Set("ETag", concurrency.ETag(version+1))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Fields each role may change with PATCH or PUT. Org admins count as
+// admins.
+var taskPatchFields = map[string]map[string]bool{
+	"admin": {
+		"title": true, "description": true, "assigned_to": true, "status": true,
+		"hours": true, "start_date": true, "end_date": true, "parent_task": true,
+		"project_id": true,
+	},
+	"regular": {
+		"title": true, "description": true, "status": true,
+		"hours": true, "start_date": true, "end_date": true,
+	},
+}
 
-    updateDoc["$set"].(bson.M)["invoice_id"] = invoiceID
-    log.Printf("Task updated to 'done'. New InvoiceID: %v generated", invoiceID)
+// taskFields returns the fields the request's role may change.
+func taskFields(req *http.Request) map[string]bool {
+	allowed, ok := taskPatchFields[auth.Role(req)]
+	if !ok {
+		allowed = taskPatchFields["regular"]
+	}
+	return allowed
 }
 
-	_, err = collection.UpdateOne(context.TODO(), bson.M{"_id": objectID}, updateDoc)
+// patchTask applies a JSON merge patch to a task. The patched task is
+// validated and written in one versioned replace.
+func patchTask(w http.ResponseWriter, req *http.Request) {
+	taskID := req.URL.Path[len("/tasks/update/"):]
+	objectID, err := primitive.ObjectIDFromHex(taskID)
 	if err != nil {
-		http.Error(w, "Failed to update task", http.StatusInternalServerError)
+		problem.Error(w, "Invalid task ID", http.StatusBadRequest)
 		return
 	}
 
+	version, status, err := concurrency.IfMatch(req)
+	if err != nil {
+		problem.Error(w, err.Error(), status)
+		return
+	}
+
+	patch, err := mergepatch.Decode(req)
+	if err != nil {
+		problem.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := mergepatch.CheckFields(patch, taskFields(req)); err != nil {
+		problem.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	collection := client.Database("taskmanagement").Collection("tasks")
+	var currentTask Task
+	err = collection.FindOne(tracing.Traced(req), softdelete.NotDeleted(tenant.InOrg(req, bson.M{"_id": objectID}))).Decode(&currentTask)
+	if err != nil {
+		problem.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	if currentTask.Version != version {
+		problem.Error(w, "Task has been modified, fetch it again and retry", http.StatusPreconditionFailed)
+		return
+	}
+
+	patched := currentTask
+	if err := mergepatch.Into(&patched, patch); err != nil {
+		problem.Validation(w, http.StatusBadRequest, validate.JSONErrors(err))
+		return
+	}
+	if errs := validateTask(patched); len(errs) > 0 {
+		problem.Validation(w, http.StatusUnprocessableEntity, errs)
+		return
+	}
+	if _, ok := patch["project_id"]; ok {
+		if errs := projectErrors(req, patched.ProjectID); errs != nil {
+			problem.Validation(w, http.StatusUnprocessableEntity, errs)
+			return
+		}
+	}
+	if patched.AssignedTo != currentTask.AssignedTo {
+		if errs := assigneeErrors(req, patched.AssignedTo); errs != nil {
+			problem.Validation(w, http.StatusUnprocessableEntity, errs)
+			return
+		}
+	}
+
+	patched.Version = version + 1
+	result, err := collection.ReplaceOne(tracing.Traced(req), concurrency.MatchVersion(softdelete.NotDeleted(tenant.InOrg(req, bson.M{"_id": objectID})), version), patched)
+	if err != nil {
+		problem.Error(w, "Failed to update task", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		status, message := concurrency.Conflict(collection, tenant.InOrg(req, bson.M{"_id": objectID}))
+		problem.Error(w, "Task "+message, status)
+		return
+	}
+
+	publishStatusChange(req, currentTask, patched)
+	recordAudit(req, "update", taskID, currentTask, patched)
+
+	w.Header().Set("ETag", concurrency.ETag(patched.Version))
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// validateTask checks a complete task against the task schema.
+func validateTask(task Task) validate.Errors {
+	var errs validate.Errors
+	if errs.Required("title", task.Title) {
+		errs.Length("title", task.Title, 1, 200)
+	}
+	errs.Length("description", task.Description, 0, 2000)
+	if errs.Required("status", task.Status) {
+		errs.Length("status", task.Status, 1, 50)
+	}
+	errs.AtLeast("hours", task.Hours, 0)
+
+	if task.StartDate.IsZero() {
+		errs.Add("start_date", "is required")
+	}
+	if task.EndDate.IsZero() {
+		errs.Add("end_date", "is required")
+	}
+	if !task.StartDate.IsZero() && !task.EndDate.IsZero() && !task.EndDate.After(task.StartDate) {
+		errs.Add("end_date", "must be after start_date")
+	}
+	// Completing a task raises an invoice, which has to be billed to someone
+	if task.Status == "done" && task.AssignedTo.IsZero() {
+		errs.Add("assigned_to", "is required to complete a task")
+	}
+	if task.ParentTask != nil && *task.ParentTask == task.ID {
+		errs.Add("parent_task", "cannot be the task itself")
+	}
+	return errs
+}
+
+// publishStatusChange announces a task's status transition, including
+// completion, on the event bus. It is called once the transition has been
+// written, with the task as written. The billing service invoices completed
+// tasks from their task.completed event, at the rate of the task's project.
+func publishStatusChange(req *http.Request, before, after Task) {
+	if after.Status == before.Status {
+		return
+	}
+	publishEvent("task.status_changed", map[string]interface{}{
+		"task_id":    after.ID,
+		"org_id":     after.OrgID,
+		"old_status": before.Status,
+		"new_status": after.Status,
+	})
+	if after.Status == "done" {
+		publishEvent("task.completed", map[string]interface{}{
+			"task_id":     after.ID,
+			"org_id":      after.OrgID,
+			"project_id":  after.ProjectID,
+			"assigned_to": after.AssignedTo,
+			"hours":       after.Hours,
+			"rate":        taskRate(req, after),
+		})
+	}
+}
+
 func removeTask(w http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodDelete {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	taskID := req.URL.Path[len("/tasks/remove/"):]
 	objectID, err := primitive.ObjectIDFromHex(taskID)
 	if err != nil {
-		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		problem.Error(w, "Invalid task ID", http.StatusBadRequest)
 		return
 	}
 
 	collection := client.Database("taskmanagement").Collection("tasks")
-	filter := bson.M{"_id": objectID}
+	filter := tenant.InOrg(req, bson.M{"_id": objectID})
+	before := loadTask(objectID)
 
-	_, err = collection.DeleteOne(context.TODO(), filter)
+	result, err := softdelete.Delete(req, collection, filter)
 	if err != nil {
-		http.Error(w, "Failed to remove task", http.StatusInternalServerError)
+		problem.Error(w, "Failed to remove task", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		problem.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(req, "delete", taskID, before, loadTask(objectID))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func restoreTask(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	taskID := req.URL.Path[len("/tasks/restore/"):]
+	objectID, err := primitive.ObjectIDFromHex(taskID)
+	if err != nil {
+		problem.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	collection := client.Database("taskmanagement").Collection("tasks")
+	before := loadTask(objectID)
+	result, err := softdelete.Restore(collection, tenant.InOrg(req, bson.M{"_id": objectID}))
+	if err != nil {
+		problem.Error(w, "Failed to restore task", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		problem.Error(w, "Deleted task not found", http.StatusNotFound)
 		return
 	}
 
+	recordAudit(req, "restore", taskID, before, loadTask(objectID))
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func listTasks(w http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	filter, ok := projectFilter(w, req, softdelete.Scope(req, tenant.InOrg(req, bson.M{})))
+	if !ok {
+		return
+	}
 	collection := client.Database("taskmanagement").Collection("tasks")
-	cursor, err := collection.Find(context.TODO(), bson.M{})
+	cursor, err := collection.Find(tracing.Traced(req), filter)
 	if err != nil {
-		http.Error(w, "Failed to list tasks", http.StatusInternalServerError)
+		problem.Error(w, "Failed to list tasks", http.StatusInternalServerError)
 		return
 	}
 	defer cursor.Close(context.Background())
@@ -325,7 +690,7 @@ func listTasks(w http.ResponseWriter, req *http.Request) {
 	var tasks []Task
 	err = cursor.All(context.Background(), &tasks)
 	if err != nil {
-		http.Error(w, "Failed to decode tasks", http.StatusInternalServerError)
+		problem.Error(w, "Failed to decode tasks", http.StatusInternalServerError)
 		return
 	}
 
@@ -337,23 +702,26 @@ func listTasksByUser(w http.ResponseWriter, req *http.Request) {
 	userID := req.URL.Path[len("/tasks/listByUser/"):] // Assuming the endpoint is like /tasks/listByUser/<UserID>
 	objectID, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		problem.Error(w, "Invalid user ID", http.StatusBadRequest)
 		return
 	}
 
-	filter := bson.M{"assigned_to": objectID}
+	filter, ok := projectFilter(w, req, softdelete.Scope(req, tenant.InOrg(req, bson.M{"assigned_to": objectID})))
+	if !ok {
+		return
+	}
 
 	collection := client.Database("taskmanagement").Collection("tasks")
-	cursor, err := collection.Find(context.TODO(), filter)
+	cursor, err := collection.Find(tracing.Traced(req), filter)
 	if err != nil {
-		http.Error(w, "Failed to list tasks", http.StatusInternalServerError)
+		problem.Error(w, "Failed to list tasks", http.StatusInternalServerError)
 		return
 	}
 	defer cursor.Close(context.Background())
 
 	var tasks []Task
 	if err = cursor.All(context.Background(), &tasks); err != nil {
-		http.Error(w, "Failed to decode tasks", http.StatusInternalServerError)
+		problem.Error(w, "Failed to decode tasks", http.StatusInternalServerError)
 		return
 	}
 
@@ -361,68 +729,145 @@ func listTasksByUser(w http.ResponseWriter, req *http.Request) {
 	json.NewEncoder(w).Encode(tasks)
 }
 
-func removeAllTasks(w http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodDelete {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// projectFilter restricts a task listing to the project in ?project_id=,
+// answering the request if the ID is invalid.
+func projectFilter(w http.ResponseWriter, req *http.Request, filter bson.M) (bson.M, bool) {
+	value := req.URL.Query().Get("project_id")
+	if value == "" {
+		return filter, true
 	}
-
-	collection := client.Database("taskmanagement").Collection("tasks")
-
-	_, err := collection.DeleteMany(context.TODO(), bson.M{})
+	projectID, err := primitive.ObjectIDFromHex(value)
 	if err != nil {
-		http.Error(w, "Failed to remove all tasks", http.StatusInternalServerError)
-		return
+		problem.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return nil, false
 	}
+	filter["project_id"] = projectID
+	return filter, true
 }
 
-func createInvoiceInBillingService(task Task) (primitive.ObjectID, error) {
-    hourlyRate := 100.0  // Ensure this is defined or passed correctly
-    amount := task.Hours * hourlyRate
+// loadTask returns the task with the given ID, including a soft-deleted
+// one, or nil if it does not exist.
+func loadTask(objectID primitive.ObjectID) *Task {
+	var task Task
+	err := client.Database("taskmanagement").Collection("tasks").FindOne(context.TODO(), bson.M{"_id": objectID}).Decode(&task)
+	if err != nil {
+		return nil
+	}
+	return &task
+}
 
-    billing := Billing{
-        UserID: task.AssignedTo,
-        TaskID: task.ID,
-        Hours:  task.Hours,
-        Amount: amount,
-    }
+// startConsumers subscribes the task service to events from the other services.
+func startConsumers() error {
+	types := []string{"user.deactivated", "invoice.created", tenant.GrantedEvent, tenant.RevokedEvent}
+	return bus.Subscribe(server.Background(), "task-service", types, func(ctx context.Context, event eventbus.Event) error {
+		switch event.Type {
+		case tenant.GrantedEvent:
+			return handleMembershipGranted(ctx, event)
+		case tenant.RevokedEvent:
+			return handleMembershipRevoked(ctx, event)
+		case "user.deactivated":
+			return handleUserDeactivated(ctx, event)
+		case "invoice.created":
+			return handleInvoiceCreated(ctx, event)
+		}
+		return nil
+	})
+}
 
-    jsonData, err := json.Marshal(billing)
-    if err != nil {
-        log.Printf("Error marshalling invoice data: %v", err)
-        return primitive.NilObjectID, err
-    }
+// handleInvoiceCreated links a completed task to the invoice the billing
+// service raised for it.
+func handleInvoiceCreated(ctx context.Context, event eventbus.Event) error {
+	var data struct {
+		ID     primitive.ObjectID `json:"id"`
+		TaskID primitive.ObjectID `json:"task_id"`
+	}
+	if err := json.Unmarshal(event.Data, &data); err != nil {
+		log.Printf("Ignoring malformed invoice.created event %s: %v", event.ID, err)
+		return nil
+	}
 
-    req, err := http.NewRequest("POST", "http://api-gateway:8000/billings/createForTaskService", bytes.NewBuffer(jsonData))
-    if err != nil {
-        log.Printf("Error creating request: %v", err)
-        return primitive.NilObjectID, err
-    }
-    req.Header.Set("Content-Type", "application/json")
-    req.Header.Set("X-Task-Service", "your-task-service-secret")
+	// A redelivered event finds the task already linked and changes nothing
+	filter := bson.M{"_id": data.TaskID, "invoice_id": bson.M{"$ne": data.ID}}
+	update := concurrency.BumpVersion(bson.M{"$set": bson.M{"invoice_id": data.ID}})
+	_, err := client.Database("taskmanagement").Collection("tasks").UpdateOne(ctx, filter, update)
+	return err
+}
 
-    log.Printf("Sending request to billing service with headers: %+v and body: %s", req.Header, jsonData)
+// handleUserDeactivated hands the open tasks of a removed user over to the
+// reassignment target, or unassigns them, and reports the affected tasks.
+// Tasks of organizations the target does not belong to are unassigned and
+// reported as skipped.
+func handleUserDeactivated(ctx context.Context, event eventbus.Event) error {
+	var data struct {
+		UserID     primitive.ObjectID  `json:"user_id"`
+		ReassignTo *primitive.ObjectID `json:"reassign_to"`
+	}
+	if err := json.Unmarshal(event.Data, &data); err != nil {
+		log.Printf("Ignoring malformed user.deactivated event %s: %v", event.ID, err)
+		return nil
+	}
 
-    client := &http.Client{}
-    resp, err := client.Do(req)
-    if err != nil {
-        log.Printf("Error sending request to billing service: %v", err)
-        return primitive.NilObjectID, err
-    }
-    defer resp.Body.Close()
+	collection := client.Database("taskmanagement").Collection("tasks")
+	filter := softdelete.NotDeleted(bson.M{"assigned_to": data.UserID, "status": bson.M{"$ne": "done"}})
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var openTasks []Task
+	if err = cursor.All(ctx, &openTasks); err != nil {
+		return err
+	}
 
-    log.Printf("Billing service responded with status: %d", resp.StatusCode)
+	action := "unassigned"
+	if data.ReassignTo != nil {
+		action = "reassigned"
+	}
 
-    if resp.StatusCode != http.StatusOK {
-        log.Printf("Failed to create invoice, billing service responded with status: %d", resp.StatusCode)
-        return primitive.NilObjectID, fmt.Errorf("billing service error: %d", resp.StatusCode)
-    }
+	affected := make([]string, 0, len(openTasks))
+	skipped := make([]string, 0)
+	reassigned := make([]primitive.ObjectID, 0, len(openTasks))
+	unassigned := make([]primitive.ObjectID, 0)
+	member := map[primitive.ObjectID]bool{}
+	for _, task := range openTasks {
+		affected = append(affected, task.ID.Hex())
+		if data.ReassignTo == nil {
+			unassigned = append(unassigned, task.ID)
+			continue
+		}
+		ok, seen := member[task.OrgID]
+		if !seen {
+			if ok, err = isMember(ctx, task.OrgID, *data.ReassignTo); err != nil {
+				return err
+			}
+			member[task.OrgID] = ok
+		}
+		if ok {
+			reassigned = append(reassigned, task.ID)
+		} else {
+			unassigned = append(unassigned, task.ID)
+			skipped = append(skipped, task.ID.Hex())
+		}
+	}
 
-    var createdBilling Billing
-    if err := json.NewDecoder(resp.Body).Decode(&createdBilling); err != nil {
-        log.Printf("Error decoding response from billing service: %v", err)
-        return primitive.NilObjectID, err
-    }
+	if len(reassigned) > 0 {
+		_, err = collection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": reassigned}}, concurrency.BumpVersion(bson.M{"$set": bson.M{"assigned_to": *data.ReassignTo}}))
+		if err != nil {
+			return err
+		}
+	}
+	if len(unassigned) > 0 {
+		_, err = collection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": unassigned}}, concurrency.BumpVersion(bson.M{"$set": bson.M{"assigned_to": primitive.NilObjectID}}))
+		if err != nil {
+			return err
+		}
+	}
 
-    return createdBilling.ID, nil
+	log.Printf("%s %d open task(s) of deactivated user %s, %d skipped", action, len(affected), data.UserID.Hex(), len(skipped))
+	publishEvent("user.cascade_completed", map[string]interface{}{
+		"user_id":      data.UserID,
+		"action":       action,
+		"affected_ids": affected,
+		"skipped_ids":  skipped,
+	})
+	return nil
 }
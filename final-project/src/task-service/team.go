@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/concurrency"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/mergepatch"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/softdelete"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tenant"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/validate"
+)
+
+// Teams are named groups of an organization's users, so a whole team can
+// be made a member of a project at once. Every member of the organization
+// can see its teams; org admins manage them.
+
+type Team struct {
+	ID        primitive.ObjectID   `bson:"_id" json:"id"`
+	OrgID     primitive.ObjectID   `bson:"org_id" json:"org_id"`
+	Name      string               `bson:"name" json:"name"`
+	Members   []primitive.ObjectID `bson:"members" json:"members"`
+	DeletedAt *time.Time           `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	DeletedBy string               `bson:"deleted_by,omitempty" json:"deleted_by,omitempty"`
+	Version   int64                `bson:"version" json:"version"`
+}
+
+// Fields org admins may change with PATCH.
+var teamPatchFields = map[string]bool{"name": true, "members": true}
+
+func teams() *mongo.Collection {
+	return client.Database("taskmanagement").Collection("teams")
+}
+
+// loadTeam returns the team with the given ID in the request's
+// organization, including a soft-deleted one, or nil.
+func loadTeam(req *http.Request, objectID primitive.ObjectID) *Team {
+	var team Team
+	err := teams().FindOne(tracing.Traced(req), tenant.InOrg(req, bson.M{"_id": objectID})).Decode(&team)
+	if err != nil {
+		return nil
+	}
+	return &team
+}
+
+func validateTeam(team Team) validate.Errors {
+	var errs validate.Errors
+	if errs.Required("name", team.Name) {
+		errs.Length("name", team.Name, 1, 100)
+	}
+	return errs
+}
+
+func createTeam(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var team Team
+	if errs := validate.DecodeBody(req, &team); errs != nil {
+		problem.Validation(w, http.StatusBadRequest, errs)
+		return
+	}
+	team.ID = primitive.NewObjectID()
+	team.OrgID = tenant.Org(req)
+	team.Members = uniqueIDs(team.Members)
+	team.DeletedAt, team.DeletedBy = nil, ""
+	if errs := validateTeam(team); len(errs) > 0 {
+		problem.Validation(w, http.StatusUnprocessableEntity, errs)
+		return
+	}
+
+	team.Version = 1
+	if _, err := teams().InsertOne(tracing.Traced(req), team); err != nil {
+		log.Printf("Failed to create team: %v", err)
+		problem.Error(w, "Failed to create team", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(req, "team_create", team.ID.Hex(), nil, team)
+
+	log.Printf("Team created: %s", team.ID.Hex())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", concurrency.ETag(team.Version))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(team)
+}
+
+func listTeams(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cursor, err := teams().Find(tracing.Traced(req), softdelete.Scope(req, tenant.InOrg(req, bson.M{})))
+	if err != nil {
+		problem.Error(w, "Failed to list teams", http.StatusInternalServerError)
+		return
+	}
+	list := []Team{}
+	if err := cursor.All(tracing.Traced(req), &list); err != nil {
+		problem.Error(w, "Failed to decode teams", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func getTeam(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/teams/get/"):])
+	if err != nil {
+		problem.Error(w, "Invalid team ID", http.StatusBadRequest)
+		return
+	}
+	var team Team
+	err = teams().FindOne(tracing.Traced(req), softdelete.Scope(req, tenant.InOrg(req, bson.M{"_id": objectID}))).Decode(&team)
+	if err != nil {
+		problem.Error(w, "Team not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", concurrency.ETag(team.Version))
+	json.NewEncoder(w).Encode(team)
+}
+
+// patchTeam applies a JSON merge patch to a team in one versioned replace.
+func patchTeam(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPatch {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	teamID := req.URL.Path[len("/teams/update/"):]
+	objectID, err := primitive.ObjectIDFromHex(teamID)
+	if err != nil {
+		problem.Error(w, "Invalid team ID", http.StatusBadRequest)
+		return
+	}
+
+	version, status, err := concurrency.IfMatch(req)
+	if err != nil {
+		problem.Error(w, err.Error(), status)
+		return
+	}
+
+	patch, err := mergepatch.Decode(req)
+	if err != nil {
+		problem.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := mergepatch.CheckFields(patch, teamPatchFields); err != nil {
+		problem.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var current Team
+	err = teams().FindOne(tracing.Traced(req), softdelete.NotDeleted(tenant.InOrg(req, bson.M{"_id": objectID}))).Decode(&current)
+	if err != nil {
+		problem.Error(w, "Team not found", http.StatusNotFound)
+		return
+	}
+	if current.Version != version {
+		problem.Error(w, "Team has been modified, fetch it again and retry", http.StatusPreconditionFailed)
+		return
+	}
+
+	patched := current
+	if err := mergepatch.Into(&patched, patch); err != nil {
+		problem.Validation(w, http.StatusBadRequest, validate.JSONErrors(err))
+		return
+	}
+	patched.Members = uniqueIDs(patched.Members)
+	if errs := validateTeam(patched); len(errs) > 0 {
+		problem.Validation(w, http.StatusUnprocessableEntity, errs)
+		return
+	}
+
+	patched.Version = version + 1
+	filter := concurrency.MatchVersion(softdelete.NotDeleted(tenant.InOrg(req, bson.M{"_id": objectID})), version)
+	result, err := teams().ReplaceOne(tracing.Traced(req), filter, patched)
+	if err != nil {
+		problem.Error(w, "Failed to update team", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		status, message := concurrency.Conflict(teams(), tenant.InOrg(req, bson.M{"_id": objectID}))
+		problem.Error(w, "Team "+message, status)
+		return
+	}
+	recordAudit(req, "team_update", teamID, current, patched)
+
+	w.Header().Set("ETag", concurrency.ETag(patched.Version))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeTeam soft-deletes a team. Projects keep it among their teams, so
+// restoring it brings it back everywhere.
+func removeTeam(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodDelete {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	teamID := req.URL.Path[len("/teams/remove/"):]
+	objectID, err := primitive.ObjectIDFromHex(teamID)
+	if err != nil {
+		problem.Error(w, "Invalid team ID", http.StatusBadRequest)
+		return
+	}
+
+	before := loadTeam(req, objectID)
+	result, err := softdelete.Delete(req, teams(), tenant.InOrg(req, bson.M{"_id": objectID}))
+	if err != nil {
+		problem.Error(w, "Failed to remove team", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		problem.Error(w, "Team not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(req, "team_delete", teamID, before, loadTeam(req, objectID))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func restoreTeam(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	teamID := req.URL.Path[len("/teams/restore/"):]
+	objectID, err := primitive.ObjectIDFromHex(teamID)
+	if err != nil {
+		problem.Error(w, "Invalid team ID", http.StatusBadRequest)
+		return
+	}
+
+	before := loadTeam(req, objectID)
+	result, err := softdelete.Restore(teams(), tenant.InOrg(req, bson.M{"_id": objectID}))
+	if err != nil {
+		problem.Error(w, "Failed to restore team", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		problem.Error(w, "Deleted team not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(req, "team_restore", teamID, before, loadTeam(req, objectID))
+
+	w.WriteHeader(http.StatusNoContent)
+}
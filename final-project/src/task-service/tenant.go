@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/eventbus"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tenant"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/validate"
+)
+
+// Every task belongs to the organization it was created in. The task
+// routes take a token naming an organization in its org_id claim, and
+// every query they run is scoped to it with tenant.InOrg, so organizations
+// never see or change each other's tasks. Admins of the organization have
+// admin rights here, until the user service revokes their role. Tasks are
+// only assigned to members of their organization, which the service keeps
+// its own list of from the user service's membership events.
+
+// ensureTenancy indexes tasks, projects, teams and members by
+// organization and moves tasks without one into the default organization.
+func ensureTenancy(client *mongo.Client) error {
+	db := client.Database("taskmanagement")
+	collection := db.Collection("tasks")
+	_, err := collection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "org_id", Value: 1}, {Key: "assigned_to", Value: 1}},
+			Options: options.Index().SetName("org_assigned_to"),
+		},
+		{
+			Keys:    bson.D{{Key: "org_id", Value: 1}, {Key: "project_id", Value: 1}},
+			Options: options.Index().SetName("org_project_id"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"projects", "teams"} {
+		_, err = db.Collection(name).Indexes().CreateOne(context.Background(), mongo.IndexModel{
+			Keys:    bson.D{{Key: "org_id", Value: 1}},
+			Options: options.Index().SetName("org_id"),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.Collection("members").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "org_id", Value: 1}, {Key: "user_id", Value: 1}},
+		Options: options.Index().SetName("org_user_unique").SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = collection.UpdateMany(context.Background(),
+		bson.M{"org_id": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"org_id": tenant.DefaultOrgID}})
+	return err
+}
+
+// tenants holds the membership revocations that tenantMiddleware checks.
+var tenants *tenant.Revocations
+
+// tenantMiddleware authenticates the request and scopes it to the
+// organization its token names; see tenant.Revocations.Middleware.
+func tenantMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(tenants.Middleware(next))
+}
+
+func members() *mongo.Collection {
+	return client.Database("taskmanagement").Collection("members")
+}
+
+// membershipEvent is the payload of the user service's membership events.
+type membershipEvent struct {
+	OrgID  primitive.ObjectID `json:"org_id"`
+	UserID primitive.ObjectID `json:"user_id"`
+	Role   string             `json:"role"`
+}
+
+// handleMembershipGranted adds the user to the organization's members.
+func handleMembershipGranted(ctx context.Context, event eventbus.Event) error {
+	var data membershipEvent
+	if err := json.Unmarshal(event.Data, &data); err != nil {
+		log.Printf("Ignoring malformed %s event %s: %v", event.Type, event.ID, err)
+		return nil
+	}
+	member := bson.M{"org_id": data.OrgID, "user_id": data.UserID}
+	_, err := members().UpdateOne(ctx, member, bson.M{"$set": member}, options.Update().SetUpsert(true))
+	return err
+}
+
+// handleMembershipRevoked records the revocation and removes users who have
+// left the organization from its members.
+func handleMembershipRevoked(ctx context.Context, event eventbus.Event) error {
+	if err := tenants.Handle(ctx, event); err != nil {
+		return err
+	}
+	var data membershipEvent
+	if err := json.Unmarshal(event.Data, &data); err != nil || data.Role != "" {
+		return nil
+	}
+	_, err := members().DeleteOne(ctx, bson.M{"org_id": data.OrgID, "user_id": data.UserID})
+	return err
+}
+
+// isMember reports whether the user belongs to the organization.
+func isMember(ctx context.Context, orgID, userID primitive.ObjectID) (bool, error) {
+	count, err := members().CountDocuments(ctx, bson.M{"org_id": orgID, "user_id": userID})
+	return count > 0, err
+}
+
+// assigneeErrors checks that a task is assigned to a member of the
+// request's organization, if to anyone.
+func assigneeErrors(req *http.Request, assignee primitive.ObjectID) validate.Errors {
+	if assignee.IsZero() {
+		return nil
+	}
+	if member, err := isMember(tracing.Traced(req), tenant.Org(req), assignee); err != nil || !member {
+		return validate.Errors{{Field: "assigned_to", Message: "must be a member of the organization"}}
+	}
+	return nil
+}
@@ -1,4 +1,11 @@
+import base64
+import hashlib
+import hmac
 import json
+import os
+import re
+import struct
+import time
 import requests
 
 def register_user(role):
@@ -13,6 +20,38 @@ def register_user(role):
     response = requests.post(f"{base_url}/auth/register", headers=headers_json, json=data)
     if response.status_code not in (200, 201):
         print(f"Registration failed for {role}. Status Code: {response.status_code}, Response Text: {response.text}")
+        return False
+    return True
+
+def verification_token(address):
+    """Return the token of the newest verification link Mailpit caught for an address, or None."""
+    response = requests.get(f"{mailpit_url}/api/v1/search", params={"query": f"to:{address}"})
+    if response.status_code != 200:
+        print(f"Failed to read the mail for {address}. Status Code: {response.status_code}, Response Text: {response.text}")
+        return None
+    # Messages are listed newest first; the newest link is the one that works
+    for message in response.json().get('messages', []):
+        body = requests.get(f"{mailpit_url}/api/v1/message/{message['ID']}").json().get('Text', '')
+        match = re.search(r'/verify-email\?token=(\S+)', body)
+        if match:
+            return match.group(1)
+    return None
+
+def verify_user(role):
+    """Verify a user's email address with the link from their verification mail."""
+    address = f"{user_credentials[role]['username']}@example.com"
+    # The mail is sent in the background, so give it a moment to arrive
+    for _ in range(10):
+        token = verification_token(address)
+        if token:
+            break
+        time.sleep(0.5)
+    else:
+        print(f"No verification mail found for {role}.")
+        return
+    response = requests.post(f"{base_url}/auth/verify-email", headers=headers_json, json={"token": token})
+    if response.status_code not in (200, 204):
+        print(f"Verification failed for {role}. Status Code: {response.status_code}, Response Text: {response.text}")
 
 def login_user(role):
     """Login users and store their tokens with error reporting for non-successful outcomes."""
@@ -27,6 +66,10 @@ def login_user(role):
             first_part = response.text.split('\n')[0]
             response_data = json.loads(first_part)
             token = response_data.get('token')
+            if response_data.get('mfa_enrollment_required'):
+                token = enroll_mfa(role, response_data['challenge_token'])
+            elif response_data.get('mfa_required'):
+                token = login_mfa(role, response_data['challenge_token'])
             if token:
                 tokens[role] = token
             else:
@@ -36,6 +79,45 @@ def login_user(role):
     else:
         print(f"Login failed for {role}. Status Code: {response.status_code}, Response Text: {response.text}")
 
+def totp(secret):
+    """Compute the current TOTP code for a base32 secret (RFC 6238, SHA-1, 6 digits, 30 seconds)."""
+    key = base64.b32decode(secret + '=' * (-len(secret) % 8))
+    digest = hmac.new(key, struct.pack('>Q', int(time.time()) // 30), hashlib.sha1).digest()
+    offset = digest[-1] & 0x0f
+    code = struct.unpack('>I', digest[offset:offset + 4])[0] & 0x7fffffff
+    return f"{code % 1000000:06d}"
+
+def enroll_mfa(role, challenge_token):
+    """Enroll a user who has to set up MFA before logging in, returning their token."""
+    headers = headers_json.copy()
+    headers['Authorization'] = f"Bearer {challenge_token}"
+    response = requests.post(f"{base_url}/users/mfa/enroll", headers=headers)
+    if response.status_code != 200:
+        print(f"MFA enrollment failed for {role}. Status Code: {response.status_code}, Response Text: {response.text}")
+        return None
+    secret = response.json()['secret']
+    response = requests.post(f"{base_url}/users/mfa/confirm", headers=headers, json={"code": totp(secret)})
+    if response.status_code != 200:
+        print(f"MFA confirmation failed for {role}. Status Code: {response.status_code}, Response Text: {response.text}")
+        return None
+    # Later runs log in with a code, which needs the secret
+    print(f"MFA enabled for {role}; rerun with TASK_{role.upper()}_TOTP_SECRET={secret}")
+    mfa_secrets[role] = secret
+    return response.json().get('token')
+
+def login_mfa(role, challenge_token):
+    """Answer a login's MFA challenge with a code for the user's secret, returning their token."""
+    secret = mfa_secrets.get(role)
+    if not secret:
+        print(f"{role} has MFA enabled; set TASK_{role.upper()}_TOTP_SECRET to log in.")
+        return None
+    data = {"challenge_token": challenge_token, "code": totp(secret)}
+    response = requests.post(f"{base_url}/auth/login/mfa", headers=headers_json, json=data)
+    if response.status_code != 200:
+        print(f"MFA login failed for {role}. Status Code: {response.status_code}, Response Text: {response.text}")
+        return None
+    return response.json().get('token')
+
 def create_user():
     """Create a new user by an admin with error reporting for non-successful outcomes."""
     data = {"username": "newuser", "email": "newuser@example.com", "password": "newuserpass"}
@@ -54,19 +136,31 @@ def list_users():
 
 # User credentials and base configuration
 base_url = "http://localhost:8000"
+# Mailpit catches the mail the user service sends in docker-compose
+mailpit_url = os.environ.get('MAILPIT_URL', "http://localhost:8025")
 headers_json = {'Content-Type': 'application/json'}
 user_credentials = {
     'regular': {'username': 'regular_user', 'password': 'regular_pass'},
     'admin': {'username': 'admin_user', 'password': 'admin_pass'}
 }
 tokens = {}
+# Admins have to use MFA; their TOTP secrets are set once they have enrolled
+mfa_secrets = {role: os.environ[f"TASK_{role.upper()}_TOTP_SECRET"]
+               for role in user_credentials if os.environ.get(f"TASK_{role.upper()}_TOTP_SECRET")}
 
 # Execution of the registration and login tests
-register_user('regular')
-register_user('admin')
+# Unverified users cannot log in, so new users follow their verification link
+for role in ('regular', 'admin'):
+    if register_user(role):
+        verify_user(role)
 
 login_user('regular')
-login_user('admin')
+# A personal access token with the admin scope stands in for the admin's
+# password: TASK_ADMIN_TOKEN=tm_pat_... python test.py
+if os.environ.get('TASK_ADMIN_TOKEN'):
+    tokens['admin'] = os.environ['TASK_ADMIN_TOKEN']
+else:
+    login_user('admin')
 
 # Admin operations
 create_user()
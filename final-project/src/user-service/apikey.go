@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/audit"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/auth"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/validate"
+)
+
+// Scripts authenticate with personal access tokens or service API keys
+// instead of a password. A personal access token belongs to a user and
+// works in the organization it was created in; a service API key belongs
+// to an organization, is managed by its admins, and acts on behalf of the
+// admin who created it. Both expire, and are limited to their scopes:
+// read allows safe methods, write allows every method, and admin keeps the
+// user's admin rights, which keys otherwise drop.
+//
+// Only a hash of a key is stored; the key itself is shown once, when it is
+// created. The gateway accepts keys in place of a JWT and exchanges them
+// here, on a route it does not expose, for a short-lived JWT carrying the
+// key's scopes. Every exchange records when the key was last used.
+
+const (
+	keyKindPersonal = "personal"
+	keyKindService  = "service"
+
+	scopeRead  = "read"
+	scopeWrite = "write"
+	scopeAdmin = "admin"
+
+	defaultKeyLifetimeDays = 90
+	maxKeyLifetimeDays     = 365
+	// exchangedTokenTTL is how long the JWT a key is exchanged for lasts
+	exchangedTokenTTL = 5 * time.Minute
+	// expiredKeyRetention is how long expired keys stay listed
+	expiredKeyRetention = 30 * 24 * time.Hour
+)
+
+// keyPrefixes start every key, so the gateway can tell keys from JWTs.
+var keyPrefixes = map[string]string{
+	keyKindPersonal: "tm_pat_",
+	keyKindService:  "tm_key_",
+}
+
+type APIKey struct {
+	ID         primitive.ObjectID `bson:"_id" json:"id"`
+	Kind       string             `bson:"kind" json:"kind"`
+	Name       string             `bson:"name" json:"name"`
+	Prefix     string             `bson:"prefix" json:"prefix"`
+	TokenHash  string             `bson:"token_hash" json:"-"`
+	UserID     primitive.ObjectID `bson:"user_id" json:"user_id"`
+	OrgID      primitive.ObjectID `bson:"org_id" json:"org_id"`
+	Scopes     []string           `bson:"scopes" json:"scopes"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt  time.Time          `bson:"expires_at" json:"expires_at"`
+	LastUsedAt *time.Time         `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time         `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+	RevokedBy  string             `bson:"revoked_by,omitempty" json:"revoked_by,omitempty"`
+}
+
+// CreatedAPIKey is a new key, the only time the key itself is returned.
+type CreatedAPIKey struct {
+	APIKey
+	Token string `json:"token"`
+}
+
+type newAPIKey struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+// ExchangedToken is the JWT the gateway forwards in place of a key.
+type ExchangedToken struct {
+	Token     string   `json:"token"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int      `json:"expires_in"`
+}
+
+func apiKeys() *mongo.Collection {
+	return client.Database("user").Collection("api_keys")
+}
+
+// ensureAPIKeyIndexes indexes keys by hash and owner, and drops keys some
+// time after they expire.
+func ensureAPIKeyIndexes(client *mongo.Client) error {
+	_, err := client.Database("user").Collection("api_keys").Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetName("token_hash_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "kind", Value: 1}, {Key: "user_id", Value: 1}},
+			Options: options.Index().SetName("kind_user_id"),
+		},
+		{
+			Keys:    bson.D{{Key: "kind", Value: 1}, {Key: "org_id", Value: 1}},
+			Options: options.Index().SetName("kind_org_id"),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(int32(expiredKeyRetention.Seconds())),
+		},
+	})
+	return err
+}
+
+func hashAPIKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// loginOnly refuses requests made with an API key. It guards the routes
+// that manage keys, MFA or accounts, or hand out a JWT, so a leaked key
+// can neither outlive its revocation nor step outside its scopes.
+func loginOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if claims := auth.Claims(req); claims != nil && claims["key_id"] != nil {
+			problem.Error(w, "Not allowed with an API key, log in instead", http.StatusForbidden)
+			return
+		}
+		next(w, req)
+	}
+}
+
+// keyCreator returns the requesting user and the organization of their
+// token.
+func keyCreator(w http.ResponseWriter, req *http.Request) (*User, primitive.ObjectID, bool) {
+	claims := auth.Claims(req)
+	user := currentUser(req)
+	if user == nil {
+		problem.Error(w, "User not found", http.StatusNotFound)
+		return nil, primitive.NilObjectID, false
+	}
+	orgID, err := primitive.ObjectIDFromHex(fmt.Sprint(claims["org_id"]))
+	if err != nil {
+		problem.Error(w, "Token does not name an organization, log in again", http.StatusForbidden)
+		return nil, primitive.NilObjectID, false
+	}
+	return user, orgID, true
+}
+
+// createAPIKey validates a key request and stores the key, answering the
+// request with it. orgRole is the creator's role in the organization.
+func createAPIKey(w http.ResponseWriter, req *http.Request, kind string, user *User, orgID primitive.ObjectID, orgRole string) {
+	var body newAPIKey
+	if errs := validate.DecodeBody(req, &body); errs != nil {
+		problem.Validation(w, http.StatusBadRequest, errs)
+		return
+	}
+	if body.ExpiresInDays == 0 {
+		body.ExpiresInDays = defaultKeyLifetimeDays
+	}
+
+	var errs validate.Errors
+	if errs.Required("name", body.Name) {
+		errs.Length("name", body.Name, 1, 100)
+	}
+	scopes := []string{}
+	for _, scope := range body.Scopes {
+		errs.OneOf("scopes", scope, scopeRead, scopeWrite, scopeAdmin)
+		if !hasScope(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if !hasScope(scopes, scopeRead) && !hasScope(scopes, scopeWrite) {
+		errs.Add("scopes", "must include read or write")
+	}
+	if hasScope(scopes, scopeAdmin) && user.Role != "admin" && orgRole != orgRoleAdmin {
+		errs.Add("scopes", "may only include admin for admins")
+	}
+	if body.ExpiresInDays < 1 || body.ExpiresInDays > maxKeyLifetimeDays {
+		errs.Add("expires_in_days", "must be between 1 and %d", maxKeyLifetimeDays)
+	}
+	if len(errs) > 0 {
+		problem.Validation(w, http.StatusUnprocessableEntity, errs)
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		problem.Error(w, "Failed to generate key", http.StatusInternalServerError)
+		return
+	}
+	token := keyPrefixes[kind] + base64.RawURLEncoding.EncodeToString(secret)
+	now := time.Now().UTC()
+	key := APIKey{
+		ID:        primitive.NewObjectID(),
+		Kind:      kind,
+		Name:      strings.TrimSpace(body.Name),
+		Prefix:    token[:len(keyPrefixes[kind])+6],
+		TokenHash: hashAPIKey(token),
+		UserID:    user.ID,
+		OrgID:     orgID,
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.AddDate(0, 0, body.ExpiresInDays),
+	}
+	if _, err := apiKeys().InsertOne(tracing.Traced(req), key); err != nil {
+		log.Printf("Failed to create %s key: %v", kind, err)
+		problem.Error(w, "Failed to create key", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(req, kind+"_key_create", key.ID.Hex(), nil, key)
+
+	log.Printf("Created %s key %s for user %s", kind, key.ID.Hex(), user.ID.Hex())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreatedAPIKey{APIKey: key, Token: token})
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// listAPIKeys answers with the keys matching the filter, newest first,
+// including revoked and recently expired ones.
+func listAPIKeys(w http.ResponseWriter, filter bson.M) {
+	cursor, err := apiKeys().Find(context.TODO(), filter,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		problem.Error(w, "Failed to list keys", http.StatusInternalServerError)
+		return
+	}
+	keys := []APIKey{}
+	if err := cursor.All(context.TODO(), &keys); err != nil {
+		problem.Error(w, "Failed to decode keys", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// revokeAPIKey revokes the key with the ID at the end of the path if it
+// matches the filter.
+func revokeAPIKey(w http.ResponseWriter, req *http.Request, prefix string, filter bson.M) {
+	keyID := req.URL.Path[len(prefix):]
+	objectID, err := primitive.ObjectIDFromHex(keyID)
+	if err != nil {
+		problem.Error(w, "Invalid key ID", http.StatusBadRequest)
+		return
+	}
+	filter["_id"] = objectID
+	filter["revoked_at"] = bson.M{"$exists": false}
+
+	actor, _ := audit.Actor(req)
+	var key APIKey
+	err = apiKeys().FindOneAndUpdate(tracing.Traced(req), filter,
+		bson.M{"$set": bson.M{"revoked_at": time.Now().UTC(), "revoked_by": actor}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		problem.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		problem.Error(w, "Failed to revoke key", http.StatusInternalServerError)
+		return
+	}
+	before := key
+	before.RevokedAt, before.RevokedBy = nil, ""
+	recordAudit(req, key.Kind+"_key_revoke", keyID, before, key)
+
+	log.Printf("Revoked %s key %s", key.Kind, keyID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listPersonalTokens(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to list personal access tokens")
+
+	if req.Method != http.MethodGet {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, _, ok := keyCreator(w, req)
+	if !ok {
+		return
+	}
+	listAPIKeys(w, bson.M{"kind": keyKindPersonal, "user_id": user.ID})
+}
+
+// createPersonalToken creates a personal access token for the
+// organization of the request's token.
+func createPersonalToken(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to create a personal access token")
+
+	if req.Method != http.MethodPost {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, orgID, ok := keyCreator(w, req)
+	if !ok {
+		return
+	}
+	role := ""
+	if membership := membershipOf(orgID, user.ID); membership != nil {
+		role = membership.Role
+	}
+	createAPIKey(w, req, keyKindPersonal, user, orgID, role)
+}
+
+func revokePersonalToken(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to revoke a personal access token")
+
+	if req.Method != http.MethodDelete {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, _, ok := keyCreator(w, req)
+	if !ok {
+		return
+	}
+	revokeAPIKey(w, req, "/tokens/revoke/", bson.M{"kind": keyKindPersonal, "user_id": user.ID})
+}
+
+// serviceKeyAdmin returns the requesting user and their organization,
+// answering the request unless they are one of its admins, who manage
+// its service API keys.
+func serviceKeyAdmin(w http.ResponseWriter, req *http.Request) (*User, primitive.ObjectID, bool) {
+	user, orgID, ok := keyCreator(w, req)
+	if !ok {
+		return nil, orgID, false
+	}
+	_, role, ok := orgAccess(w, req, orgID.Hex())
+	if !ok {
+		return nil, orgID, false
+	}
+	if role != orgRoleAdmin {
+		problem.Error(w, "Only org admins can manage service API keys", http.StatusForbidden)
+		return nil, orgID, false
+	}
+	return user, orgID, true
+}
+
+func listServiceKeys(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to list service API keys")
+
+	if req.Method != http.MethodGet {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, orgID, ok := serviceKeyAdmin(w, req)
+	if !ok {
+		return
+	}
+	listAPIKeys(w, bson.M{"kind": keyKindService, "org_id": orgID})
+}
+
+func createServiceKey(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to create a service API key")
+
+	if req.Method != http.MethodPost {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, orgID, ok := serviceKeyAdmin(w, req)
+	if !ok {
+		return
+	}
+	createAPIKey(w, req, keyKindService, user, orgID, orgRoleAdmin)
+}
+
+func revokeServiceKey(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to revoke a service API key")
+
+	if req.Method != http.MethodDelete {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, orgID, ok := serviceKeyAdmin(w, req)
+	if !ok {
+		return
+	}
+	revokeAPIKey(w, req, "/apikeys/revoke/", bson.M{"kind": keyKindService, "org_id": orgID})
+}
+
+// exchangeAPIKey trades a live key for a short-lived JWT. The JWT has the
+// user's rights in the key's organization as they are now, but only keeps
+// admin rights for keys with the admin scope. The gateway calls this for
+// every key it has not exchanged recently; it is not routed from outside.
+func exchangeAPIKey(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	if errs := validate.DecodeBody(req, &body); errs != nil {
+		problem.Validation(w, http.StatusBadRequest, errs)
+		return
+	}
+
+	now := time.Now().UTC()
+	var key APIKey
+	err := apiKeys().FindOneAndUpdate(tracing.Traced(req),
+		bson.M{
+			"token_hash": hashAPIKey(body.Token),
+			"revoked_at": bson.M{"$exists": false},
+			"expires_at": bson.M{"$gt": now},
+		},
+		bson.M{"$set": bson.M{"last_used_at": now}}).Decode(&key)
+	if err != nil {
+		problem.Error(w, "Invalid, expired or revoked API key", http.StatusUnauthorized)
+		return
+	}
+	user := loadUser(key.UserID)
+	if user == nil || user.DeletedAt != nil {
+		problem.Error(w, "The key's user has been deactivated", http.StatusUnauthorized)
+		return
+	}
+	membership := membershipOf(key.OrgID, key.UserID)
+	if membership == nil {
+		problem.Error(w, "The key's user is no longer in its organization", http.StatusUnauthorized)
+		return
+	}
+
+	role, orgRole := "regular", orgRoleMember
+	if hasScope(key.Scopes, scopeAdmin) {
+		role, orgRole = user.Role, membership.Role
+	}
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"userID":   user.ID.Hex(),
+		"role":     role,
+		"org_id":   key.OrgID.Hex(),
+		"org_role": orgRole,
+		"key_id":   key.ID.Hex(),
+		"scopes":   key.Scopes,
+		"iat":      now.Unix(),
+		"exp":      now.Add(exchangedTokenTTL).Unix(),
+	}).SignedString([]byte("your-secret-key"))
+	if err != nil {
+		log.Println("Failed to generate JWT token:", err)
+		problem.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ExchangedToken{
+		Token:     tokenString,
+		Scopes:    key.Scopes,
+		ExpiresIn: int(exchangedTokenTTL.Seconds()),
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/eventbus"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/server"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
+)
+
+// DeactivationReport lists what the other services changed when a user was
+// removed. Each service fills in its own entry once it has processed the
+// user.deactivated event.
+type DeactivationReport struct {
+	UserID        primitive.ObjectID       `bson:"_id" json:"user_id"`
+	DeactivatedAt time.Time                `bson:"deactivated_at" json:"deactivated_at"`
+	DeactivatedBy string                   `bson:"deactivated_by" json:"deactivated_by"`
+	ReassignTo    *primitive.ObjectID      `bson:"reassign_to,omitempty" json:"reassign_to,omitempty"`
+	Services      map[string]CascadeResult `bson:"services" json:"services"`
+}
+
+// CascadeResult is one service's entry in a deactivation report. Skipped
+// IDs are the affected records the service could not hand over to the
+// reassignment target, such as tasks of organizations it does not belong to.
+type CascadeResult struct {
+	Action      string    `bson:"action" json:"action"`
+	AffectedIDs []string  `bson:"affected_ids" json:"affected_ids"`
+	SkippedIDs  []string  `bson:"skipped_ids,omitempty" json:"skipped_ids,omitempty"`
+	CompletedAt time.Time `bson:"completed_at" json:"completed_at"`
+}
+
+func deactivationReports() *mongo.Collection {
+	return client.Database("user").Collection("deactivation_reports")
+}
+
+func startDeactivationReport(userID primitive.ObjectID, deactivatedBy string, at time.Time, reassignTo *primitive.ObjectID) error {
+	report := DeactivationReport{
+		UserID:        userID,
+		DeactivatedAt: at,
+		DeactivatedBy: deactivatedBy,
+		ReassignTo:    reassignTo,
+		Services:      map[string]CascadeResult{},
+	}
+	_, err := deactivationReports().ReplaceOne(context.TODO(), bson.M{"_id": userID}, report, options.Replace().SetUpsert(true))
+	return err
+}
+
+// startConsumers subscribes the user service to events from the other services.
+func startConsumers() error {
+	return bus.Subscribe(server.Background(), "user-service", []string{"user.cascade_completed"}, handleCascadeCompleted)
+}
+
+// handleCascadeCompleted records a service's cascade result in the user's
+// report. Affected and skipped IDs are merged so a redelivered event does
+// not lose them.
+func handleCascadeCompleted(ctx context.Context, event eventbus.Event) error {
+	var data struct {
+		UserID      primitive.ObjectID `json:"user_id"`
+		Action      string             `json:"action"`
+		AffectedIDs []string           `json:"affected_ids"`
+		SkippedIDs  []string           `json:"skipped_ids"`
+	}
+	if err := json.Unmarshal(event.Data, &data); err != nil {
+		log.Printf("Ignoring malformed user.cascade_completed event %s: %v", event.ID, err)
+		return nil
+	}
+	if data.AffectedIDs == nil {
+		data.AffectedIDs = []string{}
+	}
+
+	key := "services." + event.Source
+	update := bson.M{
+		"$set": bson.M{
+			key + ".action":       data.Action,
+			key + ".completed_at": event.Time,
+		},
+		"$addToSet": bson.M{key + ".affected_ids": bson.M{"$each": data.AffectedIDs}},
+	}
+	if len(data.SkippedIDs) > 0 {
+		update["$addToSet"].(bson.M)[key+".skipped_ids"] = bson.M{"$each": data.SkippedIDs}
+	}
+	_, err := deactivationReports().UpdateOne(ctx, bson.M{"_id": data.UserID}, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%s finished deactivation cascade for user %s: %s %d record(s)", event.Source, data.UserID.Hex(), data.Action, len(data.AffectedIDs))
+	return nil
+}
+
+func getDeactivationReport(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/users/deactivation-report/"):])
+	if err != nil {
+		problem.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var report DeactivationReport
+	err = deactivationReports().FindOne(tracing.Traced(req), bson.M{"_id": userID}).Decode(&report)
+	if err != nil {
+		problem.Error(w, "Deactivation report not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func listDeactivationReports(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "deactivated_at", Value: -1}})
+	cursor, err := deactivationReports().Find(tracing.Traced(req), bson.M{}, opts)
+	if err != nil {
+		problem.Error(w, "Failed to list deactivation reports", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	reports := []DeactivationReport{}
+	if err = cursor.All(context.Background(), &reports); err != nil {
+		problem.Error(w, "Failed to decode deactivation reports", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
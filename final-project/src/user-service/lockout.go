@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
+)
+
+// Failed logins are counted per username and per client IP. Once a counter
+// reaches its threshold, further logins for that username or from that IP
+// are refused until the lockout ends, and each failure after that doubles
+// the lockout. A successful login clears the username's counter; counters
+// are also forgotten a day after their last failure. Every attempt is kept
+// in the login history.
+
+const (
+	userLockoutThreshold = 5
+	ipLockoutThreshold   = 20
+	lockoutBase          = time.Minute
+	lockoutMax           = time.Hour
+	failureWindow        = 24 * time.Hour
+	loginHistoryTTL      = 90 * 24 * time.Hour
+	loginHistoryLimit    = 50
+)
+
+// LoginRecord is one login attempt.
+type LoginRecord struct {
+	ID        primitive.ObjectID  `bson:"_id" json:"id"`
+	UserID    *primitive.ObjectID `bson:"user_id,omitempty" json:"user_id,omitempty"`
+	Username  string              `bson:"username" json:"username"`
+	Time      time.Time           `bson:"time" json:"time"`
+	IP        string              `bson:"ip" json:"ip"`
+	UserAgent string              `bson:"user_agent" json:"user_agent"`
+	Success   bool                `bson:"success" json:"success"`
+	// Reason says why a login failed: invalid_credentials,
+	// invalid_mfa_code, unverified or locked
+	Reason string `bson:"reason,omitempty" json:"reason,omitempty"`
+}
+
+type loginFailures struct {
+	Failures    int       `bson:"failures"`
+	LockedUntil time.Time `bson:"locked_until"`
+}
+
+func loginFailureCounters() *mongo.Collection {
+	return client.Database("user").Collection("login_failures")
+}
+
+func loginHistory() *mongo.Collection {
+	return client.Database("user").Collection("login_history")
+}
+
+func ensureLoginIndexes(client *mongo.Client) error {
+	_, err := client.Database("user").Collection("login_failures").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.Database("user").Collection("login_history").Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "time", Value: -1}},
+			Options: options.Index().SetName("user_time"),
+		},
+		{
+			Keys:    bson.D{{Key: "time", Value: 1}},
+			Options: options.Index().SetName("time_ttl").SetExpireAfterSeconds(int32(loginHistoryTTL.Seconds())),
+		},
+	})
+	return err
+}
+
+func usernameKey(username string) string {
+	return "user:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// trustedProxies lists who may name the client in X-Forwarded-For: IPs,
+// CIDR ranges or host names, comma separated in TRUSTED_PROXIES. It
+// defaults to the API gateway. Anyone else reaching the service directly
+// could otherwise pick the address their failed logins count against.
+var trustedProxies = proxyList(os.Getenv("TRUSTED_PROXIES"))
+
+func proxyList(value string) []string {
+	if value == "" {
+		return []string{"api-gateway"}
+	}
+	var proxies []string
+	for _, proxy := range strings.Split(value, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+// trustedProxy reports whether ip is one of the trusted proxies. Host
+// names are looked up each time, as the gateway's address changes when its
+// container is recreated.
+func trustedProxy(ip net.IP) bool {
+	for _, proxy := range trustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if proxyIP := net.ParseIP(proxy); proxyIP != nil {
+			if proxyIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		addrs, err := net.LookupIP(proxy)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client. A trusted proxy appends the
+// address it received the request from to X-Forwarded-For, so the last
+// entry is the one that can be trusted; from anyone else the header is
+// ignored.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		if ip := net.ParseIP(host); ip != nil && trustedProxy(ip) {
+			parts := strings.Split(forwarded, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+	return host
+}
+
+// loginLockedFor returns how long logins for the username or from the IP
+// are still locked out, zero if they are not.
+func loginLockedFor(username, ip string) time.Duration {
+	cursor, err := loginFailureCounters().Find(context.TODO(), bson.M{
+		"_id":          bson.M{"$in": bson.A{usernameKey(username), ipKey(ip)}},
+		"locked_until": bson.M{"$gt": time.Now()},
+	})
+	if err != nil {
+		log.Printf("Failed to check login lockouts: %v", err)
+		return 0
+	}
+	var counters []loginFailures
+	if err := cursor.All(context.TODO(), &counters); err != nil {
+		log.Printf("Failed to check login lockouts: %v", err)
+		return 0
+	}
+
+	var wait time.Duration
+	for _, counter := range counters {
+		if remaining := time.Until(counter.LockedUntil); remaining > wait {
+			wait = remaining
+		}
+	}
+	return wait
+}
+
+// refuseLockedOut answers 429 if logins for the username or from the
+// client's IP are locked out, reporting whether it did.
+func refuseLockedOut(w http.ResponseWriter, req *http.Request, username string) bool {
+	ip := clientIP(req)
+	wait := loginLockedFor(username, ip)
+	if wait <= 0 {
+		return false
+	}
+	slog.InfoContext(req.Context(), "Login refused while locked out", "retry_after", wait)
+	recordLogin(req, userIDByUsername(username), username, false, "locked")
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	problem.Error(w, "Too many failed logins, try again later", http.StatusTooManyRequests)
+	return true
+}
+
+// completeLogin clears the user's failed logins and records the login.
+func completeLogin(req *http.Request, user *User) {
+	if err := clearLoginFailures(user.Username); err != nil {
+		log.Printf("Failed to clear failed logins: %v", err)
+	}
+	recordLogin(req, &user.ID, user.Username, true, "")
+}
+
+// recordLoginFailure counts a failed login against the username and the IP.
+func recordLoginFailure(username, ip string) {
+	countLoginFailure(usernameKey(username), userLockoutThreshold)
+	countLoginFailure(ipKey(ip), ipLockoutThreshold)
+}
+
+func countLoginFailure(key string, threshold int) {
+	now := time.Now()
+	var counter loginFailures
+	err := loginFailureCounters().FindOneAndUpdate(context.TODO(),
+		bson.M{"_id": key},
+		bson.M{
+			"$inc": bson.M{"failures": 1},
+			"$set": bson.M{"last_failure": now, "expires_at": now.Add(failureWindow)},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	if err != nil {
+		log.Printf("Failed to count failed login: %v", err)
+		return
+	}
+	if counter.Failures < threshold {
+		return
+	}
+
+	lockout := lockoutFor(counter.Failures - threshold)
+	lockedUntil := now.Add(lockout)
+	_, err = loginFailureCounters().UpdateOne(context.TODO(), bson.M{"_id": key}, bson.M{
+		"$set": bson.M{"locked_until": lockedUntil, "expires_at": lockedUntil.Add(failureWindow)},
+	})
+	if err != nil {
+		log.Printf("Failed to lock out logins: %v", err)
+		return
+	}
+	// The key names the username or IP, which are personal data
+	kind, _, _ := strings.Cut(key, ":")
+	slog.Info("Locked out logins", "by", kind, "for", lockout, "failures", counter.Failures)
+}
+
+// lockoutFor doubles the lockout for every failure past the threshold.
+func lockoutFor(past int) time.Duration {
+	if past >= 16 {
+		return lockoutMax
+	}
+	lockout := lockoutBase << past
+	if lockout > lockoutMax {
+		return lockoutMax
+	}
+	return lockout
+}
+
+// clearLoginFailures forgets a username's failed logins.
+func clearLoginFailures(username string) error {
+	_, err := loginFailureCounters().DeleteOne(context.TODO(), bson.M{"_id": usernameKey(username)})
+	return err
+}
+
+// recordLogin adds an attempt to the login history.
+func recordLogin(req *http.Request, userID *primitive.ObjectID, username string, success bool, reason string) {
+	record := LoginRecord{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Username:  username,
+		Time:      time.Now(),
+		IP:        clientIP(req),
+		UserAgent: req.UserAgent(),
+		Success:   success,
+		Reason:    reason,
+	}
+	if _, err := loginHistory().InsertOne(tracing.Traced(req), record); err != nil {
+		log.Printf("Failed to record login attempt: %v", err)
+	}
+}
+
+// userIDByUsername looks up a user for the login history, nil if there is
+// no such user.
+func userIDByUsername(username string) *primitive.ObjectID {
+	var user User
+	err := client.Database("user").Collection("users").FindOne(context.TODO(), bson.M{"username": username},
+		options.FindOne().SetCollation(&options.Collation{Locale: "en", Strength: 2})).Decode(&user)
+	if err != nil {
+		return nil
+	}
+	return &user.ID
+}
+
+// unlockUser lets an admin clear a user's failed logins and lockout.
+// Lockouts of an IP end on their own.
+func unlockUser(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to unlock user")
+
+	if req.Method != http.MethodPost {
+		log.Println("Invalid request method")
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := req.URL.Path[len("/users/unlock/"):]
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		log.Printf("Invalid user ID: %v", err)
+		problem.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	user := loadUser(objectID)
+	if user == nil {
+		problem.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err := clearLoginFailures(user.Username); err != nil {
+		log.Printf("Failed to unlock user: %v", err)
+		problem.Error(w, "Failed to unlock user", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(req, "unlock", userID, nil, nil)
+
+	log.Printf("User unlocked successfully: %s", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getLoginHistory lists a user's most recent login attempts, newest first.
+// Users can see their own history; admins can see anyone's.
+func getLoginHistory(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to get login history")
+
+	if req.Method != http.MethodGet {
+		log.Println("Invalid request method")
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := req.URL.Path[len("/users/login-history/"):]
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		log.Printf("Invalid user ID: %v", err)
+		problem.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	role, _ := req.Context().Value("role").(string)
+	if role != "admin" && req.Context().Value("userID") != userID {
+		problem.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	limit := loginHistoryLimit
+	if value := req.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > 500 {
+			problem.Validation(w, http.StatusBadRequest, []problem.FieldError{{Field: "limit", Message: "must be a number from 1 to 500"}})
+			return
+		}
+	}
+
+	cursor, err := loginHistory().Find(tracing.Traced(req), bson.M{"user_id": objectID},
+		options.Find().SetSort(bson.D{{Key: "time", Value: -1}}).SetLimit(int64(limit)))
+	if err != nil {
+		log.Printf("Failed to get login history: %v", err)
+		problem.Error(w, "Failed to get login history", http.StatusInternalServerError)
+		return
+	}
+	records := []LoginRecord{}
+	if err := cursor.All(tracing.Traced(req), &records); err != nil {
+		log.Printf("Failed to decode login history: %v", err)
+		problem.Error(w, "Failed to get login history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
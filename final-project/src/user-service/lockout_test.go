@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLockoutFor(t *testing.T) {
+	tests := []struct {
+		past int
+		want time.Duration
+	}{
+		{0, time.Minute},
+		{1, 2 * time.Minute},
+		{2, 4 * time.Minute},
+		{5, 32 * time.Minute},
+		// Doubling stops at the maximum
+		{6, time.Hour},
+		{15, time.Hour},
+		// Large counts do not overflow the shift
+		{16, time.Hour},
+		{1000, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := lockoutFor(tt.past); got != tt.want {
+			t.Errorf("lockoutFor(%d) = %v, want %v", tt.past, got, tt.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	saved := trustedProxies
+	defer func() { trustedProxies = saved }()
+	trustedProxies = proxyList("10.0.0.2, 192.168.0.0/16")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"direct", "203.0.113.7:5000", "", "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:5000", "198.51.100.1", "198.51.100.1"},
+		{"trusted range", "192.168.4.1:5000", "198.51.100.1", "198.51.100.1"},
+		// The proxy appends the address it saw, after any the client sent
+		{"last entry", "10.0.0.2:5000", "1.2.3.4, 198.51.100.1", "198.51.100.1"},
+		// Anyone else cannot choose the address their failures count against
+		{"untrusted", "203.0.113.7:5000", "198.51.100.1", "203.0.113.7"},
+		{"no port", "203.0.113.7", "198.51.100.1", "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/users/login", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := clientIP(req); got != tt.want {
+			t.Errorf("%s: clientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
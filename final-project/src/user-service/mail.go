@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/server"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer is implemented by every mail transport.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+var mailer Mailer
+
+// newMailer selects the transport from MAIL_TRANSPORT (smtp or log). The
+// smtp transport sends through SMTP_ADDR, logging in with SMTP_USERNAME and
+// SMTP_PASSWORD if they are set.
+func newMailer() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "Task Management <no-reply@example.com>"
+	}
+
+	switch kind := os.Getenv("MAIL_TRANSPORT"); kind {
+	case "", "smtp":
+		addr := os.Getenv("SMTP_ADDR")
+		if addr == "" {
+			addr = "mailpit:1025"
+		}
+		return &smtpMailer{
+			addr:     addr,
+			from:     from,
+			username: os.Getenv("SMTP_USERNAME"),
+			password: os.Getenv("SMTP_PASSWORD"),
+		}, nil
+	case "log":
+		return logMailer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail transport %q", kind)
+	}
+}
+
+// sendMail sends a message in the background, so the request does not wait
+// for the mail server and its timing does not reveal whether mail was sent.
+func sendMail(msg Message) {
+	server.Go(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := mailer.Send(ctx, msg); err != nil {
+			log.Printf("Failed to send %q to %s: %v", msg.Subject, msg.To, err)
+		}
+	})
+}
+
+type smtpMailer struct {
+	addr     string
+	from     string
+	username string
+	password string
+}
+
+func (m *smtpMailer) Send(ctx context.Context, msg Message) error {
+	var auth smtp.Auth
+	if m.username != "" {
+		host, _, err := net.SplitHostPort(m.addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.username, m.password, host)
+	}
+
+	sender := m.from
+	if start, end := strings.LastIndex(sender, "<"), strings.LastIndex(sender, ">"); start >= 0 && end > start {
+		sender = sender[start+1 : end]
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.addr, auth, sender, []string{msg.To}, m.format(msg))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *smtpMailer) format(msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", m.from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// logMailer logs messages instead of sending them, for running without a
+// mail server. Only the subject is logged: the recipient is personal data,
+// and the bodies carry live verification, reset and invitation links.
+type logMailer struct{}
+
+func (logMailer) Send(ctx context.Context, msg Message) error {
+	slog.InfoContext(ctx, "Mail not sent without a mail server", "subject", msg.Subject)
+	return nil
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/validate"
+)
+
+// Users can turn on multi-factor authentication with a TOTP app (RFC 6238);
+// admins have to. Logging in then takes two steps: the password gets a
+// short-lived challenge token, and the challenge token plus a code from the
+// app, or one of the recovery codes, gets the JWT. An admin without MFA
+// gets an enrollment challenge instead, which only lets them enroll.
+//
+// Challenge tokens are signed with their own key, so the services never
+// accept one in place of a JWT.
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is how many periods either side of now a code is accepted for
+	totpSkew = 1
+
+	mfaIssuer         = "Task Management"
+	recoveryCodeCount = 10
+	challengeTTL      = 5 * time.Minute
+
+	purposeMFA    = "mfa"
+	purposeEnroll = "mfa_enroll"
+)
+
+var challengeKey = []byte("your-mfa-challenge-key")
+
+// MFA is a user's second factor. Recovery codes are stored as SHA-256
+// hashes and each works once.
+type MFA struct {
+	UserID        primitive.ObjectID `bson:"_id"`
+	Enabled       bool               `bson:"enabled"`
+	Secret        string             `bson:"secret,omitempty"`
+	PendingSecret string             `bson:"pending_secret,omitempty"`
+	RecoveryCodes []string           `bson:"recovery_codes,omitempty"`
+	// LastStep is the TOTP period of the last code used, which cannot be
+	// used again
+	LastStep  int64      `bson:"last_step"`
+	EnabledAt *time.Time `bson:"enabled_at,omitempty"`
+}
+
+// LoginResult is the response to a login. It holds either the JWT, or a
+// challenge token for the second step.
+type LoginResult struct {
+	Token                 string `json:"token,omitempty"`
+	MFARequired           bool   `json:"mfa_required,omitempty"`
+	MFAEnrollmentRequired bool   `json:"mfa_enrollment_required,omitempty"`
+	ChallengeToken        string `json:"challenge_token,omitempty"`
+}
+
+type mfaCode struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+func mfaSettings() *mongo.Collection {
+	return client.Database("user").Collection("mfa")
+}
+
+func loadMFA(userID primitive.ObjectID) *MFA {
+	var mfa MFA
+	if err := mfaSettings().FindOne(context.TODO(), bson.M{"_id": userID}).Decode(&mfa); err != nil {
+		return nil
+	}
+	return &mfa
+}
+
+// newTOTPSecret returns a random 160-bit secret in base32, as TOTP apps
+// expect it.
+func newTOTPSecret() string {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+}
+
+// provisioningURI is the otpauth:// URI TOTP apps read from a QR code.
+func provisioningURI(username, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", mfaIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(mfaIssuer+":"+username) + "?" + query.Encode()
+}
+
+// totp computes the code for a period (RFC 6238, RFC 4226 section 5.3).
+func totp(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
+
+// verifyTOTP checks a code against the periods around now, returning the
+// period it belongs to. Periods up to lastStep have been used already.
+func verifyTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && subtle.ConstantTimeCompare([]byte(totp(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// newRecoveryCodes returns codes to show the user once and their hashes
+// to store.
+func newRecoveryCodes() ([]string, []string) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 6)
+		rand.Read(raw)
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw))
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+// useCode accepts a code from the user's app or an unused recovery code,
+// marking it used so it cannot be replayed.
+func (mfa *MFA) useCode(code mfaCode) bool {
+	if code.RecoveryCode != "" {
+		result, err := mfaSettings().UpdateOne(context.TODO(),
+			bson.M{"_id": mfa.UserID, "recovery_codes": hashRecoveryCode(code.RecoveryCode)},
+			bson.M{"$pull": bson.M{"recovery_codes": hashRecoveryCode(code.RecoveryCode)}})
+		return err == nil && result.ModifiedCount == 1
+	}
+
+	step, ok := verifyTOTP(mfa.Secret, code.Code, mfa.LastStep, time.Now())
+	if !ok {
+		return false
+	}
+	// Only one request can move past the period
+	result, err := mfaSettings().UpdateOne(context.TODO(),
+		bson.M{"_id": mfa.UserID, "last_step": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"last_step": step}})
+	return err == nil && result.ModifiedCount == 1
+}
+
+// rejectCode counts a wrong code like a failed login and answers 401.
+func rejectCode(w http.ResponseWriter, req *http.Request, user *User) {
+	log.Printf("Invalid MFA code for user %s", user.ID.Hex())
+	recordLoginFailure(user.Username, clientIP(req))
+	recordLogin(req, &user.ID, user.Username, false, "invalid_mfa_code")
+	problem.Error(w, "Invalid MFA code", http.StatusUnauthorized)
+}
+
+func issueChallenge(userID primitive.ObjectID, purpose string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"userID":  userID.Hex(),
+		"purpose": purpose,
+		"exp":     time.Now().Add(challengeTTL).Unix(),
+	})
+	return token.SignedString(challengeKey)
+}
+
+// parseChallenge returns the user a challenge token was issued to.
+func parseChallenge(tokenString, purpose string) (primitive.ObjectID, bool) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return challengeKey, nil
+	})
+	if err != nil || !token.Valid {
+		return primitive.NilObjectID, false
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if claims["purpose"] != purpose {
+		return primitive.NilObjectID, false
+	}
+	userIDString, _ := claims["userID"].(string)
+	userID, err := primitive.ObjectIDFromHex(userIDString)
+	return userID, err == nil
+}
+
+// requireSecondFactor answers a correct password with a challenge when the
+// user has MFA, or must have it, reporting whether it did.
+func requireSecondFactor(w http.ResponseWriter, user *User) bool {
+	mfa := loadMFA(user.ID)
+	result := LoginResult{}
+	purpose := purposeMFA
+	switch {
+	case mfa != nil && mfa.Enabled:
+		result.MFARequired = true
+	case user.Role == "admin":
+		result.MFAEnrollmentRequired = true
+		purpose = purposeEnroll
+	default:
+		return false
+	}
+
+	challenge, err := issueChallenge(user.ID, purpose)
+	if err != nil {
+		log.Println("Failed to generate challenge token:", err)
+		problem.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return true
+	}
+	result.ChallengeToken = challenge
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+	return true
+}
+
+// loginMFA is the second login step: a challenge token and a code.
+func loginMFA(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to complete MFA login")
+
+	if req.Method != http.MethodPost {
+		log.Println("Invalid request method for MFA login")
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		ChallengeToken string `json:"challenge_token"`
+		mfaCode
+	}
+	if errs := validate.DecodeBody(req, &body); errs != nil {
+		problem.Validation(w, http.StatusBadRequest, errs)
+		return
+	}
+	var errs validate.Errors
+	errs.Required("challenge_token", body.ChallengeToken)
+	if body.Code == "" && body.RecoveryCode == "" {
+		errs.Add("code", "is required unless recovery_code is given")
+	}
+	if errs != nil {
+		problem.Validation(w, http.StatusUnprocessableEntity, errs)
+		return
+	}
+
+	userID, ok := parseChallenge(body.ChallengeToken, purposeMFA)
+	if !ok {
+		problem.Error(w, "Invalid or expired challenge token", http.StatusUnauthorized)
+		return
+	}
+	user := loadUser(userID)
+	mfa := loadMFA(userID)
+	if user == nil || user.DeletedAt != nil || mfa == nil || !mfa.Enabled {
+		problem.Error(w, "Invalid or expired challenge token", http.StatusUnauthorized)
+		return
+	}
+
+	if refuseLockedOut(w, req, user.Username) {
+		return
+	}
+	if !mfa.useCode(body.mfaCode) {
+		rejectCode(w, req, user)
+		return
+	}
+	completeLogin(req, user)
+
+	tokenString, err := issueToken(user)
+	if err != nil {
+		log.Println("Failed to generate JWT token:", err)
+		problem.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User logged in with MFA: %s", user.ID.Hex())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResult{Token: tokenString})
+}
+
+type enrollmentKey struct{}
+
+// enrollmentMiddleware accepts a JWT, like authMiddleware, or an
+// enrollment challenge token for an admin who has to enroll before they
+// can log in.
+func enrollmentMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		tokenString := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		userID, ok := parseChallenge(tokenString, purposeEnroll)
+		if !ok {
+			authMiddleware(next)(w, req)
+			return
+		}
+		user := loadUser(userID)
+		if user == nil || user.DeletedAt != nil {
+			problem.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(req.Context(), "userID", userID.Hex())
+		ctx = context.WithValue(ctx, "role", user.Role)
+		ctx = context.WithValue(ctx, enrollmentKey{}, true)
+		next(w, req.WithContext(ctx))
+	}
+}
+
+// currentUser loads the user making the request.
+func currentUser(req *http.Request) *User {
+	userID, _ := req.Context().Value("userID").(string)
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil
+	}
+	user := loadUser(objectID)
+	if user == nil || user.DeletedAt != nil {
+		return nil
+	}
+	return user
+}
+
+// enrollMFA starts enrollment with a new secret. MFA is only turned on once
+// confirmMFA has seen a code for it.
+func enrollMFA(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to enroll in MFA")
+
+	if req.Method != http.MethodPost {
+		log.Println("Invalid request method")
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(req)
+	if user == nil {
+		problem.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if mfa := loadMFA(user.ID); mfa != nil && mfa.Enabled {
+		problem.Error(w, "MFA is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret := newTOTPSecret()
+	_, err := mfaSettings().UpdateOne(tracing.Traced(req), bson.M{"_id": user.ID},
+		bson.M{"$set": bson.M{"pending_secret": secret, "enabled": false}}, options.Update().SetUpsert(true))
+	if err != nil {
+		log.Printf("Failed to start MFA enrollment: %v", err)
+		problem.Error(w, "Failed to start MFA enrollment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": provisioningURI(user.Username, secret),
+	})
+}
+
+// confirmMFA turns MFA on once the user shows a code for the new secret,
+// returning their recovery codes. An admin enrolling at login is logged in.
+func confirmMFA(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to confirm MFA enrollment")
+
+	if req.Method != http.MethodPost {
+		log.Println("Invalid request method")
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body mfaCode
+	if errs := validate.DecodeBody(req, &body); errs != nil {
+		problem.Validation(w, http.StatusBadRequest, errs)
+		return
+	}
+	var errs validate.Errors
+	errs.Required("code", body.Code)
+	if errs != nil {
+		problem.Validation(w, http.StatusUnprocessableEntity, errs)
+		return
+	}
+
+	user := currentUser(req)
+	if user == nil {
+		problem.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	mfa := loadMFA(user.ID)
+	if mfa == nil || mfa.PendingSecret == "" {
+		problem.Error(w, "Start MFA enrollment first", http.StatusConflict)
+		return
+	}
+	if refuseLockedOut(w, req, user.Username) {
+		return
+	}
+	step, ok := verifyTOTP(mfa.PendingSecret, body.Code, 0, time.Now())
+	if !ok {
+		rejectCode(w, req, user)
+		return
+	}
+
+	codes, hashes := newRecoveryCodes()
+	now := time.Now()
+	_, err := mfaSettings().UpdateOne(tracing.Traced(req), bson.M{"_id": user.ID, "pending_secret": mfa.PendingSecret}, bson.M{
+		"$set":   bson.M{"enabled": true, "secret": mfa.PendingSecret, "recovery_codes": hashes, "last_step": step, "enabled_at": now},
+		"$unset": bson.M{"pending_secret": ""},
+	})
+	if err != nil {
+		log.Printf("Failed to enable MFA: %v", err)
+		problem.Error(w, "Failed to enable MFA", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(req, "mfa_enable", user.ID.Hex(), nil, nil)
+
+	response := map[string]interface{}{"recovery_codes": codes}
+	if enrolling, _ := req.Context().Value(enrollmentKey{}).(bool); enrolling {
+		completeLogin(req, user)
+		tokenString, err := issueToken(user)
+		if err != nil {
+			log.Println("Failed to generate JWT token:", err)
+			problem.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+		response["token"] = tokenString
+	}
+
+	log.Printf("MFA enabled for user %s", user.ID.Hex())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// disableMFA turns MFA off after checking a code. Admins cannot turn it off.
+func disableMFA(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to disable MFA")
+
+	if req.Method != http.MethodPost {
+		log.Println("Invalid request method")
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, mfa, ok := checkCurrentCode(w, req)
+	if !ok {
+		return
+	}
+	if user.Role == "admin" {
+		problem.Error(w, "MFA is mandatory for admins", http.StatusForbidden)
+		return
+	}
+	if _, err := mfaSettings().DeleteOne(tracing.Traced(req), bson.M{"_id": mfa.UserID}); err != nil {
+		log.Printf("Failed to disable MFA: %v", err)
+		problem.Error(w, "Failed to disable MFA", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(req, "mfa_disable", user.ID.Hex(), nil, nil)
+
+	log.Printf("MFA disabled for user %s", user.ID.Hex())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// regenerateRecoveryCodes replaces the user's recovery codes after
+// checking a code.
+func regenerateRecoveryCodes(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to regenerate recovery codes")
+
+	if req.Method != http.MethodPost {
+		log.Println("Invalid request method")
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, mfa, ok := checkCurrentCode(w, req)
+	if !ok {
+		return
+	}
+	codes, hashes := newRecoveryCodes()
+	_, err := mfaSettings().UpdateOne(tracing.Traced(req), bson.M{"_id": mfa.UserID}, bson.M{"$set": bson.M{"recovery_codes": hashes}})
+	if err != nil {
+		log.Printf("Failed to regenerate recovery codes: %v", err)
+		problem.Error(w, "Failed to regenerate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Recovery codes regenerated for user %s", user.ID.Hex())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// checkCurrentCode checks a code from the requesting user, who must have
+// MFA on. It writes the response and returns false if the code is wrong.
+func checkCurrentCode(w http.ResponseWriter, req *http.Request) (*User, *MFA, bool) {
+	var body mfaCode
+	if errs := validate.DecodeBody(req, &body); errs != nil {
+		problem.Validation(w, http.StatusBadRequest, errs)
+		return nil, nil, false
+	}
+	if body.Code == "" && body.RecoveryCode == "" {
+		problem.Validation(w, http.StatusUnprocessableEntity, []problem.FieldError{{Field: "code", Message: "is required unless recovery_code is given"}})
+		return nil, nil, false
+	}
+
+	user := currentUser(req)
+	if user == nil {
+		problem.Error(w, "User not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	mfa := loadMFA(user.ID)
+	if mfa == nil || !mfa.Enabled {
+		problem.Error(w, "MFA is not enabled", http.StatusConflict)
+		return nil, nil, false
+	}
+	if refuseLockedOut(w, req, user.Username) {
+		return nil, nil, false
+	}
+	if !mfa.useCode(body) {
+		rejectCode(w, req, user)
+		return nil, nil, false
+	}
+	return user, mfa, true
+}
+
+// resetMFA lets an admin remove a user's MFA, for a lost device. An admin
+// whose MFA is reset enrolls again at their next login.
+func resetMFA(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to reset MFA")
+
+	if req.Method != http.MethodDelete {
+		log.Println("Invalid request method")
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := req.URL.Path[len("/users/mfa/reset/"):]
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		log.Printf("Invalid user ID: %v", err)
+		problem.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if loadUser(objectID) == nil {
+		problem.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if _, err := mfaSettings().DeleteOne(tracing.Traced(req), bson.M{"_id": objectID}); err != nil {
+		log.Printf("Failed to reset MFA: %v", err)
+		problem.Error(w, "Failed to reset MFA", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(req, "mfa_reset", userID, nil, nil)
+
+	log.Printf("MFA reset for user %s", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
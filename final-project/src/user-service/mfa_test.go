@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 secret of the RFC 6238 test vectors.
+var rfc6238Secret = []byte("12345678901234567890")
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, cut to this service's six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totp(rfc6238Secret, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totp at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(rfc6238Secret)
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current period", secret, totp(rfc6238Secret, current), 0, current, true},
+		{"previous period", secret, totp(rfc6238Secret, current-1), 0, current - 1, true},
+		{"next period", secret, totp(rfc6238Secret, current+1), 0, current + 1, true},
+		{"outside the skew", secret, totp(rfc6238Secret, current-2), 0, 0, false},
+		{"replayed code", secret, totp(rfc6238Secret, current), current, 0, false},
+		{"code of a used period", secret, totp(rfc6238Secret, current-1), current - 1, 0, false},
+		{"later code after a used one", secret, totp(rfc6238Secret, current), current - 1, current, true},
+		{"wrong code", secret, "000000", 0, 0, false},
+		{"short code", secret, "05047", 0, 0, false},
+		{"invalid secret", "not base32!", totp(rfc6238Secret, current), 0, 0, false},
+	}
+	for _, tt := range tests {
+		step, ok := verifyTOTP(tt.secret, tt.code, tt.lastStep, now)
+		if ok != tt.wantOK || step != tt.wantStep {
+			t.Errorf("%s: verifyTOTP = %d, %v, want %d, %v", tt.name, step, ok, tt.wantStep, tt.wantOK)
+		}
+	}
+}
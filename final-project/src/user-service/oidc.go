@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/concurrency"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/softdelete"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/validate"
+)
+
+// The API gateway runs OpenID Connect logins and hands the result to
+// loginOIDC as a signed assertion. Users are found by the provider's
+// issuer and subject and created on their first login. The provider is
+// the source of truth for their role, which is updated on every login.
+//
+// SSO logins pass this service's second factor like password logins do,
+// unless the provider asserts in the amr claim that it checked more than
+// one factor itself.
+//
+// A new SSO user is linked to an existing account with the same email
+// only if the provider has verified the address. Users created here get a
+// random password, which they can change with a password reset, and join
+// the default organization.
+
+// SSOIdentity is the OpenID Connect account a user logs in with.
+type SSOIdentity struct {
+	Issuer  string `bson:"issuer" json:"issuer"`
+	Subject string `bson:"subject" json:"subject"`
+}
+
+var oidcAssertionKey = []byte("your-oidc-assertion-key")
+
+var usernameInvalidChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// oidcAssertion is what the gateway learned from the provider.
+type oidcAssertion struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+	Role              string
+	// AMR lists the authentication methods the provider used (RFC 8176)
+	AMR []string
+}
+
+// multiFactor reports whether the provider asserted a multi-factor login.
+func (a *oidcAssertion) multiFactor() bool {
+	for _, method := range a.AMR {
+		if method == "mfa" {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureSSOIndexes makes each provider account belong to one user.
+func ensureSSOIndexes(client *mongo.Client) error {
+	_, err := client.Database("user").Collection("users").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "sso.issuer", Value: 1}, {Key: "sso.subject", Value: 1}},
+		Options: options.Index().SetName("sso_unique").SetUnique(true).
+			SetPartialFilterExpression(bson.M{"sso": bson.M{"$exists": true}}),
+	})
+	return err
+}
+
+func parseAssertion(tokenString string) (*oidcAssertion, bool) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return oidcAssertionKey, nil
+	})
+	if err != nil || !token.Valid {
+		return nil, false
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if claims["purpose"] != "oidc_login" {
+		return nil, false
+	}
+	assertion := &oidcAssertion{}
+	assertion.Issuer, _ = claims["iss"].(string)
+	assertion.Subject, _ = claims["sub"].(string)
+	assertion.Email, _ = claims["email"].(string)
+	assertion.EmailVerified, _ = claims["email_verified"].(bool)
+	assertion.PreferredUsername, _ = claims["preferred_username"].(string)
+	assertion.Role, _ = claims["role"].(string)
+	if methods, ok := claims["amr"].([]interface{}); ok {
+		for _, method := range methods {
+			if method, ok := method.(string); ok {
+				assertion.AMR = append(assertion.AMR, method)
+			}
+		}
+	}
+	if assertion.Issuer == "" || assertion.Subject == "" || (assertion.Role != "admin" && assertion.Role != "regular") {
+		return nil, false
+	}
+	return assertion, true
+}
+
+// loginOIDC logs in the user an assertion from the gateway names,
+// creating them if this is their first login.
+func loginOIDC(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to login user with OIDC")
+
+	if req.Method != http.MethodPost {
+		log.Println("Invalid request method for OIDC login")
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Assertion string `json:"assertion"`
+	}
+	if errs := validate.DecodeBody(req, &body); errs != nil {
+		problem.Validation(w, http.StatusBadRequest, errs)
+		return
+	}
+	assertion, ok := parseAssertion(body.Assertion)
+	if !ok {
+		problem.Error(w, "Invalid or expired assertion", http.StatusUnauthorized)
+		return
+	}
+
+	user, status, message := ssoUser(req, assertion)
+	if user == nil {
+		problem.Error(w, message, status)
+		return
+	}
+
+	// Users with MFA, and every admin, still have to pass the second step
+	// unless the provider already checked a second factor
+	if !assertion.multiFactor() && requireSecondFactor(w, user) {
+		return
+	}
+	completeLogin(req, user)
+
+	tokenString, err := issueToken(user)
+	if err != nil {
+		log.Println("Failed to generate JWT token:", err)
+		problem.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User logged in with OIDC: %s", user.ID.Hex())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResult{Token: tokenString})
+}
+
+// ssoUser finds, links or creates the user for an assertion and brings
+// their role up to date. It returns nil with a status and message if the
+// user cannot log in.
+func ssoUser(req *http.Request, assertion *oidcAssertion) (*User, int, string) {
+	collection := client.Database("user").Collection("users")
+	identity := SSOIdentity{Issuer: assertion.Issuer, Subject: assertion.Subject}
+	email := strings.ToLower(strings.TrimSpace(assertion.Email))
+
+	var user User
+	err := collection.FindOne(tracing.Traced(req), bson.M{"sso.issuer": identity.Issuer, "sso.subject": identity.Subject}).Decode(&user)
+	switch {
+	case err == mongo.ErrNoDocuments && email != "":
+		err = collection.FindOne(tracing.Traced(req), bson.M{"email": email}).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			return createSSOUser(req, assertion, identity, email)
+		}
+		if err != nil {
+			break
+		}
+		// Linking to an address the provider has not checked would let
+		// anyone take over the account
+		if !assertion.EmailVerified || user.SSO != nil {
+			log.Printf("Not linking OIDC subject %s to user %s", identity.Subject, user.ID.Hex())
+			return nil, http.StatusConflict, "An account with this email already exists"
+		}
+	case err == mongo.ErrNoDocuments:
+		return createSSOUser(req, assertion, identity, email)
+	}
+	if err != nil {
+		log.Printf("Failed to find OIDC user: %v", err)
+		return nil, http.StatusInternalServerError, "Failed to log in"
+	}
+	if user.DeletedAt != nil {
+		return nil, http.StatusForbidden, "This account has been deactivated"
+	}
+
+	if user.SSO != nil && user.Role == assertion.Role {
+		return &user, 0, ""
+	}
+	before := user
+	update := bson.M{"$set": bson.M{"sso": identity, "role": assertion.Role}}
+	if user.SSO == nil {
+		// Linking proves the address, as the provider has verified it
+		update["$set"].(bson.M)["email_verified"] = true
+	}
+	if _, err := collection.UpdateOne(tracing.Traced(req), softdelete.NotDeleted(bson.M{"_id": user.ID}), concurrency.BumpVersion(update)); err != nil {
+		log.Printf("Failed to update OIDC user: %v", err)
+		return nil, http.StatusInternalServerError, "Failed to log in"
+	}
+	after := loadUser(user.ID)
+	if after == nil {
+		return nil, http.StatusInternalServerError, "Failed to log in"
+	}
+	recordAudit(req, "sso_update", user.ID.Hex(), before, after)
+	return after, 0, ""
+}
+
+// createSSOUser creates the user on their first login, numbering the
+// username if it is taken.
+func createSSOUser(req *http.Request, assertion *oidcAssertion, identity SSOIdentity, email string) (*User, int, string) {
+	if email == "" {
+		return nil, http.StatusForbidden, "The identity provider did not share an email address"
+	}
+
+	password := make([]byte, 32)
+	if _, err := rand.Read(password); err != nil {
+		log.Printf("Failed to generate password: %v", err)
+		return nil, http.StatusInternalServerError, "Failed to log in"
+	}
+	user := User{
+		Email:         email,
+		Password:      hex.EncodeToString(password),
+		Role:          assertion.Role,
+		EmailVerified: assertion.EmailVerified,
+		SSO:           &identity,
+		Version:       1,
+	}
+
+	base := ssoUsername(assertion, email)
+	collection := client.Database("user").Collection("users")
+	for attempt := 1; attempt <= 20; attempt++ {
+		user.ID = primitive.NewObjectID()
+		user.Username = base
+		if attempt > 1 {
+			suffix := strconv.Itoa(attempt)
+			if len(base)+len(suffix) > 32 {
+				base = base[:32-len(suffix)]
+			}
+			user.Username = base + suffix
+		}
+		_, err := collection.InsertOne(tracing.Traced(req), user)
+		if errs := duplicateErrors(err); errs != nil {
+			if strings.Contains(err.Error(), "username_unique") {
+				continue
+			}
+			return nil, http.StatusConflict, "An account with this email already exists"
+		}
+		if err != nil {
+			log.Printf("Failed to create OIDC user: %v", err)
+			return nil, http.StatusInternalServerError, "Failed to log in"
+		}
+
+		recordAudit(req, "create", user.ID.Hex(), nil, user)
+		if _, err := addMember(defaultOrgID, user.ID, orgRoleMember); err != nil {
+			log.Printf("Failed to add user %s to the default organization: %v", user.ID.Hex(), err)
+		}
+		log.Printf("Created user %s on first OIDC login", user.ID.Hex())
+		return &user, 0, ""
+	}
+	return nil, http.StatusConflict, "Could not find a free username"
+}
+
+// ssoUsername makes a valid username from the preferred username, or the
+// email's local part.
+func ssoUsername(assertion *oidcAssertion, email string) string {
+	clean := func(name string) string {
+		return strings.Trim(usernameInvalidChars.ReplaceAllString(name, "_"), "_")
+	}
+	name := ""
+	if !strings.Contains(assertion.PreferredUsername, "@") {
+		name = clean(assertion.PreferredUsername)
+	}
+	if name == "" {
+		name = clean(strings.SplitN(email, "@", 2)[0])
+	}
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	for len(name) < 3 {
+		name += "_"
+	}
+	return name
+}
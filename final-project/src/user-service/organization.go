@@ -0,0 +1,827 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tenant"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/validate"
+)
+
+// Organizations are the tenants of the system. Users belong to one or more
+// organizations as an admin or a member, and work in one of them at a time:
+// its ID is the org_id claim of their JWT, and the task and billing
+// services only ever show and change that organization's data. Org admins
+// have admin rights in those services, inside their organization.
+//
+// New users get an organization of their own. Org admins add people by
+// inviting their email address; the invitee accepts once they are logged
+// in with that address. Users created by SSO join the default
+// organization, which also holds everything created before organizations
+// existed.
+
+const (
+	orgRoleAdmin  = "admin"
+	orgRoleMember = "member"
+
+	invitationTTL = 7 * 24 * time.Hour
+)
+
+// defaultOrgID is the default organization. The task and billing services
+// use the same ID for their data from before organizations existed.
+var defaultOrgID = primitive.ObjectID{11: 1}
+
+type Organization struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	Name      string             `bson:"name" json:"name"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	CreatedBy string             `bson:"created_by,omitempty" json:"created_by,omitempty"`
+}
+
+// Membership makes a user an admin or a member of an organization.
+type Membership struct {
+	ID        primitive.ObjectID `bson:"_id" json:"-"`
+	OrgID     primitive.ObjectID `bson:"org_id" json:"org_id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Role      string             `bson:"role" json:"role"`
+	JoinedAt  time.Time          `bson:"joined_at" json:"joined_at"`
+	Announced bool               `bson:"announced" json:"-"` // sent out in a granted event
+}
+
+// OrganizationWithRole is an organization as listed for one of its users.
+type OrganizationWithRole struct {
+	Organization
+	Role string `json:"role"`
+}
+
+// Member is a user as listed for their organization.
+type Member struct {
+	UserID   primitive.ObjectID `json:"user_id"`
+	Username string             `json:"username"`
+	Email    string             `json:"email"`
+	Role     string             `json:"role"`
+	JoinedAt time.Time          `json:"joined_at"`
+}
+
+// Invitation is a pending invitation. Only a hash of its token is stored;
+// the token itself is in the email.
+type Invitation struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	OrgID     primitive.ObjectID `bson:"org_id" json:"org_id"`
+	Email     string             `bson:"email" json:"email"`
+	Role      string             `bson:"role" json:"role"`
+	TokenHash string             `bson:"token_hash" json:"-"`
+	InvitedBy string             `bson:"invited_by" json:"invited_by"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
+}
+
+func organizations() *mongo.Collection {
+	return client.Database("user").Collection("organizations")
+}
+
+func memberships() *mongo.Collection {
+	return client.Database("user").Collection("memberships")
+}
+
+func invitations() *mongo.Collection {
+	return client.Database("user").Collection("invitations")
+}
+
+// ensureOrganizations creates the organization indexes and the default
+// organization, and makes users who belong to no organization members of
+// it. Admins become its admins. Memberships from before the granted event
+// existed are announced to the other services.
+func ensureOrganizations(client *mongo.Client) error {
+	db := client.Database("user")
+	_, err := db.Collection("memberships").Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "org_id", Value: 1}, {Key: "user_id", Value: 1}},
+			Options: options.Index().SetName("org_user_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}},
+			Options: options.Index().SetName("user_id"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("invitations").Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "org_id", Value: 1}, {Key: "email", Value: 1}},
+			Options: options.Index().SetName("org_email_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetName("token_hash_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Collection("organizations").UpdateOne(context.Background(),
+		bson.M{"_id": defaultOrgID},
+		bson.M{"$setOnInsert": bson.M{"name": "Default organization", "created_at": time.Now().UTC()}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+
+	cursor, err := db.Collection("users").Find(context.Background(), bson.M{}, options.Find().SetProjection(bson.M{"_id": 1, "role": 1}))
+	if err != nil {
+		return err
+	}
+	var users []User
+	if err := cursor.All(context.Background(), &users); err != nil {
+		return err
+	}
+	for _, user := range users {
+		count, err := db.Collection("memberships").CountDocuments(context.Background(), bson.M{"user_id": user.ID})
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		role := orgRoleMember
+		if user.Role == "admin" {
+			role = orgRoleAdmin
+		}
+		if _, err := addMember(defaultOrgID, user.ID, role); err != nil {
+			return err
+		}
+	}
+
+	cursor, err = db.Collection("memberships").Find(context.Background(), bson.M{"announced": bson.M{"$ne": true}})
+	if err != nil {
+		return err
+	}
+	var unannounced []Membership
+	if err := cursor.All(context.Background(), &unannounced); err != nil {
+		return err
+	}
+	for i := range unannounced {
+		grantMembership(&unannounced[i])
+		if _, err := db.Collection("memberships").UpdateOne(context.Background(), bson.M{"_id": unannounced[i].ID}, bson.M{"$set": bson.M{"announced": true}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addMember adds a user to an organization, returning the new membership.
+func addMember(orgID, userID primitive.ObjectID, role string) (*Membership, error) {
+	membership := Membership{
+		ID:        primitive.NewObjectID(),
+		OrgID:     orgID,
+		UserID:    userID,
+		Role:      role,
+		JoinedAt:  time.Now().UTC(),
+		Announced: true,
+	}
+	if _, err := memberships().InsertOne(context.TODO(), membership); err != nil {
+		return nil, err
+	}
+	grantMembership(&membership)
+	return &membership, nil
+}
+
+// grantMembership tells the other services that the user joined the
+// organization.
+func grantMembership(membership *Membership) {
+	publishEvent(tenant.GrantedEvent, map[string]interface{}{
+		"org_id":  membership.OrgID,
+		"user_id": membership.UserID,
+		"role":    membership.Role,
+	})
+}
+
+// membershipOf returns the user's membership of the organization, or nil.
+func membershipOf(orgID, userID primitive.ObjectID) *Membership {
+	var membership Membership
+	if err := memberships().FindOne(context.TODO(), bson.M{"org_id": orgID, "user_id": userID}).Decode(&membership); err != nil {
+		return nil
+	}
+	return &membership
+}
+
+// currentMembership returns the membership of the organization the user
+// works in: the one they last switched to, or else the one they joined
+// first. It returns nil for users who belong to no organization.
+func currentMembership(user *User) *Membership {
+	if user.OrgID != nil {
+		if membership := membershipOf(*user.OrgID, user.ID); membership != nil {
+			return membership
+		}
+	}
+	var membership Membership
+	err := memberships().FindOne(context.TODO(), bson.M{"user_id": user.ID},
+		options.FindOne().SetSort(bson.D{{Key: "joined_at", Value: 1}})).Decode(&membership)
+	if err != nil {
+		return nil
+	}
+	return &membership
+}
+
+// setCurrentOrg makes the organization the one the user works in.
+func setCurrentOrg(user *User, orgID primitive.ObjectID) error {
+	_, err := client.Database("user").Collection("users").UpdateOne(context.TODO(),
+		bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"org_id": orgID}})
+	if err == nil {
+		user.OrgID = &orgID
+	}
+	return err
+}
+
+// createOrganization creates an organization with the user as its admin,
+// and switches the user to it.
+func createOrganization(name string, owner *User) (*Organization, error) {
+	org := Organization{
+		ID:        primitive.NewObjectID(),
+		Name:      name,
+		CreatedAt: time.Now().UTC(),
+		CreatedBy: owner.ID.Hex(),
+	}
+	if _, err := organizations().InsertOne(context.TODO(), org); err != nil {
+		return nil, err
+	}
+	if _, err := addMember(org.ID, owner.ID, orgRoleAdmin); err != nil {
+		return nil, err
+	}
+	if err := setCurrentOrg(owner, org.ID); err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+// loadOrganization returns the organization with the given ID, or nil.
+func loadOrganization(orgID primitive.ObjectID) *Organization {
+	var org Organization
+	if err := organizations().FindOne(context.TODO(), bson.M{"_id": orgID}).Decode(&org); err != nil {
+		return nil
+	}
+	return &org
+}
+
+// orgAccess finds the organization a request is about and the requesting
+// user's role in it, answering the request if the organization does not
+// exist or the user is not in it. Platform admins act as org admins of
+// every organization.
+func orgAccess(w http.ResponseWriter, req *http.Request, orgID string) (*Organization, string, bool) {
+	objectID, err := primitive.ObjectIDFromHex(orgID)
+	if err != nil {
+		problem.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return nil, "", false
+	}
+	org := loadOrganization(objectID)
+	if org == nil {
+		problem.Error(w, "Organization not found", http.StatusNotFound)
+		return nil, "", false
+	}
+	if isAdmin(req) {
+		return org, orgRoleAdmin, true
+	}
+	userID, _ := primitive.ObjectIDFromHex(fmt.Sprint(req.Context().Value("userID")))
+	membership := membershipOf(objectID, userID)
+	if membership == nil {
+		// Organizations the user is not in are not theirs to know about
+		problem.Error(w, "Organization not found", http.StatusNotFound)
+		return nil, "", false
+	}
+	return org, membership.Role, true
+}
+
+// pathIDs splits the IDs after a route prefix.
+func pathIDs(req *http.Request, prefix string) []string {
+	return strings.Split(strings.Trim(req.URL.Path[len(prefix):], "/"), "/")
+}
+
+// listOrganizations lists the organizations the user belongs to, with
+// their role in each.
+func listOrganizations(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to list organizations")
+
+	if req.Method != http.MethodGet {
+		log.Println("Invalid request method")
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := primitive.ObjectIDFromHex(fmt.Sprint(req.Context().Value("userID")))
+	cursor, err := memberships().Find(tracing.Traced(req), bson.M{"user_id": userID},
+		options.Find().SetSort(bson.D{{Key: "joined_at", Value: 1}}))
+	if err != nil {
+		log.Printf("Failed to list organizations: %v", err)
+		problem.Error(w, "Failed to list organizations", http.StatusInternalServerError)
+		return
+	}
+	var joined []Membership
+	if err := cursor.All(tracing.Traced(req), &joined); err != nil {
+		log.Printf("Failed to decode memberships: %v", err)
+		problem.Error(w, "Failed to list organizations", http.StatusInternalServerError)
+		return
+	}
+
+	orgs := []OrganizationWithRole{}
+	for _, membership := range joined {
+		if org := loadOrganization(membership.OrgID); org != nil {
+			orgs = append(orgs, OrganizationWithRole{Organization: *org, Role: membership.Role})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orgs)
+}
+
+// createOrganizationHandler creates an organization with the requesting
+// user as its admin, and logs them in to it.
+func createOrganizationHandler(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to create an organization")
+
+	if req.Method != http.MethodPost {
+		log.Println("Invalid request method")
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	if errs := validate.DecodeBody(req, &body); errs != nil {
+		problem.Validation(w, http.StatusBadRequest, errs)
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	var errs validate.Errors
+	if errs.Required("name", body.Name) {
+		errs.Length("name", body.Name, 1, 100)
+	}
+	if errs != nil {
+		problem.Validation(w, http.StatusUnprocessableEntity, errs)
+		return
+	}
+
+	user := currentUser(req)
+	if user == nil {
+		problem.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	org, err := createOrganization(body.Name, user)
+	if err != nil {
+		log.Printf("Failed to create organization: %v", err)
+		problem.Error(w, "Failed to create organization", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(req, "org_create", org.ID.Hex(), nil, org)
+
+	log.Printf("Organization created: %s", org.ID.Hex())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(OrganizationWithRole{Organization: *org, Role: orgRoleAdmin})
+}
+
+// getOrganization returns an organization the user belongs to.
+func getOrganization(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to get an organization")
+
+	if req.Method != http.MethodGet {
+		log.Println("Invalid request method")
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	org, role, ok := orgAccess(w, req, req.URL.Path[len("/orgs/get/"):])
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(OrganizationWithRole{Organization: *org, Role: role})
+}
+
+// switchOrganization logs the user in to another of their organizations.
+func switchOrganization(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to switch organization")
+
+	if req.Method != http.MethodPost {
+		log.Println("Invalid request method")
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(req)
+	if user == nil {
+		problem.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	org, _, ok := orgAccess(w, req, req.URL.Path[len("/orgs/switch/"):])
+	if !ok {
+		return
+	}
+	if membershipOf(org.ID, user.ID) == nil {
+		problem.Error(w, "You are not a member of this organization", http.StatusForbidden)
+		return
+	}
+	if err := setCurrentOrg(user, org.ID); err != nil {
+		log.Printf("Failed to switch organization: %v", err)
+		problem.Error(w, "Failed to switch organization", http.StatusInternalServerError)
+		return
+	}
+	writeToken(w, user)
+}
+
+// writeToken answers with a new JWT for the user.
+func writeToken(w http.ResponseWriter, user *User) {
+	tokenString, err := issueToken(user)
+	if err != nil {
+		log.Println("Failed to generate JWT token:", err)
+		problem.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResult{Token: tokenString})
+}
+
+// orgMembers lists an organization's members at /orgs/members/{org}, and
+// changes a member's role (PUT) or removes them (DELETE) at
+// /orgs/members/{org}/{user}. Members can leave on their own; everything
+// else takes an org admin.
+func orgMembers(w http.ResponseWriter, req *http.Request) {
+	ids := pathIDs(req, "/orgs/members/")
+	org, role, ok := orgAccess(w, req, ids[0])
+	if !ok {
+		return
+	}
+
+	if len(ids) == 1 {
+		if req.Method != http.MethodGet {
+			problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		listMembers(w, org)
+		return
+	}
+	if len(ids) != 2 {
+		problem.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	userID, err := primitive.ObjectIDFromHex(ids[1])
+	if err != nil {
+		problem.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	self := req.Context().Value("userID") == ids[1]
+	if role != orgRoleAdmin && !(self && req.Method == http.MethodDelete) {
+		problem.Error(w, "Only organization admins can manage members", http.StatusForbidden)
+		return
+	}
+	membership := membershipOf(org.ID, userID)
+	if membership == nil {
+		problem.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		var body struct {
+			Role string `json:"role"`
+		}
+		if errs := validate.DecodeBody(req, &body); errs != nil {
+			problem.Validation(w, http.StatusBadRequest, errs)
+			return
+		}
+		var errs validate.Errors
+		if errs.Required("role", body.Role) {
+			errs.OneOf("role", body.Role, orgRoleAdmin, orgRoleMember)
+		}
+		if errs != nil {
+			problem.Validation(w, http.StatusUnprocessableEntity, errs)
+			return
+		}
+		if body.Role != orgRoleAdmin && lastAdmin(membership) {
+			problem.Error(w, "An organization needs at least one admin", http.StatusConflict)
+			return
+		}
+		if _, err := memberships().UpdateOne(tracing.Traced(req), bson.M{"_id": membership.ID}, bson.M{"$set": bson.M{"role": body.Role}}); err != nil {
+			log.Printf("Failed to change member role: %v", err)
+			problem.Error(w, "Failed to change member role", http.StatusInternalServerError)
+			return
+		}
+		after := *membership
+		after.Role = body.Role
+		if membership.Role == orgRoleAdmin && body.Role != orgRoleAdmin {
+			revokeMembership(membership, body.Role)
+		}
+		recordAudit(req, "org_member_update", org.ID.Hex(), membership, after)
+		log.Printf("Member %s of organization %s is now %s", userID.Hex(), org.ID.Hex(), body.Role)
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if lastAdmin(membership) {
+			problem.Error(w, "An organization needs at least one admin", http.StatusConflict)
+			return
+		}
+		if _, err := memberships().DeleteOne(tracing.Traced(req), bson.M{"_id": membership.ID}); err != nil {
+			log.Printf("Failed to remove member: %v", err)
+			problem.Error(w, "Failed to remove member", http.StatusInternalServerError)
+			return
+		}
+		client.Database("user").Collection("users").UpdateOne(tracing.Traced(req),
+			bson.M{"_id": userID, "org_id": org.ID}, bson.M{"$unset": bson.M{"org_id": ""}})
+		revokeMembership(membership, "")
+		recordAudit(req, "org_member_remove", org.ID.Hex(), membership, nil)
+		log.Printf("Removed user %s from organization %s", userID.Hex(), org.ID.Hex())
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// revokeMembership tells the other services that the user lost the
+// membership, or its admin role, so they refuse the user's tokens for the
+// organization that were issued before now. role is the user's remaining
+// role there, empty once they have left.
+func revokeMembership(membership *Membership, role string) {
+	publishEvent(tenant.RevokedEvent, map[string]interface{}{
+		"org_id":  membership.OrgID,
+		"user_id": membership.UserID,
+		"role":    role,
+	})
+}
+
+// lastAdmin reports whether the membership is its organization's only admin.
+func lastAdmin(membership *Membership) bool {
+	if membership.Role != orgRoleAdmin {
+		return false
+	}
+	count, err := memberships().CountDocuments(context.TODO(), bson.M{"org_id": membership.OrgID, "role": orgRoleAdmin})
+	return err != nil || count <= 1
+}
+
+func listMembers(w http.ResponseWriter, org *Organization) {
+	cursor, err := memberships().Find(context.TODO(), bson.M{"org_id": org.ID},
+		options.Find().SetSort(bson.D{{Key: "joined_at", Value: 1}}))
+	if err != nil {
+		log.Printf("Failed to list members: %v", err)
+		problem.Error(w, "Failed to list members", http.StatusInternalServerError)
+		return
+	}
+	var joined []Membership
+	if err := cursor.All(context.TODO(), &joined); err != nil {
+		log.Printf("Failed to decode members: %v", err)
+		problem.Error(w, "Failed to list members", http.StatusInternalServerError)
+		return
+	}
+
+	members := []Member{}
+	for _, membership := range joined {
+		user := loadUser(membership.UserID)
+		if user == nil || user.DeletedAt != nil {
+			continue
+		}
+		members = append(members, Member{
+			UserID:   user.ID,
+			Username: user.Username,
+			Email:    user.Email,
+			Role:     membership.Role,
+			JoinedAt: membership.JoinedAt,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+// orgInvitations lists (GET) and sends (POST) an organization's invitations
+// at /orgs/invitations/{org}, and revokes one (DELETE) at
+// /orgs/invitations/{org}/{invitation}. All of it takes an org admin.
+func orgInvitations(w http.ResponseWriter, req *http.Request) {
+	ids := pathIDs(req, "/orgs/invitations/")
+	org, role, ok := orgAccess(w, req, ids[0])
+	if !ok {
+		return
+	}
+	if role != orgRoleAdmin {
+		problem.Error(w, "Only organization admins can manage invitations", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case len(ids) == 1 && req.Method == http.MethodGet:
+		listInvitations(w, org)
+	case len(ids) == 1 && req.Method == http.MethodPost:
+		inviteMember(w, req, org)
+	case len(ids) == 2 && req.Method == http.MethodDelete:
+		invitationID, err := primitive.ObjectIDFromHex(ids[1])
+		if err != nil {
+			problem.Error(w, "Invalid invitation ID", http.StatusBadRequest)
+			return
+		}
+		result, err := invitations().DeleteOne(tracing.Traced(req), bson.M{"_id": invitationID, "org_id": org.ID})
+		if err != nil {
+			log.Printf("Failed to revoke invitation: %v", err)
+			problem.Error(w, "Failed to revoke invitation", http.StatusInternalServerError)
+			return
+		}
+		if result.DeletedCount == 0 {
+			problem.Error(w, "Invitation not found", http.StatusNotFound)
+			return
+		}
+		recordAudit(req, "org_invitation_revoke", org.ID.Hex(), nil, nil)
+		log.Printf("Revoked invitation %s", invitationID.Hex())
+		w.WriteHeader(http.StatusNoContent)
+	case len(ids) > 2:
+		problem.Error(w, "Not found", http.StatusNotFound)
+	default:
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listInvitations(w http.ResponseWriter, org *Organization) {
+	cursor, err := invitations().Find(context.TODO(),
+		bson.M{"org_id": org.ID, "expires_at": bson.M{"$gt": time.Now()}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		log.Printf("Failed to list invitations: %v", err)
+		problem.Error(w, "Failed to list invitations", http.StatusInternalServerError)
+		return
+	}
+	pending := []Invitation{}
+	if err := cursor.All(context.TODO(), &pending); err != nil {
+		log.Printf("Failed to decode invitations: %v", err)
+		problem.Error(w, "Failed to list invitations", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pending)
+}
+
+// inviteMember invites an email address to the organization, replacing an
+// earlier invitation for the same address.
+func inviteMember(w http.ResponseWriter, req *http.Request, org *Organization) {
+	var body struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+	if errs := validate.DecodeBody(req, &body); errs != nil {
+		problem.Validation(w, http.StatusBadRequest, errs)
+		return
+	}
+	if body.Role == "" {
+		body.Role = orgRoleMember
+	}
+	invitee := User{Email: body.Email}
+	normalizeUser(&invitee)
+	var errs validate.Errors
+	if errs.Required("email", invitee.Email) {
+		errs.Email("email", invitee.Email)
+	}
+	errs.OneOf("role", body.Role, orgRoleAdmin, orgRoleMember)
+	if errs != nil {
+		problem.Validation(w, http.StatusUnprocessableEntity, errs)
+		return
+	}
+	if user := userByEmail(invitee.Email); user != nil && membershipOf(org.ID, user.ID) != nil {
+		problem.Error(w, "This user is already a member", http.StatusConflict)
+		return
+	}
+
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		log.Printf("Failed to generate invitation token: %v", err)
+		problem.Error(w, "Failed to invite member", http.StatusInternalServerError)
+		return
+	}
+	tokenString := base64.RawURLEncoding.EncodeToString(token)
+	invitedBy, _ := req.Context().Value("userID").(string)
+	invitation := Invitation{
+		ID:        primitive.NewObjectID(),
+		OrgID:     org.ID,
+		Email:     invitee.Email,
+		Role:      body.Role,
+		TokenHash: hashInvitationToken(tokenString),
+		InvitedBy: invitedBy,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: time.Now().UTC().Add(invitationTTL),
+	}
+	if _, err := invitations().DeleteMany(tracing.Traced(req), bson.M{"org_id": org.ID, "email": invitation.Email}); err != nil {
+		log.Printf("Failed to replace invitation: %v", err)
+		problem.Error(w, "Failed to invite member", http.StatusInternalServerError)
+		return
+	}
+	if _, err := invitations().InsertOne(tracing.Traced(req), invitation); err != nil {
+		log.Printf("Failed to store invitation: %v", err)
+		problem.Error(w, "Failed to invite member", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(req, "org_invite", org.ID.Hex(), nil, invitation)
+
+	sendMail(Message{
+		To:      invitation.Email,
+		Subject: fmt.Sprintf("You are invited to %s", org.Name),
+		Body: fmt.Sprintf("Hi,\n\nYou are invited to join %s as %s %s. To accept, log in with this email address and open this link within 7 days:\n\n%s/accept-invitation?token=%s\n\nIf you do not have an account yet, register with this email address first.\n",
+			org.Name, article(invitation.Role), invitation.Role, appURL(), url.QueryEscape(tokenString)),
+	})
+
+	slog.InfoContext(req.Context(), "Invited a user to an organization", "invitation_id", invitation.ID.Hex(), "org_id", org.ID.Hex())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invitation)
+}
+
+func article(role string) string {
+	if role == orgRoleAdmin {
+		return "an"
+	}
+	return "a"
+}
+
+func hashInvitationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// acceptInvitation adds the requesting user to the organization they were
+// invited to, and logs them in to it. The invitation must be for their
+// email address, and works once.
+func acceptInvitation(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to accept an invitation")
+
+	if req.Method != http.MethodPost {
+		log.Println("Invalid request method")
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	if errs := validate.DecodeBody(req, &body); errs != nil {
+		problem.Validation(w, http.StatusBadRequest, errs)
+		return
+	}
+	var errs validate.Errors
+	if !errs.Required("token", body.Token) {
+		problem.Validation(w, http.StatusUnprocessableEntity, errs)
+		return
+	}
+
+	user := currentUser(req)
+	if user == nil {
+		problem.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	var invitation Invitation
+	err := invitations().FindOneAndDelete(tracing.Traced(req), bson.M{
+		"token_hash": hashInvitationToken(body.Token),
+		"email":      user.Email,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&invitation)
+	if err != nil {
+		problem.Error(w, "Invalid or expired invitation", http.StatusBadRequest)
+		return
+	}
+
+	if membershipOf(invitation.OrgID, user.ID) == nil {
+		membership, err := addMember(invitation.OrgID, user.ID, invitation.Role)
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			log.Printf("Failed to add member: %v", err)
+			problem.Error(w, "Failed to accept invitation", http.StatusInternalServerError)
+			return
+		}
+		if membership != nil {
+			recordAudit(req, "org_join", invitation.OrgID.Hex(), nil, membership)
+		}
+	}
+	if err := setCurrentOrg(user, invitation.OrgID); err != nil {
+		log.Printf("Failed to switch organization: %v", err)
+		problem.Error(w, "Failed to accept invitation", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s joined organization %s", user.ID.Hex(), invitation.OrgID.Hex())
+	writeToken(w, user)
+}
@@ -4,21 +4,63 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"log/slog"
 	"net/http"
+	"regexp"
+	"strings"
 	"time"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
         "github.com/dgrijalva/jwt-go"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/audit"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/auth"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/concurrency"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/eventbus"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/health"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/logging"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/mergepatch"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/metrics"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/server"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/softdelete"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/validate"
 )
 
 var client *mongo.Client
 
+// eventSource names the service in the events it publishes and its logs
+const eventSource = "user-service"
+
+var bus eventbus.Broker
+
+var outbox *eventbus.Outbox
+
+// publishEvent publishes an event from this service through its outbox.
+func publishEvent(eventType string, data interface{}) {
+	outbox.Publish(eventSource, eventType, data)
+}
+
+// recordAudit publishes the audit record of a mutating request. before and
+// after are the document as it was and as it is now; either may be nil for
+// creates and hard deletes.
+func recordAudit(req *http.Request, action, targetID string, before, after interface{}) {
+	publishEvent("audit.recorded", audit.FromRequest(eventSource, req, action, targetID, before, after))
+}
+
 func main() {
+	logging.Setup(eventSource)
+	shutdownTracing := tracing.Setup(eventSource)
+	defer shutdownTracing(context.Background())
+
 	// Create a new MongoDB client
 	var err error
-	client, err = mongo.NewClient(options.Client().ApplyURI("mongodb://user-mongodb:27017"))
+	client, err = mongo.NewClient(options.Client().ApplyURI("mongodb://user-mongodb:27017").SetMonitor(metrics.MongoMonitor()))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -30,7 +72,8 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer client.Disconnect(ctx)
+	defer client.Disconnect(context.Background())
+	health.AddCheck("mongodb", health.PingMongo(client))
 
 	// Check if the database and collection exist, create them if they don't
 	err = ensureDatabaseAndCollection(client)
@@ -38,6 +81,71 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Usernames and emails must be unique
+	err = ensureIndexes(client)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Failed login counters and the login history expire on their own
+	err = ensureLoginIndexes(client)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Each OpenID Connect account belongs to one user
+	err = ensureSSOIndexes(client)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Email tokens expire on their own
+	err = ensureEmailVerification(client)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = ensureAPIKeyIndexes(client)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Mail for email verification and password resets
+	mailer, err = newMailer()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Connect to the event bus
+	bus, err = eventbus.Connect()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer bus.Close()
+	health.AddCheck("eventbus", bus.Ping)
+
+	// Events go out through an outbox in the service's own database
+	outbox, err = eventbus.NewOutbox(client.Database("user").Collection("outbox"), bus)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.Go(outbox.Relay)
+
+	// Every user belongs to an organization; new memberships are announced
+	// through the outbox
+	err = ensureOrganizations(client)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Collect the cascade results reported by the other services
+	if err := startConsumers(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Purge soft-deleted users once their retention period has passed
+	server.Go(func() { softdelete.RetentionJob(client.Database("user").Collection("users")) })
+
 	// Create a new HTTP server
 	mux := http.NewServeMux()
 
@@ -45,14 +153,59 @@ func main() {
 	mux.Handle("/users/list", authMiddleware(adminMiddleware(http.HandlerFunc(listUsers))))
 	mux.Handle("/users/create", http.HandlerFunc(createUser))
 mux.Handle("/users/get/", authMiddleware(adminMiddleware(http.HandlerFunc(getUser))))
-mux.Handle("/users/update/", authMiddleware(adminMiddleware(http.HandlerFunc(updateUser))))
+mux.Handle("/users/update/", loginOnly(authMiddleware(http.HandlerFunc(updateUser))))
 mux.Handle("/users/remove/", authMiddleware(adminMiddleware(http.HandlerFunc(removeUser))))
-mux.Handle("/users/delete-all", http.HandlerFunc(deleteAllUsers))
+mux.Handle("/users/restore/", authMiddleware(adminMiddleware(http.HandlerFunc(restoreUser))))
 mux.Handle("/users/login", http.HandlerFunc(loginUser))
+mux.Handle("/users/deactivation-reports", authMiddleware(adminMiddleware(http.HandlerFunc(listDeactivationReports))))
+mux.Handle("/users/deactivation-report/", authMiddleware(adminMiddleware(http.HandlerFunc(getDeactivationReport))))
+	mux.Handle("/users/unlock/", authMiddleware(adminMiddleware(http.HandlerFunc(unlockUser))))
+	mux.Handle("/users/login-history/", authMiddleware(http.HandlerFunc(getLoginHistory)))
+	mux.Handle("/users/login/mfa", http.HandlerFunc(loginMFA))
+	mux.Handle("/users/mfa/enroll", loginOnly(enrollmentMiddleware(http.HandlerFunc(enrollMFA))))
+	mux.Handle("/users/mfa/confirm", loginOnly(enrollmentMiddleware(http.HandlerFunc(confirmMFA))))
+	mux.Handle("/users/mfa/disable", loginOnly(authMiddleware(http.HandlerFunc(disableMFA))))
+	mux.Handle("/users/mfa/recovery-codes", loginOnly(authMiddleware(http.HandlerFunc(regenerateRecoveryCodes))))
+	mux.Handle("/users/mfa/reset/", authMiddleware(adminMiddleware(http.HandlerFunc(resetMFA))))
+	mux.Handle("/users/oidc/login", http.HandlerFunc(loginOIDC))
+	mux.Handle("/users/verify-email", http.HandlerFunc(verifyEmail))
+	mux.Handle("/users/verify-email/resend", http.HandlerFunc(resendVerification))
+	mux.Handle("/users/password/forgot", http.HandlerFunc(forgotPassword))
+	mux.Handle("/users/password/reset", http.HandlerFunc(resetPassword))
+
+	// Organization endpoints
+	mux.Handle("/orgs/list", authMiddleware(http.HandlerFunc(listOrganizations)))
+	mux.Handle("/orgs/create", authMiddleware(http.HandlerFunc(createOrganizationHandler)))
+	mux.Handle("/orgs/get/", authMiddleware(http.HandlerFunc(getOrganization)))
+	mux.Handle("/orgs/switch/", loginOnly(authMiddleware(http.HandlerFunc(switchOrganization))))
+	mux.Handle("/orgs/members/", authMiddleware(http.HandlerFunc(orgMembers)))
+	mux.Handle("/orgs/invitations/", authMiddleware(http.HandlerFunc(orgInvitations)))
+	mux.Handle("/orgs/accept", loginOnly(authMiddleware(http.HandlerFunc(acceptInvitation))))
+
+	// Personal access tokens and service API keys
+	mux.Handle("/tokens/list", loginOnly(authMiddleware(http.HandlerFunc(listPersonalTokens))))
+	mux.Handle("/tokens/create", loginOnly(authMiddleware(http.HandlerFunc(createPersonalToken))))
+	mux.Handle("/tokens/revoke/", loginOnly(authMiddleware(http.HandlerFunc(revokePersonalToken))))
+	mux.Handle("/apikeys/list", loginOnly(authMiddleware(http.HandlerFunc(listServiceKeys))))
+	mux.Handle("/apikeys/create", loginOnly(authMiddleware(http.HandlerFunc(createServiceKey))))
+	mux.Handle("/apikeys/revoke/", loginOnly(authMiddleware(http.HandlerFunc(revokeServiceKey))))
+	// Only called by the gateway, which does not route /internal/
+	mux.Handle("/internal/apikeys/exchange", http.HandlerFunc(exchangeAPIKey))
+
+	// Liveness and readiness checks, used by the API gateway and Kubernetes
+	mux.HandleFunc("/healthz", health.Healthz)
+	mux.HandleFunc("/readyz", health.Readyz)
+
+	// Prometheus metrics
+	prometheus.MustRegister(metrics.NewCountGauge("users_active", "Users that are not deleted.",
+		func() *mongo.Collection { return client.Database("user").Collection("users") },
+		softdelete.NotDeleted(bson.M{})))
+	mux.Handle("/metrics", promhttp.Handler())
 
 	// Start the server
 	log.Println("User Service listening on port 8001...")
-	log.Fatal(http.ListenAndServe(":8001", mux))
+	route := metrics.MuxRoute(mux)
+	server.Run(":8001", tracing.Middleware(logging.Middleware(metrics.Middleware(auth.RequireScopes(mux), route)), route))
 }
 
 func ensureDatabaseAndCollection(client *mongo.Client) error {
@@ -108,22 +261,45 @@ func ensureDatabaseAndCollection(client *mongo.Client) error {
 	return nil
 }
 
+// ensureIndexes creates the unique indexes on username and email. Usernames
+// compare case-insensitively; emails are stored lowercased. Soft-deleted
+// users keep their username and email so that they can be restored.
+func ensureIndexes(client *mongo.Client) error {
+	collection := client.Database("user").Collection("users")
+	_, err := collection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "username", Value: 1}},
+			Options: options.Index().SetName("username_unique").SetUnique(true).SetCollation(&options.Collation{Locale: "en", Strength: 2}),
+		},
+		{
+			Keys:    bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().SetName("email_unique").SetUnique(true),
+		},
+	})
+	return err
+}
+
 type User struct {
 	ID       primitive.ObjectID `bson:"_id" json:"id"`
 	Username string             `bson:"username" json:"username"`
 	Email    string             `bson:"email" json:"email"`
 	Password string             `bson:"password" json:"password"`
         Role     string             `bson:"role" json:"role"`
+	EmailVerified bool              `bson:"email_verified" json:"email_verified"`
+	SSO       *SSOIdentity      `bson:"sso,omitempty" json:"sso,omitempty"`
+	OrgID     *primitive.ObjectID `bson:"org_id,omitempty" json:"org_id,omitempty"`
+	DeletedAt *time.Time        `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	DeletedBy string            `bson:"deleted_by,omitempty" json:"deleted_by,omitempty"`
+	Version   int64             `bson:"version" json:"version"`
 }
 
 
 func createUser(w http.ResponseWriter, req *http.Request) {
  
     var user User
-    err := json.NewDecoder(req.Body).Decode(&user)
-    if err != nil {
-        log.Printf("Invalid request body: %v", err)
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+    if errs := validate.DecodeBody(req, &user); errs != nil {
+        log.Printf("Invalid request body: %v", errs)
+        problem.Validation(w, http.StatusBadRequest, errs)
         return
     }
 
@@ -132,18 +308,41 @@ func createUser(w http.ResponseWriter, req *http.Request) {
         user.Role = "regular"
     }
 
-    log.Printf("Creating user: %+v", user)
+    normalizeUser(&user)
+    if errs := validateUser(user); len(errs) > 0 {
+        problem.Validation(w, http.StatusUnprocessableEntity, errs)
+        return
+    }
+
+    // Nobody is verified until they follow the link sent to them
+    user.EmailVerified = false
+    user.OrgID = nil
+
+    slog.InfoContext(req.Context(), "Creating user", "user", user)
 
     collection := client.Database("user").Collection("users")
     user.ID = primitive.NewObjectID()
-    _, err = collection.InsertOne(context.TODO(), user)
+    user.Version = 1
+    _, err := collection.InsertOne(tracing.Traced(req), user)
+    if errs := duplicateErrors(err); errs != nil {
+        problem.Validation(w, http.StatusConflict, errs)
+        return
+    }
     if err != nil {
         log.Printf("Failed to create user: %v", err)
-        http.Error(w, "Failed to create user", http.StatusInternalServerError)
+        problem.Error(w, "Failed to create user", http.StatusInternalServerError)
         return
     }
 
-    log.Printf("User created successfully: %+v", user)
+    recordAudit(req, "create", user.ID.Hex(), nil, user)
+    sendVerificationEmail(&user)
+
+    // Everyone starts out in an organization of their own
+    if _, err := createOrganization(user.Username+"'s organization", &user); err != nil {
+        log.Printf("Failed to create organization for user %s: %v", user.ID.Hex(), err)
+    }
+
+    slog.InfoContext(req.Context(), "User created", "user", user)
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusCreated) // Set status to 201 Created
     json.NewEncoder(w).Encode(user)
@@ -154,7 +353,7 @@ func loginUser(w http.ResponseWriter, req *http.Request) {
 
     if req.Method != http.MethodPost {
         log.Println("Invalid request method for user login")
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         return
     }
 
@@ -166,39 +365,52 @@ func loginUser(w http.ResponseWriter, req *http.Request) {
     err := json.NewDecoder(req.Body).Decode(&credentials)
     if err != nil {
         log.Println("Failed to decode request body:", err)
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        problem.Error(w, "Invalid request body", http.StatusBadRequest)
         return
     }
 
     log.Printf("Login attempt for username: %s", credentials.Username)
 
+    // Refuse logins for a locked out username or IP without checking the password
+    if refuseLockedOut(w, req, credentials.Username) {
+        return
+    }
+
     collection := client.Database("user").Collection("users")
-    filter := bson.M{"username": credentials.Username, "password": credentials.Password}
+    filter := softdelete.NotDeleted(bson.M{"username": credentials.Username, "password": credentials.Password})
 
     var user User
-    err = collection.FindOne(context.TODO(), filter).Decode(&user)
+    err = collection.FindOne(tracing.Traced(req), filter).Decode(&user)
     if err != nil {
         log.Println("Invalid username or password")
-        http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+        recordLoginFailure(credentials.Username, clientIP(req))
+        recordLogin(req, userIDByUsername(credentials.Username), credentials.Username, false, "invalid_credentials")
+        problem.Error(w, "Invalid username or password", http.StatusUnauthorized)
         return
     }
 
-    log.Printf("User logged in successfully: %+v", user)
+    // The password is right, but the account cannot be used until its
+    // email address is verified
+    if !user.EmailVerified {
+        log.Printf("Login refused for unverified user %s", user.ID.Hex())
+        recordLogin(req, &user.ID, user.Username, false, "unverified")
+        problem.Error(w, "Email address is not verified", http.StatusForbidden)
+        return
+    }
 
+    // Users with MFA, and every admin, still have to pass the second step
+    if requireSecondFactor(w, &user) {
+        return
+    }
+    completeLogin(req, &user)
 
-    // Generate JWT token
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-        "userID": user.ID.Hex(),
-        "role":   user.Role,
-        "exp":    time.Now().Add(time.Hour * 24).Unix(), // Token expires in 24 hours
-    })
+    slog.InfoContext(req.Context(), "User logged in", "user_id", user.ID.Hex(), "username", user.Username)
 
-    // Sign the token with a secret key
-    secretKey := []byte("your-secret-key")
-    tokenString, err := token.SignedString(secretKey)
+
+    tokenString, err := issueToken(&user)
     if err != nil {
         log.Println("Failed to generate JWT token:", err)
-        http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+        problem.Error(w, "Failed to generate token", http.StatusInternalServerError)
         return
     }
 
@@ -213,12 +425,33 @@ func loginUser(w http.ResponseWriter, req *http.Request) {
     json.NewEncoder(w).Encode(user)
 }
 
+// issueToken generates the JWT a user is logged in with. It names the
+// organization the user works in and their role there; users who belong
+// to no organization get a token without them.
+func issueToken(user *User) (string, error) {
+    claims := jwt.MapClaims{
+        "userID": user.ID.Hex(),
+        "role":   user.Role,
+        "iat":    time.Now().Unix(),
+        "exp":    time.Now().Add(time.Hour * 24).Unix(), // Token expires in 24 hours
+    }
+    if membership := currentMembership(user); membership != nil {
+        claims["org_id"] = membership.OrgID.Hex()
+        claims["org_role"] = membership.Role
+    }
+    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+    // Sign the token with a secret key
+    secretKey := []byte("your-secret-key")
+    return token.SignedString(secretKey)
+}
+
 func getUser(w http.ResponseWriter, req *http.Request) {
 	log.Println("Received request to get user")
 
 	if req.Method != http.MethodGet {
 		log.Println("Invalid request method")
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
@@ -226,25 +459,26 @@ func getUser(w http.ResponseWriter, req *http.Request) {
 	objectID, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		log.Printf("Invalid user ID: %v", err)
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		problem.Error(w, "Invalid user ID", http.StatusBadRequest)
 		return
 	}
 
 	log.Printf("Getting user with ID: %s", userID)
 
 	collection := client.Database("user").Collection("users")
-	filter := bson.M{"_id": objectID}
+	filter := softdelete.Scope(req, bson.M{"_id": objectID})
 
 	var user User
-	err = collection.FindOne(context.TODO(), filter).Decode(&user)
+	err = collection.FindOne(tracing.Traced(req), filter).Decode(&user)
 	if err != nil {
 		log.Printf("User not found: %v", err)
-		http.Error(w, "User not found", http.StatusNotFound)
+		problem.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	log.Printf("User found: %+v", user)
+	slog.InfoContext(req.Context(), "User found", "user", user)
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", concurrency.ETag(user.Version))
 	w.WriteHeader(http.StatusOK)
        json.NewEncoder(w).Encode(user)
 }
@@ -252,9 +486,19 @@ func getUser(w http.ResponseWriter, req *http.Request) {
 func updateUser(w http.ResponseWriter, req *http.Request) {
 	log.Println("Received request to update user")
 
+	// Users may patch their own account; everything else is admin only
+	if req.Method == http.MethodPatch {
+		patchUser(w, req)
+		return
+	}
+	if !isAdmin(req) {
+		problem.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	if req.Method != http.MethodPut {
 		log.Println("Invalid request method")
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
@@ -262,45 +506,225 @@ func updateUser(w http.ResponseWriter, req *http.Request) {
 	objectID, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		log.Printf("Invalid user ID: %v", err)
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		problem.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	version, status, err := concurrency.IfMatch(req)
+	if err != nil {
+		problem.Error(w, err.Error(), status)
 		return
 	}
 
 	log.Printf("Updating user with ID: %s", userID)
 
 	var user User
-	err = json.NewDecoder(req.Body).Decode(&user)
-	if err != nil {
-		log.Printf("Invalid request body: %v", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if errs := validate.DecodeBody(req, &user); errs != nil {
+		log.Printf("Invalid request body: %v", errs)
+		problem.Validation(w, http.StatusBadRequest, errs)
+		return
+	}
+
+	// PUT does not change the role, so validate against the current one
+	before := loadUser(objectID)
+	if before == nil || before.DeletedAt != nil {
+		problem.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	user.Role = before.Role
+	normalizeUser(&user)
+	if errs := validateUser(user); len(errs) > 0 {
+		problem.Validation(w, http.StatusUnprocessableEntity, errs)
 		return
 	}
 
 	collection := client.Database("user").Collection("users")
-	filter := bson.M{"_id": objectID}
+	filter := concurrency.MatchVersion(softdelete.NotDeleted(bson.M{"_id": objectID}), version)
+	// A new email address has to be verified again
+	emailChanged := user.Email != before.Email
 	update := bson.M{"$set": bson.M{
-		"username": user.Username,
-		"email":    user.Email,
-		"password": user.Password,
+		"username":       user.Username,
+		"email":          user.Email,
+		"password":       user.Password,
+		"email_verified": before.EmailVerified && !emailChanged,
 	}}
 
-	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	result, err := collection.UpdateOne(tracing.Traced(req), filter, concurrency.BumpVersion(update))
+	if errs := duplicateErrors(err); errs != nil {
+		problem.Validation(w, http.StatusConflict, errs)
+		return
+	}
 	if err != nil {
 		log.Printf("Failed to update user: %v", err)
-		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		problem.Error(w, "Failed to update user", http.StatusInternalServerError)
 		return
 	}
+	if result.MatchedCount == 0 {
+		status, message := concurrency.Conflict(collection, bson.M{"_id": objectID})
+		problem.Error(w, "User "+message, status)
+		return
+	}
+
+	after := loadUser(objectID)
+	recordAudit(req, "update", userID, before, after)
+	if emailChanged && after != nil {
+		sendVerificationEmail(after)
+	}
 
-	log.Printf("User updated successfully: %+v", user)
+	slog.InfoContext(req.Context(), "User updated", "user", user)
+	w.Header().Set("ETag", concurrency.ETag(version+1))
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// Fields each role may change with PATCH. Regular users can only patch
+// their own account.
+var userPatchFields = map[string]map[string]bool{
+	"admin":   {"username": true, "email": true, "password": true, "role": true},
+	"regular": {"email": true, "password": true},
+}
+
+// patchUser applies a JSON merge patch to a user, so only the fields in
+// the patch change. The patched user is validated and written in one
+// versioned replace.
+func patchUser(w http.ResponseWriter, req *http.Request) {
+	userID := req.URL.Path[len("/users/update/"):]
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		log.Printf("Invalid user ID: %v", err)
+		problem.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	role, _ := req.Context().Value("role").(string)
+	if role != "admin" && req.Context().Value("userID") != userID {
+		problem.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	version, status, err := concurrency.IfMatch(req)
+	if err != nil {
+		problem.Error(w, err.Error(), status)
+		return
+	}
+
+	patch, err := mergepatch.Decode(req)
+	if err != nil {
+		problem.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := mergepatch.CheckFields(patch, userPatchFields[role]); err != nil {
+		problem.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	log.Printf("Patching user with ID: %s", userID)
+
+	collection := client.Database("user").Collection("users")
+	var currentUser User
+	err = collection.FindOne(tracing.Traced(req), softdelete.NotDeleted(bson.M{"_id": objectID})).Decode(&currentUser)
+	if err != nil {
+		problem.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if currentUser.Version != version {
+		problem.Error(w, "User has been modified, fetch it again and retry", http.StatusPreconditionFailed)
+		return
+	}
+
+	patched := currentUser
+	if err := mergepatch.Into(&patched, patch); err != nil {
+		problem.Validation(w, http.StatusBadRequest, validate.JSONErrors(err))
+		return
+	}
+	normalizeUser(&patched)
+	if errs := validateUser(patched); len(errs) > 0 {
+		problem.Validation(w, http.StatusUnprocessableEntity, errs)
+		return
+	}
+	// A new email address has to be verified again
+	emailChanged := patched.Email != currentUser.Email
+	if emailChanged {
+		patched.EmailVerified = false
+	}
+
+	patched.Version = version + 1
+	result, err := collection.ReplaceOne(tracing.Traced(req), concurrency.MatchVersion(softdelete.NotDeleted(bson.M{"_id": objectID}), version), patched)
+	if errs := duplicateErrors(err); errs != nil {
+		problem.Validation(w, http.StatusConflict, errs)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to patch user: %v", err)
+		problem.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		status, message := concurrency.Conflict(collection, bson.M{"_id": objectID})
+		problem.Error(w, "User "+message, status)
+		return
+	}
+
+	recordAudit(req, "update", userID, currentUser, patched)
+	if emailChanged {
+		sendVerificationEmail(&patched)
+	}
+
+	log.Printf("User patched successfully: %s", userID)
+	w.Header().Set("ETag", concurrency.ETag(patched.Version))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// normalizeUser trims the username and lowercases the email, so the unique
+// indexes see one spelling of each.
+func normalizeUser(user *User) {
+	user.Username = strings.TrimSpace(user.Username)
+	user.Email = strings.ToLower(strings.TrimSpace(user.Email))
+}
+
+// validateUser checks a complete user against the user schema.
+func validateUser(user User) validate.Errors {
+	var errs validate.Errors
+	if errs.Required("username", user.Username) {
+		errs.Length("username", user.Username, 3, 32)
+		errs.Pattern("username", user.Username, usernamePattern, "contain only letters, digits, '.', '_' and '-'")
+	}
+	if errs.Required("email", user.Email) {
+		errs.Email("email", user.Email)
+	}
+	if errs.Required("password", user.Password) {
+		errs.Length("password", user.Password, 6, 128)
+	}
+	errs.OneOf("role", user.Role, "admin", "regular")
+	return errs
+}
+
+// duplicateErrors reports which unique field a failed write collided on,
+// or nil if err is not a duplicate key error.
+func duplicateErrors(err error) validate.Errors {
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	var errs validate.Errors
+	if strings.Contains(err.Error(), "username_unique") {
+		errs.Add("username", "is already taken")
+	}
+	if strings.Contains(err.Error(), "email_unique") {
+		errs.Add("email", "is already registered")
+	}
+	if errs == nil {
+		errs.Add("body", "conflicts with an existing user")
+	}
+	return errs
+}
+
 func removeUser(w http.ResponseWriter, req *http.Request) {
 	log.Println("Received request to remove user")
 
 	if req.Method != http.MethodDelete {
 		log.Println("Invalid request method")
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
@@ -308,40 +732,121 @@ func removeUser(w http.ResponseWriter, req *http.Request) {
 	objectID, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		log.Printf("Invalid user ID: %v", err)
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		problem.Error(w, "Invalid user ID", http.StatusBadRequest)
 		return
 	}
 
+	// Open tasks can be handed over to another user instead of being unassigned
+	var reassignTo *primitive.ObjectID
+	if target := req.URL.Query().Get("reassign_to"); target != "" {
+		targetID, err := primitive.ObjectIDFromHex(target)
+		if err != nil || targetID == objectID {
+			problem.Error(w, "Invalid reassign_to user ID", http.StatusBadRequest)
+			return
+		}
+		err = client.Database("user").Collection("users").FindOne(tracing.Traced(req), softdelete.NotDeleted(bson.M{"_id": targetID})).Err()
+		if err != nil {
+			problem.Error(w, "reassign_to user not found", http.StatusBadRequest)
+			return
+		}
+		reassignTo = &targetID
+	}
+
 	log.Printf("Removing user with ID: %s", userID)
 
 	collection := client.Database("user").Collection("users")
-	filter := bson.M{"_id": objectID}
-
-	_, err = collection.DeleteOne(context.TODO(), filter)
+	filter := softdelete.NotDeleted(bson.M{"_id": objectID})
+
+	// Users are deactivated rather than deleted so their tasks and billings
+	// can be cleaned up by the other services.
+	before := loadUser(objectID)
+	now := time.Now().UTC()
+	deletedBy, _ := req.Context().Value("userID").(string)
+	result, err := collection.UpdateOne(tracing.Traced(req), filter, concurrency.BumpVersion(bson.M{"$set": bson.M{
+		"deleted_at": now,
+		"deleted_by": deletedBy,
+	}}))
 	if err != nil {
 		log.Printf("Failed to remove user: %v", err)
-		http.Error(w, "Failed to remove user", http.StatusInternalServerError)
+		problem.Error(w, "Failed to remove user", http.StatusInternalServerError)
 		return
 	}
+	if result.MatchedCount == 0 {
+		problem.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(req, "delete", userID, before, loadUser(objectID))
+
+	err = startDeactivationReport(objectID, deletedBy, now, reassignTo)
+	if err != nil {
+		log.Printf("Failed to create deactivation report for %s: %v", userID, err)
+	}
+
+	publishEvent("user.deactivated", map[string]interface{}{
+		"user_id":        objectID,
+		"reassign_to":    reassignTo,
+		"deactivated_by": deletedBy,
+		"deactivated_at": now,
+	})
 
 	log.Printf("User removed successfully: %s", userID)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func restoreUser(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to restore user")
+
+	if req.Method != http.MethodPost {
+		log.Println("Invalid request method")
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := req.URL.Path[len("/users/restore/"):]
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		log.Printf("Invalid user ID: %v", err)
+		problem.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	collection := client.Database("user").Collection("users")
+	before := loadUser(objectID)
+	result, err := softdelete.Restore(collection, bson.M{"_id": objectID})
+	if err != nil {
+		log.Printf("Failed to restore user: %v", err)
+		problem.Error(w, "Failed to restore user", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		problem.Error(w, "Deleted user not found", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(req, "restore", userID, before, loadUser(objectID))
+
+	// Tasks that were unassigned or reassigned stay where they are
+	publishEvent("user.restored", map[string]interface{}{"user_id": objectID})
+
+	log.Printf("User restored successfully: %s", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func listUsers(w http.ResponseWriter, req *http.Request) {
 	log.Println("Received request to list users")
 
 	if req.Method != http.MethodGet {
 		log.Println("Invalid request method")
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	collection := client.Database("user").Collection("users")
-	cursor, err := collection.Find(context.TODO(), bson.M{})
+	cursor, err := collection.Find(tracing.Traced(req), softdelete.Scope(req, bson.M{}))
 	if err != nil {
 		log.Printf("Failed to list users: %v", err)
-		http.Error(w, "Failed to list users", http.StatusInternalServerError)
+		problem.Error(w, "Failed to list users", http.StatusInternalServerError)
 		return
 	}
 	defer cursor.Close(context.Background())
@@ -350,33 +855,23 @@ func listUsers(w http.ResponseWriter, req *http.Request) {
 	err = cursor.All(context.Background(), &users)
 	if err != nil {
 		log.Printf("Failed to decode users: %v", err)
-		http.Error(w, "Failed to decode users", http.StatusInternalServerError)
+		problem.Error(w, "Failed to decode users", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Users listed successfully: %+v", users)
+	slog.InfoContext(req.Context(), "Users listed", "count", len(users))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(users)
 }
 
-func deleteAllUsers(w http.ResponseWriter, req *http.Request) {
-	log.Println("Received request to delete all users")
-
-	if req.Method != http.MethodDelete {
-		log.Println("Invalid request method")
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	collection := client.Database("user").Collection("users")
-	_, err := collection.DeleteMany(context.TODO(), bson.M{})
+// loadUser returns the user with the given ID, including a soft-deleted
+// one, or nil if it does not exist.
+func loadUser(objectID primitive.ObjectID) *User {
+	var user User
+	err := client.Database("user").Collection("users").FindOne(context.TODO(), bson.M{"_id": objectID}).Decode(&user)
 	if err != nil {
-		log.Printf("Failed to delete users: %v", err)
-		http.Error(w, "Failed to delete users", http.StatusInternalServerError)
-		return
+		return nil
 	}
-
-	log.Println("All users deleted successfully")
-	w.WriteHeader(http.StatusNoContent)
+	return &user
 }
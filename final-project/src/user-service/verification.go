@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/concurrency"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/softdelete"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/validate"
+)
+
+// New accounts have to verify their email address before they can log in,
+// and a forgotten password is reset through a link sent by email. The
+// links carry signed tokens that expire and work once: each token is also
+// stored, and using it deletes it. Sending a new link replaces the user's
+// earlier ones.
+//
+// Like challenge tokens, email tokens are signed with their own key, so the
+// services never accept one in place of a JWT.
+
+const (
+	verifyEmailTTL   = 24 * time.Hour
+	resetPasswordTTL = time.Hour
+
+	purposeVerifyEmail   = "verify_email"
+	purposeResetPassword = "reset_password"
+)
+
+var emailTokenKey = []byte("your-email-token-key")
+
+// emailToken is an unused email token. Email is the address a
+// verification token was sent to, which must still be the user's.
+type emailToken struct {
+	ID        string             `bson:"_id"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	Purpose   string             `bson:"purpose"`
+	Email     string             `bson:"email"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+}
+
+func emailTokens() *mongo.Collection {
+	return client.Database("user").Collection("email_tokens")
+}
+
+// ensureEmailVerification creates the email token indexes and marks users
+// created before verification existed as verified.
+func ensureEmailVerification(client *mongo.Client) error {
+	_, err := client.Database("user").Collection("email_tokens").Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "purpose", Value: 1}},
+			Options: options.Index().SetName("user_purpose"),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.Database("user").Collection("users").UpdateMany(context.Background(),
+		bson.M{"email_verified": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"email_verified": true}})
+	return err
+}
+
+// appURL is where the links in emails point: the frontend, which posts
+// the token to the API.
+func appURL() string {
+	if value := os.Getenv("APP_URL"); value != "" {
+		return value
+	}
+	return "http://localhost:3000"
+}
+
+// issueEmailToken replaces the user's tokens for the purpose with a new one.
+func issueEmailToken(user *User, purpose string, ttl time.Duration) (string, error) {
+	if _, err := emailTokens().DeleteMany(context.TODO(), bson.M{"user_id": user.ID, "purpose": purpose}); err != nil {
+		return "", err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	record := emailToken{
+		ID:        hex.EncodeToString(id),
+		UserID:    user.ID,
+		Purpose:   purpose,
+		Email:     user.Email,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if _, err := emailTokens().InsertOne(context.TODO(), record); err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"jti":     record.ID,
+		"userID":  user.ID.Hex(),
+		"purpose": purpose,
+		"exp":     record.ExpiresAt.Unix(),
+	})
+	return token.SignedString(emailTokenKey)
+}
+
+// useEmailToken checks a token's signature and uses it up, returning nil
+// if it is invalid, expired or already used.
+func useEmailToken(tokenString, purpose string) *emailToken {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return emailTokenKey, nil
+	})
+	if err != nil || !token.Valid {
+		return nil
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	id, _ := claims["jti"].(string)
+	if id == "" || claims["purpose"] != purpose {
+		return nil
+	}
+
+	var record emailToken
+	err = emailTokens().FindOneAndDelete(context.TODO(), bson.M{
+		"_id":        id,
+		"purpose":    purpose,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&record)
+	if err != nil {
+		return nil
+	}
+	return &record
+}
+
+// sendVerificationEmail mails the user a link to verify their address.
+func sendVerificationEmail(user *User) {
+	token, err := issueEmailToken(user, purposeVerifyEmail, verifyEmailTTL)
+	if err != nil {
+		log.Printf("Failed to issue verification token for user %s: %v", user.ID.Hex(), err)
+		return
+	}
+	sendMail(Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nTo verify your email address, open this link within 24 hours:\n\n%s/verify-email?token=%s\n\nIf you did not create an account, ignore this email.\n",
+			user.Username, appURL(), url.QueryEscape(token)),
+	})
+}
+
+// sendPasswordResetEmail mails the user a link to choose a new password.
+func sendPasswordResetEmail(user *User) {
+	token, err := issueEmailToken(user, purposeResetPassword, resetPasswordTTL)
+	if err != nil {
+		log.Printf("Failed to issue password reset token for user %s: %v", user.ID.Hex(), err)
+		return
+	}
+	sendMail(Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nTo choose a new password, open this link within an hour:\n\n%s/reset-password?token=%s\n\nIf you did not ask to reset your password, ignore this email; your password has not changed.\n",
+			user.Username, appURL(), url.QueryEscape(token)),
+	})
+}
+
+// userByEmail returns the user with the given email, or nil.
+func userByEmail(email string) *User {
+	var user User
+	err := client.Database("user").Collection("users").FindOne(context.TODO(), softdelete.NotDeleted(bson.M{"email": email})).Decode(&user)
+	if err != nil {
+		return nil
+	}
+	return &user
+}
+
+// verifyEmail marks the user's email address as verified.
+func verifyEmail(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to verify email")
+
+	if req.Method != http.MethodPost {
+		log.Println("Invalid request method")
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	if errs := validate.DecodeBody(req, &body); errs != nil {
+		problem.Validation(w, http.StatusBadRequest, errs)
+		return
+	}
+	var errs validate.Errors
+	if !errs.Required("token", body.Token) {
+		problem.Validation(w, http.StatusUnprocessableEntity, errs)
+		return
+	}
+
+	record := useEmailToken(body.Token, purposeVerifyEmail)
+	if record == nil {
+		problem.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	before := loadUser(record.UserID)
+	if before == nil || before.DeletedAt != nil || before.Email != record.Email {
+		problem.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+
+	collection := client.Database("user").Collection("users")
+	filter := softdelete.NotDeleted(bson.M{"_id": record.UserID, "email": record.Email})
+	update := bson.M{"$set": bson.M{"email_verified": true}}
+	result, err := collection.UpdateOne(tracing.Traced(req), filter, concurrency.BumpVersion(update))
+	if err != nil {
+		log.Printf("Failed to verify email: %v", err)
+		problem.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		problem.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+
+	recordAudit(req, "verify_email", record.UserID.Hex(), before, loadUser(record.UserID))
+
+	log.Printf("Email verified for user %s", record.UserID.Hex())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resendVerification sends another verification link. It answers the same
+// whether or not the address belongs to an unverified user, so it cannot
+// be used to find out who has an account.
+func resendVerification(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to resend verification email")
+
+	email, ok := decodeEmail(w, req)
+	if !ok {
+		return
+	}
+	if user := userByEmail(email); user != nil && !user.EmailVerified {
+		sendVerificationEmail(user)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// forgotPassword sends a password reset link. Like resendVerification, it
+// answers the same whether or not the address has an account.
+func forgotPassword(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request for a password reset")
+
+	email, ok := decodeEmail(w, req)
+	if !ok {
+		return
+	}
+	if user := userByEmail(email); user != nil {
+		sendPasswordResetEmail(user)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// decodeEmail reads the {"email": ...} body of the requests that send
+// mail, answering the request if it is invalid.
+func decodeEmail(w http.ResponseWriter, req *http.Request) (string, bool) {
+	if req.Method != http.MethodPost {
+		log.Println("Invalid request method")
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return "", false
+	}
+
+	var body struct {
+		Email string `json:"email"`
+	}
+	if errs := validate.DecodeBody(req, &body); errs != nil {
+		problem.Validation(w, http.StatusBadRequest, errs)
+		return "", false
+	}
+	user := User{Email: body.Email}
+	normalizeUser(&user)
+	var errs validate.Errors
+	if errs.Required("email", user.Email) {
+		errs.Email("email", user.Email)
+	}
+	if errs != nil {
+		problem.Validation(w, http.StatusUnprocessableEntity, errs)
+		return "", false
+	}
+	return user.Email, true
+}
+
+// resetPassword sets a new password with a token from a reset link. The
+// link proves the user reads mail at their address, so it also verifies
+// it, and it clears the user's failed logins.
+func resetPassword(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received request to reset password")
+
+	if req.Method != http.MethodPost {
+		log.Println("Invalid request method")
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if errs := validate.DecodeBody(req, &body); errs != nil {
+		problem.Validation(w, http.StatusBadRequest, errs)
+		return
+	}
+	var errs validate.Errors
+	errs.Required("token", body.Token)
+	if errs.Required("password", body.Password) {
+		errs.Length("password", body.Password, 6, 128)
+	}
+	if errs != nil {
+		problem.Validation(w, http.StatusUnprocessableEntity, errs)
+		return
+	}
+
+	record := useEmailToken(body.Token, purposeResetPassword)
+	if record == nil {
+		problem.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	before := loadUser(record.UserID)
+	if before == nil || before.DeletedAt != nil {
+		problem.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+
+	collection := client.Database("user").Collection("users")
+	update := bson.M{"$set": bson.M{
+		"password":       body.Password,
+		"email_verified": before.EmailVerified || before.Email == record.Email,
+	}}
+	result, err := collection.UpdateOne(tracing.Traced(req), softdelete.NotDeleted(bson.M{"_id": record.UserID}), concurrency.BumpVersion(update))
+	if err != nil {
+		log.Printf("Failed to reset password: %v", err)
+		problem.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		problem.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	if err := clearLoginFailures(before.Username); err != nil {
+		log.Printf("Failed to clear failed logins: %v", err)
+	}
+
+	recordAudit(req, "reset_password", record.UserID.Hex(), before, loadUser(record.UserID))
+
+	log.Printf("Password reset for user %s", record.UserID.Hex())
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// Webhook URLs are chosen by users, so a delivery must not be a way to
+// reach the services and metadata endpoints inside the deployment. The
+// host of a URL is checked when the subscription is created, and every
+// connection a delivery makes is checked again once the host has been
+// resolved, so a host that later resolves to an internal address, or a
+// redirect to one, is refused too.
+
+var errBlockedTarget = errors.New("private, loopback and link-local addresses are not allowed")
+
+// blockedIP reports whether deliveries must not connect to ip.
+func blockedIP(ip net.IP) bool {
+	return ip.IsPrivate() ||
+		ip.IsLoopback() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsUnspecified()
+}
+
+// checkTargetHost resolves a webhook URL's host and rejects it if any of
+// its addresses is blocked.
+func checkTargetHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("could not be resolved")
+	}
+	for _, addr := range addrs {
+		if blockedIP(addr.IP) {
+			return errBlockedTarget
+		}
+	}
+	return nil
+}
+
+// deliveryClient posts webhook deliveries. It refuses to connect to blocked
+// addresses, and ignores proxy settings so the check applies to the
+// endpoint itself.
+var deliveryClient = &http.Client{
+	Timeout: deliveryTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: deliveryTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || blockedIP(ip) {
+					return errBlockedTarget
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: deliveryTimeout,
+		MaxIdleConnsPerHost: 2,
+	},
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/eventbus"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tenant"
+)
+
+// Every subscription belongs to the organization its creator's token
+// named, and only receives the events of that organization: the org_id in
+// an event's data has to match. Billing events carry amounts and rates, so
+// they only go to subscriptions created by admins. The webhook routes are
+// scoped to the token's organization with tenant.InOrg; admins of the
+// organization manage all of its subscriptions.
+
+// billingEvents are the events only admins' subscriptions receive.
+var billingEvents = map[string]bool{
+	"billing.created": true,
+	"invoice.created": true,
+}
+
+// tenants holds the membership revocations that tenantMiddleware checks.
+var tenants *tenant.Revocations
+
+// tenantMiddleware authenticates the request and scopes it to the
+// organization its token names; see tenant.Revocations.Middleware.
+func tenantMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(tenants.Middleware(next))
+}
+
+// ensureTenancy indexes subscriptions by organization. Subscriptions from
+// before organizations existed have none and receive no events.
+func ensureTenancy(client *mongo.Client) error {
+	_, err := client.Database("webhook").Collection("subscriptions").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "org_id", Value: 1}, {Key: "active", Value: 1}},
+		Options: options.Index().SetName("org_active"),
+	})
+	return err
+}
+
+// eventOrg returns the organization named in an event's data, if any.
+func eventOrg(event eventbus.Event) (primitive.ObjectID, bool) {
+	var data struct {
+		OrgID primitive.ObjectID `json:"org_id"`
+	}
+	if err := json.Unmarshal(event.Data, &data); err != nil || data.OrgID.IsZero() {
+		return primitive.NilObjectID, false
+	}
+	return data.OrgID, true
+}
+
+// subscriptionFilter selects the active subscriptions an event goes to.
+func subscriptionFilter(event eventbus.Event, orgID primitive.ObjectID) bson.M {
+	filter := bson.M{
+		"active": true,
+		"org_id": orgID,
+		"events": bson.M{"$in": []string{event.Type, "*"}},
+	}
+	if billingEvents[event.Type] {
+		filter["role"] = "admin"
+	}
+	return filter
+}
+
+// handleMembershipRevoked records the revocation for tenantMiddleware, and
+// stops the user's subscriptions in the organization from receiving what
+// they no longer may: all events once they have left it, billing events
+// once they are no longer an admin there.
+func handleMembershipRevoked(ctx context.Context, event eventbus.Event) error {
+	if err := tenants.Handle(ctx, event); err != nil {
+		return err
+	}
+	var data struct {
+		OrgID  primitive.ObjectID `json:"org_id"`
+		UserID primitive.ObjectID `json:"user_id"`
+		Role   string             `json:"role"`
+	}
+	if err := json.Unmarshal(event.Data, &data); err != nil {
+		log.Printf("Ignoring malformed %s event %s: %v", event.Type, event.ID, err)
+		return nil
+	}
+
+	filter := bson.M{"org_id": data.OrgID, "user_id": data.UserID}
+	update := bson.M{"$set": bson.M{"active": false}}
+	if data.Role != "" {
+		update = bson.M{"$set": bson.M{"role": data.Role}}
+	}
+	_, err := subscriptions().UpdateMany(ctx, filter, update)
+	return err
+}
@@ -0,0 +1,674 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/auth"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/eventbus"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/health"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/logging"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/metrics"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/problem"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/server"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tenant"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/tracing"
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/validate"
+)
+
+var client *mongo.Client
+
+// eventSource names the service in the events it publishes and its logs
+const eventSource = "webhook-service"
+
+var bus eventbus.Broker
+
+// Events that subscriptions may register for. "*" subscribes to all of them.
+var knownEvents = map[string]bool{
+	"task.created":        true,
+	"task.status_changed": true,
+	"task.completed":      true,
+	"billing.created":     true,
+	"invoice.created":     true,
+}
+
+const (
+	maxDeliveryAttempts = 8
+	retryBaseDelay      = 30 * time.Second
+	deliveryTimeout     = 10 * time.Second
+)
+
+func main() {
+	logging.Setup(eventSource)
+	shutdownTracing := tracing.Setup(eventSource)
+	defer shutdownTracing(context.Background())
+
+	// Create a new MongoDB client
+	var err error
+	client, err = mongo.NewClient(options.Client().ApplyURI("mongodb://webhook-mongodb:27017").SetMonitor(metrics.MongoMonitor()))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Connect to MongoDB
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = client.Connect(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Disconnect(context.Background())
+	health.AddCheck("mongodb", health.PingMongo(client))
+
+	// Check if the database and collections exist, create them if they don't
+	err = ensureDatabaseAndCollections(client)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Every subscription belongs to an organization
+	err = ensureTenancy(client)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Tokens outlive memberships, so revoked ones are recorded
+	tenants, err = tenant.NewRevocations(client.Database("webhook").Collection("revocations"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Connect to the event bus
+	bus, err = eventbus.Connect()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer bus.Close()
+	health.AddCheck("eventbus", bus.Ping)
+
+	// Consume events from the other services
+	if err := startConsumers(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Retry failed deliveries in the background
+	server.Go(deliveryWorker)
+
+	// Create a new HTTP server
+	mux := http.NewServeMux()
+
+	// Webhook endpoints
+	mux.Handle("/webhooks/create", tenantMiddleware(http.HandlerFunc(createSubscription)))
+	mux.Handle("/webhooks/list", tenantMiddleware(http.HandlerFunc(listSubscriptions)))
+	mux.Handle("/webhooks/get/", tenantMiddleware(http.HandlerFunc(getSubscription)))
+	mux.Handle("/webhooks/remove/", tenantMiddleware(http.HandlerFunc(removeSubscription)))
+	mux.Handle("/webhooks/deliveries/", tenantMiddleware(http.HandlerFunc(listDeliveries)))
+	mux.Handle("/webhooks/redeliver/", tenantMiddleware(http.HandlerFunc(redeliver)))
+
+	// Liveness and readiness checks, used by the API gateway and Kubernetes
+	mux.HandleFunc("/healthz", health.Healthz)
+	mux.HandleFunc("/readyz", health.Readyz)
+
+	// Prometheus metrics
+	prometheus.MustRegister(metrics.NewCountGauge("webhook_deliveries_pending", "Deliveries waiting for their first or a further attempt.",
+		deliveries, bson.M{"status": "pending"}))
+	mux.Handle("/metrics", promhttp.Handler())
+
+	// Start the server
+	log.Println("Webhook Service listening on port 8004...")
+	route := metrics.MuxRoute(mux)
+	server.Run(":8004", tracing.Middleware(logging.Middleware(metrics.Middleware(auth.RequireScopes(mux), route)), route))
+}
+
+func ensureDatabaseAndCollections(client *mongo.Client) error {
+	dbName := "webhook"
+
+	collections, err := client.Database(dbName).ListCollectionNames(context.Background(), bson.M{})
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool)
+	for _, coll := range collections {
+		existing[coll] = true
+	}
+
+	for _, collectionName := range []string{"subscriptions", "deliveries"} {
+		if existing[collectionName] {
+			continue
+		}
+		err = client.Database(dbName).CreateCollection(context.Background(), collectionName)
+		if err != nil {
+			return err
+		}
+		log.Printf("Created collection '%s' in database '%s'", collectionName, dbName)
+	}
+
+	// Deliveries are polled by status and next attempt time. An event is
+	// queued at most once per subscription; redeliveries are extra.
+	_, err = client.Database(dbName).Collection("deliveries").Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt", Value: 1}}},
+		{
+			Keys: bson.D{{Key: "subscription_id", Value: 1}, {Key: "event_id", Value: 1}},
+			Options: options.Index().
+				SetName("subscription_event_id").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"redelivery": false}),
+		},
+	})
+	return err
+}
+
+type Subscription struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	OrgID     primitive.ObjectID `bson:"org_id" json:"org_id"`
+	Role      string             `bson:"role" json:"role"` // the creator's: admin or member
+	URL       string             `bson:"url" json:"url"`
+	Events    []string           `bson:"events" json:"events"`
+	Secret    string             `bson:"secret" json:"secret,omitempty"`
+	Active    bool               `bson:"active" json:"active"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+type Delivery struct {
+	ID             primitive.ObjectID `bson:"_id" json:"id"`
+	SubscriptionID primitive.ObjectID `bson:"subscription_id" json:"subscription_id"`
+	EventID        string             `bson:"event_id" json:"event_id"`
+	Event          string             `bson:"event" json:"event"`
+	Payload        string             `bson:"payload" json:"payload"`
+	Status         string             `bson:"status" json:"status"` // pending, succeeded or failed
+	Redelivery     bool               `bson:"redelivery" json:"redelivery"`
+	Attempts       int                `bson:"attempts" json:"attempts"`
+	ResponseCode   int                `bson:"response_code,omitempty" json:"response_code,omitempty"`
+	LastError      string             `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	NextAttempt    time.Time          `bson:"next_attempt" json:"next_attempt"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+	DeliveredAt    *time.Time         `bson:"delivered_at,omitempty" json:"delivered_at,omitempty"`
+}
+
+func subscriptions() *mongo.Collection {
+	return client.Database("webhook").Collection("subscriptions")
+}
+
+func deliveries() *mongo.Collection {
+	return client.Database("webhook").Collection("deliveries")
+}
+
+// findOwnedSubscription loads a subscription of the request's organization,
+// allowing access to its owner and to admins.
+func findOwnedSubscription(req *http.Request, id string) (Subscription, int, error) {
+	var sub Subscription
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return sub, http.StatusBadRequest, fmt.Errorf("Invalid subscription ID")
+	}
+
+	err = subscriptions().FindOne(tracing.Traced(req), tenant.InOrg(req, bson.M{"_id": objectID})).Decode(&sub)
+	if err != nil {
+		return sub, http.StatusNotFound, fmt.Errorf("Subscription not found")
+	}
+
+	if !isAdmin(req) && sub.UserID.Hex() != req.Context().Value("userID") {
+		return sub, http.StatusNotFound, fmt.Errorf("Subscription not found")
+	}
+	return sub, http.StatusOK, nil
+}
+
+// minSecretLength is the shortest signing secret a caller may choose, in
+// bytes. Generated secrets are 32 random bytes, hex encoded.
+const minSecretLength = 16
+
+func createSubscription(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var sub Subscription
+	if errs := validate.DecodeBody(req, &sub); errs != nil {
+		problem.Validation(w, http.StatusBadRequest, errs)
+		return
+	}
+
+	var errs validate.Errors
+	target, err := url.Parse(sub.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		errs.Add("url", "must be an http or https URL")
+	} else if err := checkTargetHost(req.Context(), target.Hostname()); err != nil {
+		errs.Add("url", "host %v", err)
+	}
+	if len(sub.Events) == 0 {
+		errs.Add("events", "must contain at least one event")
+	}
+	for _, event := range sub.Events {
+		if event != "*" && !knownEvents[event] {
+			errs.Add("events", "unknown event: %s", event)
+		}
+	}
+	if sub.Secret != "" && len(sub.Secret) < minSecretLength {
+		errs.Add("secret", "must be at least %d bytes", minSecretLength)
+	}
+	if len(errs) > 0 {
+		problem.Validation(w, http.StatusUnprocessableEntity, errs)
+		return
+	}
+
+	userID, err := primitive.ObjectIDFromHex(req.Context().Value("userID").(string))
+	if err != nil {
+		problem.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	// Generate a signing secret unless the caller supplied one
+	if sub.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			problem.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+			return
+		}
+		sub.Secret = hex.EncodeToString(secret)
+	}
+
+	sub.ID = primitive.NewObjectID()
+	sub.UserID = userID
+	sub.OrgID = tenant.Org(req)
+	sub.Role = "member"
+	if isAdmin(req) {
+		sub.Role = "admin"
+	}
+	sub.Active = true
+	sub.CreatedAt = time.Now().UTC()
+
+	_, err = subscriptions().InsertOne(tracing.Traced(req), sub)
+	if err != nil {
+		log.Printf("Failed to create subscription: %v", err)
+		problem.Error(w, "Failed to create subscription", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Webhook subscription %s created for %v", sub.ID.Hex(), sub.Events)
+	// The secret is only returned once, on creation
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sub)
+}
+
+func listSubscriptions(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter := tenant.InOrg(req, bson.M{})
+	if !isAdmin(req) {
+		userID, err := primitive.ObjectIDFromHex(req.Context().Value("userID").(string))
+		if err != nil {
+			problem.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		filter["user_id"] = userID
+	}
+
+	cursor, err := subscriptions().Find(tracing.Traced(req), filter)
+	if err != nil {
+		problem.Error(w, "Failed to list subscriptions", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	subs := []Subscription{}
+	if err = cursor.All(context.Background(), &subs); err != nil {
+		problem.Error(w, "Failed to decode subscriptions", http.StatusInternalServerError)
+		return
+	}
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subs)
+}
+
+func getSubscription(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sub, status, err := findOwnedSubscription(req, req.URL.Path[len("/webhooks/get/"):])
+	if err != nil {
+		problem.Error(w, err.Error(), status)
+		return
+	}
+	sub.Secret = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sub)
+}
+
+func removeSubscription(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodDelete {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sub, status, err := findOwnedSubscription(req, req.URL.Path[len("/webhooks/remove/"):])
+	if err != nil {
+		problem.Error(w, err.Error(), status)
+		return
+	}
+
+	_, err = subscriptions().DeleteOne(tracing.Traced(req), bson.M{"_id": sub.ID})
+	if err != nil {
+		problem.Error(w, "Failed to remove subscription", http.StatusInternalServerError)
+		return
+	}
+
+	// Stop retrying anything still queued for the removed subscription
+	_, err = deliveries().UpdateMany(tracing.Traced(req),
+		bson.M{"subscription_id": sub.ID, "status": "pending"},
+		bson.M{"$set": bson.M{"status": "failed", "last_error": "subscription removed"}})
+	if err != nil {
+		log.Printf("Failed to cancel pending deliveries for %s: %v", sub.ID.Hex(), err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listDeliveries(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sub, status, err := findOwnedSubscription(req, req.URL.Path[len("/webhooks/deliveries/"):])
+	if err != nil {
+		problem.Error(w, err.Error(), status)
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(100)
+	cursor, err := deliveries().Find(tracing.Traced(req), bson.M{"subscription_id": sub.ID}, opts)
+	if err != nil {
+		problem.Error(w, "Failed to list deliveries", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	history := []Delivery{}
+	if err = cursor.All(context.Background(), &history); err != nil {
+		problem.Error(w, "Failed to decode deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+func redeliver(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		problem.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deliveryID, err := primitive.ObjectIDFromHex(req.URL.Path[len("/webhooks/redeliver/"):])
+	if err != nil {
+		problem.Error(w, "Invalid delivery ID", http.StatusBadRequest)
+		return
+	}
+
+	var original Delivery
+	err = deliveries().FindOne(tracing.Traced(req), bson.M{"_id": deliveryID}).Decode(&original)
+	if err != nil {
+		problem.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+
+	sub, status, err := findOwnedSubscription(req, original.SubscriptionID.Hex())
+	if err != nil {
+		problem.Error(w, err.Error(), status)
+		return
+	}
+
+	// Redelivery is recorded as a new delivery so the log keeps the original
+	// attempt. It is due right away, so the delivery worker picks it up.
+	delivery := newDelivery(sub, original.EventID, original.Event, original.Payload)
+	delivery.Redelivery = true
+	delivery.NextAttempt = delivery.CreatedAt
+	_, err = deliveries().InsertOne(tracing.Traced(req), delivery)
+	if err != nil {
+		problem.Error(w, "Failed to queue redelivery", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(delivery)
+}
+
+// startConsumers relays the events subscriptions can register for to the delivery queue.
+func startConsumers() error {
+	types := []string{tenant.RevokedEvent}
+	for eventType := range knownEvents {
+		types = append(types, eventType)
+	}
+	return bus.Subscribe(server.Background(), "webhook-service", types, func(ctx context.Context, event eventbus.Event) error {
+		if event.Type == tenant.RevokedEvent {
+			return handleMembershipRevoked(ctx, event)
+		}
+		_, err := fanOut(event)
+		return err
+	})
+}
+
+// fanOut records one delivery per active subscription of the event's
+// organization interested in it, and makes the first attempt for each in
+// the background.
+func fanOut(event eventbus.Event) (int, error) {
+	orgID, ok := eventOrg(event)
+	if !ok {
+		log.Printf("Event %s (%s) names no organization, not delivered", event.Type, event.ID)
+		return 0, nil
+	}
+	cursor, err := subscriptions().Find(context.TODO(), subscriptionFilter(event, orgID))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(context.Background())
+
+	var subs []Subscription
+	if err = cursor.All(context.Background(), &subs); err != nil {
+		return 0, err
+	}
+
+	// The bus sequence number is internal to the broker
+	event.Seq = 0
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, sub := range subs {
+		// Events are delivered at least once; the unique index on the
+		// subscription and event skips subscriptions already queued
+		delivery := newDelivery(sub, event.ID, event.Type, string(payload))
+		_, err := deliveries().InsertOne(context.TODO(), delivery)
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		sub := sub
+		server.Go(func() { attemptDelivery(sub, &delivery) })
+	}
+
+	log.Printf("Event %s (%s) queued for %d subscription(s)", event.Type, event.ID, len(subs))
+	return len(subs), nil
+}
+
+func newDelivery(sub Subscription, eventID, event, payload string) Delivery {
+	now := time.Now().UTC()
+	return Delivery{
+		ID:             primitive.NewObjectID(),
+		SubscriptionID: sub.ID,
+		EventID:        eventID,
+		Event:          event,
+		Payload:        payload,
+		Status:         "pending",
+		// The first attempt is made right away; this only matters if it never completes
+		NextAttempt: now.Add(retryBaseDelay),
+		CreatedAt:   now,
+	}
+}
+
+// signPayload returns the hex HMAC-SHA256 of "<timestamp>.<payload>" so
+// receivers can reject both forged and replayed requests.
+func signPayload(secret, timestamp, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryDelay is the exponential backoff before the given attempt number.
+func retryDelay(attempts int) time.Duration {
+	return retryBaseDelay * time.Duration(1<<uint(attempts-1))
+}
+
+// attemptDelivery posts the payload once and records the outcome,
+// scheduling the next retry or giving up after maxDeliveryAttempts.
+func attemptDelivery(sub Subscription, delivery *Delivery) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest("POST", sub.URL, bytes.NewBufferString(delivery.Payload))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Webhook-Event", delivery.Event)
+		req.Header.Set("X-Webhook-Delivery", delivery.ID.Hex())
+		req.Header.Set("X-Webhook-Timestamp", timestamp)
+		req.Header.Set("X-Webhook-Signature", "sha256="+signPayload(sub.Secret, timestamp, delivery.Payload))
+
+		var resp *http.Response
+		resp, err = deliveryClient.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			delivery.ResponseCode = resp.StatusCode
+			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+				err = fmt.Errorf("endpoint responded with status %d", resp.StatusCode)
+			}
+		}
+	}
+
+	delivery.Attempts++
+	now := time.Now().UTC()
+	switch {
+	case err == nil:
+		delivery.Status = "succeeded"
+		delivery.LastError = ""
+		delivery.DeliveredAt = &now
+	case delivery.Attempts >= maxDeliveryAttempts:
+		delivery.Status = "failed"
+		delivery.LastError = err.Error()
+	default:
+		delivery.LastError = err.Error()
+		delivery.NextAttempt = now.Add(retryDelay(delivery.Attempts))
+	}
+
+	_, updateErr := deliveries().UpdateOne(context.TODO(), bson.M{"_id": delivery.ID}, bson.M{"$set": bson.M{
+		"status":        delivery.Status,
+		"attempts":      delivery.Attempts,
+		"response_code": delivery.ResponseCode,
+		"last_error":    delivery.LastError,
+		"next_attempt":  delivery.NextAttempt,
+		"delivered_at":  delivery.DeliveredAt,
+	}})
+	if updateErr != nil {
+		log.Printf("Failed to record delivery %s: %v", delivery.ID.Hex(), updateErr)
+	}
+
+	if err != nil {
+		log.Printf("Delivery %s to %s failed (attempt %d): %v", delivery.ID.Hex(), sub.URL, delivery.Attempts, err)
+	}
+}
+
+// deliveryWorker periodically retries pending deliveries whose backoff has
+// elapsed, until the service shuts down.
+func deliveryWorker() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-server.Background().Done():
+			return
+		case <-ticker.C:
+		}
+
+		filter := bson.M{
+			"status":       "pending",
+			"next_attempt": bson.M{"$lte": time.Now().UTC()},
+		}
+		cursor, err := deliveries().Find(context.TODO(), filter, options.Find().SetLimit(50))
+		if err != nil {
+			log.Printf("Failed to load pending deliveries: %v", err)
+			continue
+		}
+
+		var due []Delivery
+		err = cursor.All(context.Background(), &due)
+		cursor.Close(context.Background())
+		if err != nil {
+			log.Printf("Failed to decode pending deliveries: %v", err)
+			continue
+		}
+
+		for i := range due {
+			// Leave the rest for the next start
+			if server.Background().Err() != nil {
+				break
+			}
+			var sub Subscription
+			err := subscriptions().FindOne(context.TODO(), bson.M{"_id": due[i].SubscriptionID}).Decode(&sub)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				cancelDelivery(due[i].ID, "subscription removed")
+				continue
+			}
+			if err != nil {
+				log.Printf("Failed to load the subscription of delivery %s: %v", due[i].ID.Hex(), err)
+				continue
+			}
+			attemptDelivery(sub, &due[i])
+		}
+	}
+}
+
+// cancelDelivery gives up on a pending delivery that can no longer be made.
+func cancelDelivery(id primitive.ObjectID, reason string) {
+	_, err := deliveries().UpdateOne(context.TODO(), bson.M{"_id": id, "status": "pending"},
+		bson.M{"$set": bson.M{"status": "failed", "last_error": reason}})
+	if err != nil {
+		log.Printf("Failed to cancel delivery %s: %v", id.Hex(), err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/DavidN0809/Cloud-Computing/final-project/shared/eventbus"
+)
+
+func TestSignPayload(t *testing.T) {
+	tests := []struct {
+		secret, timestamp, payload string
+		want                       string
+	}{
+		{"secret", "1700000000", `{"id":"1"}`, "086f6aff7bd084c98679825129c5a64dbad88c760016d6d2c0fb123f27951d54"},
+		// A different timestamp or secret gives a different signature
+		{"key", "1700000001", `{"id":"1"}`, "ff3643a7f045fd54697302170c577c988e8b29d9f4ea4afbf0404efb8e26d637"},
+		{"", "0", "", "b849d5a581847b281957065739df36df2463d1977ea8d6e1e4e6cf33fadc68c3"},
+	}
+	for _, tt := range tests {
+		if got := signPayload(tt.secret, tt.timestamp, tt.payload); got != tt.want {
+			t.Errorf("signPayload(%q, %q, %q) = %s, want %s", tt.secret, tt.timestamp, tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{4, 4 * time.Minute},
+		{maxDeliveryAttempts - 1, 32 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.attempts); got != tt.want {
+			t.Errorf("retryDelay(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestBlockedIP(t *testing.T) {
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.10", true},
+		{"169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"93.184.216.34", false},
+		{"2606:2800:220:1:248:1893:25c8:1946", false},
+	}
+	for _, tt := range tests {
+		if got := blockedIP(net.ParseIP(tt.ip)); got != tt.blocked {
+			t.Errorf("blockedIP(%s) = %v, want %v", tt.ip, got, tt.blocked)
+		}
+	}
+}
+
+func TestCheckTargetHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want error
+	}{
+		{"127.0.0.1", errBlockedTarget},
+		{"169.254.169.254", errBlockedTarget},
+		{"localhost", errBlockedTarget},
+		{"93.184.216.34", nil},
+	}
+	for _, tt := range tests {
+		if err := checkTargetHost(context.Background(), tt.host); !errors.Is(err, tt.want) {
+			t.Errorf("checkTargetHost(%q) = %v, want %v", tt.host, err, tt.want)
+		}
+	}
+}
+
+func TestDeliveryClientRefusesBlockedAddresses(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	_, err = deliveryClient.Get("http://" + listener.Addr().String())
+	if !errors.Is(err, errBlockedTarget) {
+		t.Fatalf("delivery to a loopback address: got %v, want %v", err, errBlockedTarget)
+	}
+}
+
+func TestSubscriptionFilter(t *testing.T) {
+	orgID := primitive.NewObjectID()
+	data, _ := json.Marshal(map[string]interface{}{"task_id": primitive.NewObjectID(), "org_id": orgID})
+
+	tests := []struct {
+		eventType string
+		data      json.RawMessage
+		wantOrg   bool
+		adminOnly bool
+	}{
+		{"task.created", data, true, false},
+		{"task.completed", data, true, false},
+		{"billing.created", data, true, true},
+		{"invoice.created", data, true, true},
+		{"task.created", json.RawMessage(`{"task_id":"x"}`), false, false},
+		{"task.created", json.RawMessage(`not json`), false, false},
+	}
+	for _, tt := range tests {
+		event := eventbus.Event{ID: "e1", Type: tt.eventType, Data: tt.data}
+		got, ok := eventOrg(event)
+		if ok != tt.wantOrg || (ok && got != orgID) {
+			t.Errorf("eventOrg(%s %s) = %s, %v, want org %v", tt.eventType, tt.data, got.Hex(), ok, tt.wantOrg)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		filter := subscriptionFilter(event, got)
+		if filter["org_id"] != orgID {
+			t.Errorf("%s: filter org %v, want %s", tt.eventType, filter["org_id"], orgID.Hex())
+		}
+		if _, adminOnly := filter["role"]; adminOnly != tt.adminOnly {
+			t.Errorf("%s: filter %v, admin only %v, want %v", tt.eventType, filter, adminOnly, tt.adminOnly)
+		}
+	}
+}
@@ -21,6 +21,7 @@ import Switch from '@mui/material/Switch';
 import DeleteIcon from '@mui/icons-material/Delete';
 import FilterListIcon from '@mui/icons-material/FilterList';
 import { visuallyHidden } from '@mui/utils';
+import { authHeaders } from './auth';
 
 interface Data {
   id:number;
@@ -293,7 +294,7 @@ export default function ListAllTasks() {
     const fetchTasks = async () => {
       setLoading(true);
       try {
-        const response = await fetch('http://localhost:8000/tasks/list');
+        const response = await fetch('http://localhost:8000/tasks/list', { headers: authHeaders() });
         if (!response.ok) {
           throw new Error(`HTTP error! status: ${response.status}`);
         }
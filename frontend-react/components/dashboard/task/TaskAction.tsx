@@ -10,6 +10,7 @@ import DialogActions from '@mui/material/DialogActions';
 import Title from './Title';
 import { useRouter } from 'next/navigation';
 import { AlertColor } from '@mui/material/Alert';
+import { authHeaders } from './auth';
 
 type Severity = AlertColor;
 
@@ -79,6 +80,7 @@ export default function TaskAction() {
       const response = await fetch('http://localhost:8000/tasks/create', {
         method: 'POST',
         headers: {
+          ...authHeaders(),
           'Content-Type': 'application/json'
         },
         body: JSON.stringify(taskData)
@@ -131,10 +133,19 @@ export default function TaskAction() {
     // };
 
     try {
+      // Updates must send the task's current version in If-Match
+      const current = await fetch(`http://localhost:8000/tasks/get/${task_id}`, { headers: authHeaders() });
+      if (!current.ok) {
+        throw new Error(`HTTP error! status: ${current.status}`);
+      }
+      const etag = current.headers.get('ETag') ?? '';
+
       const response = await fetch(`http://localhost:8000/tasks/update/${task_id}`, {
-        method: 'PUT', 
+        method: 'PUT',
         headers: {
-          'Content-Type': 'application/json'
+          ...authHeaders(),
+          'Content-Type': 'application/json',
+          'If-Match': etag
         },
         body: JSON.stringify(taskData)
       });
@@ -0,0 +1,6 @@
+// The task routes need the JWT saved at sign-in, which names the
+// organization whose tasks they show.
+export function authHeaders(): Record<string, string> {
+  const tokenCookie = document.cookie.split('; ').find(cookie => cookie.startsWith('token='));
+  return tokenCookie ? { Authorization: `Bearer ${tokenCookie.split('=')[1]}` } : {};
+}